@@ -0,0 +1,181 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gorilla/rpc"
+	rpcjson "github.com/gorilla/rpc/json"
+	"inmobi.com/graphite/carbon/logging"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"sync"
+)
+
+var logger *logging.Logger
+
+var mux = http.NewServeMux()
+
+/* JSON-RPC endpoint for services that alter the data held by the daemon */
+var rpcServer = rpc.NewServer()
+
+/* The config of every subsystem as it runs with it, defaults applied */
+var configs = make(map[string]interface{})
+var configLock sync.Mutex
+
+func init() {
+	logger = logging.MakeLogger("admin")
+
+	codec := rpcjson.NewCodec()
+	rpcServer.RegisterCodec(codec, "application/json")
+	rpcServer.RegisterCodec(codec, "application/json-rpc")
+	mux.Handle("/rpc", rpcServer)
+	HandleJSON("/config", serveConfig)
+}
+
+/* Records the config a subsystem runs with, once parsed & defaults applied,
+for /config to report under the name of the subsystem */
+func RegisterConfig(subsystem string, config interface{}) {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	if _, dup := configs[subsystem]; dup {
+		logger.Panicf("Config already registered for %s", subsystem)
+	}
+	configs[subsystem] = config
+}
+
+func serveConfig(r *http.Request) (interface{}, error) {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	retval := make(map[string]interface{}, len(configs))
+	for subsystem, config := range configs {
+		retval[subsystem] = config
+	}
+	return retval, nil
+}
+
+/* Exposes the methods of a receiver over JSON-RPC at /rpc on the admin
+listener; see gorilla/rpc for the method signatures expected */
+func RegisterService(receiver interface{}, name string) {
+	if err := rpcServer.RegisterService(receiver, name); err != nil {
+		logger.Panicf("Cannot register service %s: %v", name, err)
+	}
+}
+
+/* An admin endpoint; the returned value is serialized as JSON */
+type Handler func(r *http.Request) (interface{}, error)
+
+/* An error that maps onto a specific HTTP status */
+type Error struct {
+	Status int
+	Msg    string
+}
+
+func (this *Error) Error() string {
+	return this.Msg
+}
+
+func Errorf(status int, format string, v ...interface{}) error {
+	return &Error{status, fmt.Sprintf(format, v...)}
+}
+
+/* Registers a plain HTTP handler on the admin listener; for endpoints that
+need control over the response beyond what HandleJSON offers */
+func Handle(path string, h http.Handler) {
+	mux.Handle(path, h)
+}
+
+/* Registers a read only endpoint on the admin listener. Registration may
+happen before or after the listener has been started */
+func HandleJSON(path string, h Handler) {
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		serveJSON(w, r, path, h)
+	})
+}
+
+/* Registers an endpoint that changes the state of the daemon; such
+endpoints only respond to POST */
+func HandleAction(path string, h Handler) {
+	mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+		handler := h
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			handler = func(r *http.Request) (interface{}, error) {
+				return nil, Errorf(http.StatusMethodNotAllowed, "%s only supports POST", path)
+			}
+		}
+		serveJSON(w, r, path, handler)
+	})
+}
+
+func serveJSON(w http.ResponseWriter, r *http.Request, path string, h Handler) {
+	val, err := h(r)
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		status := http.StatusInternalServerError
+		if x, ok := err.(*Error); ok {
+			status = x.Status
+		}
+		w.WriteHeader(status)
+		val = map[string]string{"error": err.Error()}
+	}
+	if err := json.NewEncoder(w).Encode(val); err != nil {
+		logger.With("path", path).Errorf("%v", err)
+	}
+}
+
+/* Profiling is opt-in as it is expensive & reveals internals */
+func handlePprof() {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+/* Starts the admin listener in the background. The listener is optional;
+without a 'port' in the config no admin endpoints are served. It binds to
+the loopback interface unless 'bind' says otherwise: the endpoints delete,
+rename & close, write snapshots anywhere & reveal the config, with no
+authentication of their own */
+func Listen(config map[string]string) {
+	port_str, ok := config["port"]
+	if !ok {
+		logger.Infof("no port configured; admin endpoints are disabled")
+		return
+	}
+	port, err := strconv.ParseUint(port_str, 10, 16)
+	if err != nil {
+		panic("Error parsing value of 'port'")
+	}
+
+	profile := false
+	if val, ok := config["pprof"]; ok {
+		if profile, err = strconv.ParseBool(val); err != nil {
+			panic("Error parsing value of 'pprof'")
+		}
+	}
+	if profile {
+		logger.Infof("profiling endpoints are enabled")
+		handlePprof()
+	}
+
+	bind, ok := config["bind"]
+	if !ok {
+		bind = "127.0.0.1"
+	}
+	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", bind, port))
+	if err != nil {
+		logger.Panicln(err)
+	}
+	logger.Infof("serving on %v", l.Addr())
+	RegisterConfig("admin", struct {
+		Port  uint16
+		Bind  string
+		Pprof bool
+	}{uint16(port), bind, profile})
+	go http.Serve(l, mux)
+}
@@ -1,16 +1,25 @@
 package assembly
 
 import (
+	"fmt"
 	"github.com/vaughan0/go-ini"
+	"inmobi.com/graphite/carbon/admin"
 	"inmobi.com/graphite/carbon/audit"
+	"inmobi.com/graphite/carbon/health"
 	"inmobi.com/graphite/carbon/listener"
+	"inmobi.com/graphite/carbon/logging"
 	"inmobi.com/graphite/carbon/mq"
 	"inmobi.com/graphite/carbon/storage"
-	"log"
+	"net/http"
 	"runtime"
 	"strconv"
 )
 
+var logger = logging.MakeLogger("assembly")
+
+const _MAX_BACKLOG_PERCENT = 80
+const _HEALTH_PORT = 3543
+
 type storagePipeline struct {
 	bounded_main   chan mq.MetricReading
 	audit_stream   chan mq.MetricReading
@@ -23,7 +32,9 @@ func makeListener(config map[string]string, c chan<- mq.MetricReading) *listener
 	if err != nil {
 		panic("Error parsing value of 'port'")
 	}
-	return listener.NewPlaintextReceiver(listener.PlaintextConfig{uint16(port)}, c)
+	parsed := listener.PlaintextConfig{uint16(port)}
+	admin.RegisterConfig("listener", parsed)
+	return listener.NewPlaintextReceiver(parsed, c)
 }
 
 func manageListener(l *listener.PlaintextReceiver) {
@@ -59,22 +70,86 @@ func manageWritePipelines(q storagePipeline, s storage.StorageCore) {
 	s.DispatchLoop(q.create_offload, nil, true, 1)
 }
 
+/* Exposes the state of the assembly itself on the admin listener */
+func manageAdminEndpoints(q storagePipeline, f audit.QueueDepths) {
+	capacities := audit.StoragePipelineDepths{
+		cap(q.bounded_main), cap(q.audit_stream), cap(q.create_offload) }
+
+	admin.HandleJSON("/queues", func(r *http.Request) (interface{}, error) {
+		return struct {
+			Depths     audit.StoragePipelineDepths
+			Capacities audit.StoragePipelineDepths
+		}{f(), capacities}, nil
+	})
+	admin.RegisterConfig("queues", capacities)
+}
+
+/* Readiness is lost once the main queue fills up beyond a threshold, as
+writes would soon be discarded. The probes get a listener of their own, on
+all interfaces unless 'bind' says otherwise */
+func manageHealth(config map[string]string, q storagePipeline) {
+	percent := uint64(_MAX_BACKLOG_PERCENT)
+	if val, ok := config["max-backlog-percent"]; ok {
+		var err error
+		if percent, err = strconv.ParseUint(val, 10, 8); err != nil || percent > 100 {
+			panic("Error parsing value of 'max-backlog-percent'")
+		}
+	}
+	threshold := cap(q.bounded_main) * int(percent) / 100
+
+	port := uint64(_HEALTH_PORT)
+	if val, ok := config["port"]; ok {
+		var err error
+		if port, err = strconv.ParseUint(val, 10, 16); err != nil {
+			panic("Error parsing value of 'port'")
+		}
+	}
+
+	health.Register("backlog", func() error {
+		if n := len(q.bounded_main); n > threshold {
+			return fmt.Errorf("backlog of %d exceeds %d", n, threshold)
+		}
+		return nil
+	})
+	health.Listen(config["bind"], uint16(port))
+	admin.RegisterConfig("health", struct {
+		Max_backlog_percent uint64
+		Port                uint16
+		Bind                string
+	}{percent, uint16(port), config["bind"]})
+}
+
 func manageAudit(c chan mq.MetricReading, f audit.QueueDepths) {
 	audit.InitMetrics(c, f)
 }
 
+func manageAdmin(config map[string]string) {
+	admin.Listen(config)
+}
+
 func concurrency(s string) {
 	if c, err := strconv.ParseInt(s, 10, 16); err == nil {
-		log.Printf("Concurrency level is %d\n", c)
+		logger.Infof("Concurrency level is %d", c)
 		runtime.GOMAXPROCS(int(c))
 	}
 }
 
+func manageLogging(config map[string]string) {
+	if err := logging.Configure(config); err != nil {
+		panic("Error configuring logging " + err.Error())
+	}
+}
+
 func BuildallAndRun(file ini.File) {
+	manageLogging(file.Section("logging"))
+
 	gmp, _ := file.Get("", "GOMAXPROCS")
 	concurrency(gmp)
 
+	manageAdmin(file.Section("admin"))
+
 	queues := manageStorageQueues(file.Section("storage"))
+	manageHealth(file.Section("health"), queues)
 
 	storage := manageStorageEngine(file.Section("storage"), file.Section("storage-engine"))
 
@@ -86,6 +161,7 @@ func BuildallAndRun(file ini.File) {
 	}
 
 	manageAudit(queues.audit_stream, depthCalculator)
+	manageAdminEndpoints(queues, depthCalculator)
 
 	listener := makeListener(file.Section("listener"), queues.bounded_main)
 	manageListener(listener)
@@ -0,0 +1,50 @@
+package audit
+
+import (
+	"inmobi.com/graphite/carbon/mq"
+	"sort"
+	"sync"
+)
+
+/* Receives a single sampled value; the metric name is relative to the
+namespace of the collector that emits it */
+type Emitter func(metric string, val float64)
+
+/* A source of values that are not tallied inline by the write path but are
+instead sampled once per reporting interval (e.g. storage engine internals) */
+type Collector func(emit Emitter)
+
+var collectors = make(map[string]Collector)
+var collectorLock sync.Mutex
+
+/* Registers a collector whose values are published under prefix "name." */
+func RegisterCollector(name string, c Collector) {
+	collectorLock.Lock()
+	defer collectorLock.Unlock()
+
+	if _, dup := collectors[name]; dup {
+		logger.Panicf("Collector already registered under the name of %s", name)
+	}
+	collectors[name] = c
+}
+
+func writeCollectors(c chan<- mq.MetricReading, prefix string, ts uint64) {
+	collectorLock.Lock()
+	names := make([]string, 0, len(collectors))
+	for name := range collectors {
+		names = append(names, name)
+	}
+	collectorLock.Unlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		collectorLock.Lock()
+		f := collectors[name]
+		collectorLock.Unlock()
+
+		namespace := prefix + name + "."
+		f(func(metric string, val float64) {
+			c <- mq.MetricReading{namespace + metric, val, ts}
+		})
+	}
+}
@@ -4,25 +4,28 @@ import (
 	"fmt"
 	"inmobi.com/graphite/carbon/logging"
 	"inmobi.com/graphite/carbon/mq"
-	"log"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 )
 
 var metrics *CarbonStats
+var metricsLock sync.RWMutex // guards metrics against the interval resets
 var create sync.Mutex
 
 var metricPrefix = _makeMetricPrefix()
 
-var logger *log.Logger
+var logger *logging.Logger
 
 func init() {
-	logger = logging.MakeLogger("audit: ")
+	logger = logging.MakeLogger("audit")
 }
 
 func GetMetrics() *CarbonStats {
+	metricsLock.RLock()
+	defer metricsLock.RUnlock()
 	return metrics
 }
 
@@ -30,8 +33,10 @@ func InitMetrics(c chan<- mq.MetricReading, f QueueDepths) {
 	create.Lock()
 	defer create.Unlock()
 
-	if metrics == nil {
+	if GetMetrics() == nil {
+		metricsLock.Lock()
 		metrics = new(CarbonStats)
+		metricsLock.Unlock()
 
 		ticker := time.Tick(60 * time.Second)
 		go func() {
@@ -45,21 +50,27 @@ func InitMetrics(c chan<- mq.MetricReading, f QueueDepths) {
 
 func resetMetrics(c chan<- mq.MetricReading, f QueueDepths) {
 	var snapshot *CarbonStats
+	metricsLock.Lock()
 	snapshot, metrics = metrics, new(CarbonStats)
+	metricsLock.Unlock()
 	now := time.Now()
 	go snapshot.writeInstance(c, now, f)
 }
 
 func (this *CarbonStats) writeInstance(c chan<- mq.MetricReading, t time.Time, f QueueDepths) {
 	time.Sleep(10 * time.Second) // Wait for things to catchup
-	logger.Printf("%d %s\n", t, logging.ObjectJsonifier(this))
+	this.flushLock.Lock()
+	logger.Infof("%d %s", t.Unix(), logging.ObjectJsonifier(this))
+	this.flushLock.Unlock()
 	ts := uint64(t.Unix())
 
 	_write32(c, metricPrefix+"metrics_received", this.Metrics_received, ts)
 	_write32(c, metricPrefix+"garbled_reception", this.Garbled_reception, ts)
 	this.Writer.writeInstance(c, metricPrefix+"writer.", ts)
+	this.writeFlushInstances(c, metricPrefix+"writer.flush.", ts)
 	queue_stats := f()
 	_write32(c, metricPrefix+"writer.cached_datapoints", uint32(queue_stats.getUsage()) , ts)
+	writeCollectors(c, metricPrefix, ts)
 }
 
 func (this *WriterStats) writeInstance(c chan<- mq.MetricReading, prefix string, ts uint64) {
@@ -71,11 +82,41 @@ func (this *WriterStats) writeInstance(c chan<- mq.MetricReading, prefix string,
 	_write32(c, prefix+"datapoints_written", this.Datapoints_written, ts)
 	_write32(c, prefix+"metric_create_errors", this.Metric_create_errors, ts)
 	_write32(c, prefix+"metrics_created", this.Metrics_created, ts)
+	_write32(c, prefix+"shortcode_collisions", this.Shortcode_collisions, ts)
+	_write32(c, prefix+"scrub_aliases", this.Scrub_aliases, ts)
 	_write32(c, prefix+"write_errors", this.Write_errors, ts)
 	_write32(c, prefix+"write_operations", this.Write_operations, ts)
 	_write32(c, prefix+"write_ratelimit_exceeded", this.Write_ratelimit_exceeded, ts)
 }
 
+func (this *CarbonStats) writeFlushInstances(c chan<- mq.MetricReading, prefix string, ts uint64) {
+	this.flushLock.Lock()
+	keys := make([]string, 0, len(this.Flush))
+	for k := range this.Flush {
+		keys = append(keys, k)
+	}
+	this.flushLock.Unlock()
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		this.flushLock.Lock()
+		x := this.Flush[k]
+		this.flushLock.Unlock()
+		x.writeInstance(c, prefix+k+".", ts)
+	}
+}
+
+func (this *FlushStats) writeInstance(c chan<- mq.MetricReading, prefix string, ts uint64) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.Batch_size.writeInstance(c, prefix+"batch_size.", ts)
+	this.Flush_microseconds.writeInstance(c, prefix+"flush_microseconds.", ts)
+	this.Queue_depth.writeInstance(c, prefix+"queue_depth.", ts)
+
+	_write32(c, prefix+"flushes", this.Flushes, ts)
+	_write32(c, prefix+"flush_errors", this.Flush_errors, ts)
+}
+
 func (this *MinAvgMax) writeInstance(c chan<- mq.MetricReading, prefix string, ts uint64) {
 	_write32p(c, prefix+"min", this.Min, ts)
 	_write32p(c, prefix+"max", this.Max, ts)
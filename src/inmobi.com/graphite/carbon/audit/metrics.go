@@ -1,6 +1,9 @@
 package audit
 
 import (
+	"encoding/json"
+	"fmt"
+	"sync"
 	"sync/atomic"
 )
 
@@ -28,17 +31,87 @@ type WriterStats struct {
 	Metric_create_errors uint32
 	Metrics_created      uint32
 
+	Shortcode_collisions uint32 // a new metric's short code was owned by another
+	Scrub_aliases        uint32 // a raw name resolved to a metric created from another
+
 	Write_errors             uint32
 	Write_operations         uint32
 	Write_ratelimit_exceeded uint32
 }
 
+/* Tallies of a single storage engine writer that flushes in batches */
+type FlushStats struct {
+	Flushes            uint32
+	Flush_errors       uint32
+	Batch_size         MinAvgMax
+	Flush_microseconds MinAvgMax
+	Queue_depth        MinAvgMax
+
+	lock sync.Mutex // a shard open both for writes & for reads shares these
+}
+
 type CarbonStats struct {
 	Writer            WriterStats
 	cpu_usage         uint32 // unsupported
 	mem_usage         uint32 // unsupported
 	Metrics_received  uint32
 	Garbled_reception uint32 // our addition
+
+	Flush     map[string]*FlushStats // keyed by partition & writer id
+	flushLock sync.Mutex
+}
+
+/* Fetches the flush stats of a given writer of a given partition for the
+current reporting interval. Callers must not hold on to the return value
+across intervals */
+func (stats *CarbonStats) FlushStats(partition string, writer uint8) *FlushStats {
+	key := fmt.Sprintf("%s.%02d", partition, writer)
+
+	stats.flushLock.Lock()
+	defer stats.flushLock.Unlock()
+
+	if stats.Flush == nil {
+		stats.Flush = make(map[string]*FlushStats)
+	}
+	retval, ok := stats.Flush[key]
+	if !ok {
+		retval = new(FlushStats)
+		stats.Flush[key] = retval
+	}
+	return retval
+}
+
+/* Marshals the tallies as they are, in the face of writers still recording
+into them */
+func (stats *FlushStats) MarshalJSON() ([]byte, error) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	return json.Marshal(struct {
+		Flushes            uint32
+		Flush_errors       uint32
+		Batch_size         MinAvgMax
+		Flush_microseconds MinAvgMax
+		Queue_depth        MinAvgMax
+	}{stats.Flushes, stats.Flush_errors, stats.Batch_size, stats.Flush_microseconds, stats.Queue_depth})
+}
+
+/* Records the depth of the queue of a writer as it flushes */
+func (stats *FlushStats) RecordQueueDepth(depth uint32) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	stats.Queue_depth.RecordMeasurement(depth)
+}
+
+/* Records a flush of n datapoints that took micros, failed or not */
+func (stats *FlushStats) RecordFlush(n uint32, micros uint32, failed bool) {
+	stats.lock.Lock()
+	defer stats.lock.Unlock()
+	atomic.AddUint32(&stats.Flushes, 1)
+	stats.Batch_size.RecordMeasurement(n)
+	stats.Flush_microseconds.RecordMeasurement(micros)
+	if failed {
+		atomic.AddUint32(&stats.Flush_errors, 1)
+	}
 }
 
 func (stats *MinAvgMax) RecordMeasurement(val uint32) {
@@ -9,7 +9,6 @@ import (
 	// import storage modules
 	_ "inmobi.com/graphite/carbon/devnull"
 	_ "inmobi.com/graphite/carbon/leveltsd"
-	_ "net/http/pprof"
 )
 
 func main() {
@@ -0,0 +1,153 @@
+/*
+Backfills datapoints in the carbon plaintext protocol, one "metric value
+timestamp" per line, read from the files named or stdin. With -backfill the
+lines are streamed to the backfill listener of a running daemon, which writes
+them off the live pipeline; otherwise they are written to the root directly
+and the daemon must be stopped. Exits with 1 when some lines are garbled or
+cannot be written
+*/
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/vaughan0/go-ini"
+	"inmobi.com/graphite/carbon/leveltsd"
+	"inmobi.com/graphite/carbon/logging"
+	"io"
+	"net"
+	"os"
+)
+
+func main() {
+	config := flag.String("c", "", "config file path; the [storage-engine] section is used")
+	root := flag.String("root", "", "leveltsd root; overrides the one in the config file")
+	backfillAddr := flag.String("backfill", "", "host:port of the backfill listener of a running daemon")
+	bufferPoints := flag.Int("buffer-points", 5000000, "datapoints held in memory between checkpoints when writing to the root")
+	verbose := flag.Bool("v", false, "log progress")
+	flag.Parse()
+
+	inputs := make([]io.Reader, 0)
+	for _, path := range flag.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			fail(err.Error())
+		}
+		defer f.Close()
+		inputs = append(inputs, f)
+	}
+	if len(inputs) == 0 {
+		inputs = append(inputs, os.Stdin)
+	}
+	in := io.MultiReader(inputs...)
+
+	if *backfillAddr != "" {
+		n, err := stream(*backfillAddr, in)
+		if err != nil {
+			fail(err.Error())
+		}
+		if *verbose {
+			fmt.Fprintf(os.Stderr, "%d byte(s) sent; see /backfill on the admin port for progress\n", n)
+		}
+		return
+	}
+
+	engine := make(map[string]string)
+	if *config != "" {
+		file, err := ini.LoadFile(*config)
+		if err != nil {
+			fail("Error reading config file " + err.Error())
+		}
+		for k, v := range file.Section("storage-engine") {
+			engine[k] = v
+		}
+	}
+	if *root != "" {
+		engine["root"] = *root
+	}
+	if engine["root"] == "" {
+		fail("Either of -backfill, -root or -c is needed")
+	}
+
+	level := "warn"
+	if *verbose {
+		level = "info"
+	}
+	if err := logging.Configure(map[string]string{"level": level}); err != nil {
+		fail(err.Error())
+	}
+	importer, err := leveltsd.OpenImporter(engine)
+	if err != nil {
+		fail(err.Error())
+	}
+
+	garbled, err := load(importer, in, *bufferPoints)
+	if cerr := importer.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		fail(err.Error())
+	}
+	stats := importer.Stats
+	fmt.Printf("%d datapoint(s) written, %d dropped as archived, %d garbled line(s)\n", stats.Datapoints, stats.Dropped, garbled)
+	if garbled > 0 || stats.Dropped > 0 {
+		os.Exit(1)
+	}
+}
+
+/* Sends the input over as is; the listener parses it */
+func stream(addr string, in io.Reader) (int64, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(conn, in)
+	if cerr := conn.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+/* Adds the datapoints of every line, checkpointing whenever bufferPoints are
+held; returns the number of garbled lines */
+func load(importer *leveltsd.Importer, in io.Reader, bufferPoints int) (uint64, error) {
+	var garbled uint64
+	pending := make(map[string][]leveltsd.Datapoint)
+	held := 0
+	checkpoint := func() error {
+		for metric, points := range pending {
+			if err := importer.Add(metric, points); err != nil {
+				return err
+			}
+		}
+		pending = make(map[string][]leveltsd.Datapoint)
+		held = 0
+		return importer.Checkpoint()
+	}
+
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		var metric string
+		var x leveltsd.Datapoint
+		if parts, _ := fmt.Sscanf(scanner.Text(), "%s %f %d", &metric, &x.Value, &x.Timestamp); parts != 3 {
+			garbled++
+			continue
+		}
+		pending[metric] = append(pending[metric], x)
+		if held++; held >= bufferPoints {
+			if err := checkpoint(); err != nil {
+				return garbled, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return garbled, err
+	}
+	return garbled, checkpoint()
+}
+
+func fail(msg string) {
+	fmt.Fprintln(os.Stderr, msg)
+	os.Exit(2)
+}
@@ -0,0 +1,103 @@
+/*
+Exports the datapoints of the metrics matching a glob within a time range to
+stdout, as CSV, JSON Lines or the carbon plaintext protocol. With -reader a
+running daemon streams the export over its reader port; otherwise the daemon
+must be stopped
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/vaughan0/go-ini"
+	"inmobi.com/graphite/carbon/leveltsd"
+	"inmobi.com/graphite/carbon/logging"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+func main() {
+	config := flag.String("c", "", "config file path; root is read from its [storage-engine] section")
+	root := flag.String("root", "", "leveltsd root; overrides the one in the config file")
+	readerAddr := flag.String("reader", "", "host:port of the reader listener of a running daemon")
+	glob := flag.String("glob", "", "metrics to export, e.g. servers.*.cpu.{user,system}")
+	until := flag.Int64("until", time.Now().Unix(), "end of the range, unix time, inclusive")
+	from := flag.Int64("from", 0, "start of the range, unix time; a day before -until by default")
+	format := flag.String("format", leveltsd.EXPORT_CSV, "one of csv, jsonl & plaintext")
+	verbose := flag.Bool("v", false, "log progress")
+	flag.Parse()
+
+	if *glob == "" {
+		fail("-glob is needed")
+	}
+	if *from == 0 {
+		*from = *until - 86400
+	}
+	if *from < 0 || *until < *from {
+		fail("-from must not be past -until")
+	}
+
+	if *readerAddr != "" {
+		if err := remoteExport(*readerAddr, *glob, *from, *until, *format); err != nil {
+			fail(err.Error())
+		}
+		return
+	}
+
+	if *root == "" && *config != "" {
+		file, err := ini.LoadFile(*config)
+		if err != nil {
+			fail("Error reading config file " + err.Error())
+		}
+		*root, _ = file.Get("storage-engine", "root")
+	}
+	if *root == "" {
+		fail("Either of -reader, -root or -c is needed")
+	}
+
+	level := "warn"
+	if *verbose {
+		level = "info"
+	}
+	if err := logging.Configure(map[string]string{"level": level}); err != nil {
+		fail(err.Error())
+	}
+	n, err := leveltsd.Export(*root, os.Stdout, &leveltsd.ExportRequest{*glob, uint64(*from), uint64(*until), *format})
+	if err != nil {
+		fail(err.Error())
+	}
+	if *verbose {
+		fmt.Fprintf(os.Stderr, "%d datapoint(s) exported\n", n)
+	}
+}
+
+func remoteExport(addr string, glob string, from int64, until int64, format string) error {
+	query := url.Values{
+		"glob":   {glob},
+		"from":   {strconv.FormatInt(from, 10)},
+		"until":  {strconv.FormatInt(until, 10)},
+		"format": {format},
+	}
+	resp, err := http.Get("http://" + addr + "/export?" + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
+
+func fail(msg string) {
+	fmt.Fprintln(os.Stderr, msg)
+	os.Exit(2)
+}
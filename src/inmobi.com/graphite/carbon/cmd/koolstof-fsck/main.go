@@ -0,0 +1,76 @@
+/*
+Cross checks the indices & the shards of a leveltsd root offline; the daemon
+must be stopped beforehand. Exits with 1 when problems remain unrepaired
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/vaughan0/go-ini"
+	"inmobi.com/graphite/carbon/leveltsd"
+	"inmobi.com/graphite/carbon/logging"
+	"os"
+)
+
+func main() {
+	config := flag.String("c", "", "config file path; root is read from its [storage-engine] section")
+	root := flag.String("root", "", "leveltsd root; overrides the one in the config file")
+	repair := flag.Bool("repair", false, "bring the indices in line with each other & stamp unmarked shards")
+	purge := flag.Bool("purge-orphans", false, "delete datapoints that no metric resolves to")
+	asJson := flag.Bool("json", false, "print the report as JSON")
+	verbose := flag.Bool("v", false, "log progress")
+	flag.Parse()
+
+	if *root == "" && *config != "" {
+		file, err := ini.LoadFile(*config)
+		if err != nil {
+			fail("Error reading config file " + err.Error())
+		}
+		*root, _ = file.Get("storage-engine", "root")
+	}
+	if *root == "" {
+		fail("Either of -root or -c is needed")
+	}
+
+	level := "warn"
+	if *verbose {
+		level = "info"
+	}
+	if err := logging.Configure(map[string]string{"level": level}); err != nil {
+		fail(err.Error())
+	}
+
+	report, err := leveltsd.Fsck(*root, *repair, *purge)
+	if report != nil {
+		printReport(report, *asJson)
+	}
+	if err != nil {
+		fail(err.Error())
+	}
+	if report.Outstanding() != 0 {
+		os.Exit(1)
+	}
+}
+
+func printReport(report *leveltsd.FsckReport, asJson bool) {
+	if asJson {
+		json.NewEncoder(os.Stdout).Encode(report)
+		return
+	}
+	for _, p := range report.Problems {
+		status := ""
+		if p.Repaired {
+			status = " (repaired)"
+		}
+		fmt.Printf("%s %s #%s# %s%s\n", p.Kind, p.Db, p.Key, p.Detail, status)
+	}
+	fmt.Printf("%d metric(s), %d node(s), %d shard(s), %d archive(s); %d problem(s), %d outstanding\n",
+		report.Metrics, report.Nodes, report.Shards, report.Archives, len(report.Problems), report.Outstanding())
+}
+
+func fail(msg string) {
+	fmt.Fprintln(os.Stderr, msg)
+	os.Exit(2)
+}
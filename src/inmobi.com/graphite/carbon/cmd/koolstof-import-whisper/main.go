@@ -0,0 +1,245 @@
+/*
+Imports a tree of whisper files, as kept by stock carbon, into a leveltsd
+root; the daemon must be stopped beforehand. The path of every file under the
+tree makes for the name of its metric (a/b/c.wsp is a.b.c) and each range of
+time is taken from the most precise archive holding it.
+
+Files are parsed in parallel. Every file whose datapoints are on disk is
+recorded in a journal; a rerun skips the files recorded, so an import that
+was interrupted can be resumed. Exits with 1 when some files could not be
+imported
+*/
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/vaughan0/go-ini"
+	"inmobi.com/graphite/carbon/leveltsd"
+	"inmobi.com/graphite/carbon/logging"
+	"inmobi.com/graphite/carbon/whisper"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger *logging.Logger
+
+func init() {
+	logger = logging.MakeLogger("import-whisper")
+}
+
+type parsed struct {
+	file   string // relative to the whisper tree
+	points []whisper.Point
+	err    error
+}
+
+func main() {
+	config := flag.String("c", "", "config file path; the [storage-engine] section is used")
+	root := flag.String("root", "", "leveltsd root; overrides the one in the config file")
+	tree := flag.String("whisper", "", "root of the whisper tree")
+	prefix := flag.String("prefix", "", "prepended to the name of every metric")
+	workers := flag.Int("j", runtime.NumCPU(), "number of files parsed in parallel")
+	journalPath := flag.String("journal", "", "journal of the files imported; <root>/whisper-import.journal by default")
+	bufferPoints := flag.Int("buffer-points", 5000000, "datapoints held in memory between checkpoints")
+	nowFlag := flag.Int64("now", 0, "unix time the retention of archives is reckoned from; the present by default")
+	verbose := flag.Bool("v", false, "log progress")
+	flag.Parse()
+
+	engine := make(map[string]string)
+	if *config != "" {
+		file, err := ini.LoadFile(*config)
+		if err != nil {
+			fail("Error reading config file " + err.Error())
+		}
+		for k, v := range file.Section("storage-engine") {
+			engine[k] = v
+		}
+	}
+	if *root != "" {
+		engine["root"] = *root
+	}
+	if engine["root"] == "" {
+		fail("Either of -root or -c is needed")
+	}
+	if *tree == "" {
+		fail("-whisper is needed")
+	}
+	if *journalPath == "" {
+		*journalPath = filepath.Join(engine["root"], "whisper-import.journal")
+	}
+	now := uint32(time.Now().Unix())
+	if *nowFlag != 0 {
+		now = uint32(*nowFlag)
+	}
+
+	level := "warn"
+	if *verbose {
+		level = "info"
+	}
+	if err := logging.Configure(map[string]string{"level": level}); err != nil {
+		fail(err.Error())
+	}
+
+	done, err := readJournal(*journalPath)
+	if err != nil {
+		fail(err.Error())
+	}
+	files, err := walk(*tree, done)
+	if err != nil {
+		fail(err.Error())
+	}
+	logger.Infof("%d file(s) to import, %d imported earlier", len(files), len(done))
+
+	journal, err := os.OpenFile(*journalPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fail(err.Error())
+	}
+	defer journal.Close()
+
+	importer, err := leveltsd.OpenImporter(engine)
+	if err != nil {
+		fail(err.Error())
+	}
+
+	results := parse(*tree, files, *workers, now)
+	pending := make([]string, 0)
+	failed, imported := 0, 0
+	checkpoint := func() {
+		if err := importer.Checkpoint(); err != nil {
+			importer.Close()
+			fail(err.Error())
+		}
+		w := bufio.NewWriter(journal)
+		for _, f := range pending {
+			fmt.Fprintln(w, f)
+		}
+		if err := w.Flush(); err != nil {
+			fail(err.Error())
+		}
+		if err := journal.Sync(); err != nil {
+			fail(err.Error())
+		}
+		imported += len(pending)
+		pending = pending[:0]
+		logger.Infof("%d/%d file(s) imported; %d datapoint(s)", imported, len(files), importer.Stats.Datapoints)
+	}
+
+	for r := range results {
+		if r.err != nil {
+			logger.Errorf("%s: %v", r.file, r.err)
+			failed++
+			continue
+		}
+		points := make([]leveltsd.Datapoint, len(r.points))
+		for i, p := range r.points {
+			points[i] = leveltsd.Datapoint{uint64(p.Timestamp), p.Value}
+		}
+		if err := importer.Add(metricName(*prefix, r.file), points); err != nil {
+			logger.Errorf("%s: %v", r.file, err)
+			failed++
+			continue
+		}
+		pending = append(pending, r.file)
+		if importer.Buffered() >= *bufferPoints {
+			checkpoint()
+		}
+	}
+	checkpoint()
+	if err := importer.Close(); err != nil {
+		fail(err.Error())
+	}
+
+	fmt.Printf("%d file(s) imported, %d failed; %d datapoint(s) written, %d dropped as their shards are archived\n",
+		imported, failed, importer.Stats.Datapoints, importer.Stats.Dropped)
+	if failed != 0 {
+		os.Exit(1)
+	}
+}
+
+/* Parses files in parallel */
+func parse(tree string, files []string, workers int, now uint32) <-chan parsed {
+	queue := make(chan string)
+	retval := make(chan parsed, workers)
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range queue {
+				points, err := whisper.Dump(filepath.Join(tree, f), now)
+				retval <- parsed{f, points, err}
+			}
+		}()
+	}
+	go func() {
+		for _, f := range files {
+			queue <- f
+		}
+		close(queue)
+		wg.Wait()
+		close(retval)
+	}()
+	return retval
+}
+
+/* The whisper files under a tree, relative to it, save for those done */
+func walk(tree string, done map[string]bool) ([]string, error) {
+	retval := make([]string, 0)
+	err := filepath.Walk(tree, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".wsp") {
+			return nil
+		}
+		rel, err := filepath.Rel(tree, path)
+		if err != nil {
+			return err
+		}
+		if !done[rel] {
+			retval = append(retval, rel)
+		}
+		return nil
+	})
+	sort.Strings(retval)
+	return retval, err
+}
+
+func readJournal(path string) (map[string]bool, error) {
+	retval := make(map[string]bool)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return retval, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		retval[scanner.Text()] = true
+	}
+	return retval, scanner.Err()
+}
+
+/* a/b/c.wsp is a.b.c */
+func metricName(prefix string, file string) string {
+	name := strings.Replace(strings.TrimSuffix(file, ".wsp"), string(filepath.Separator), ".", -1)
+	if prefix != "" {
+		return strings.TrimSuffix(prefix, ".") + "." + name
+	}
+	return name
+}
+
+func fail(msg string) {
+	fmt.Fprintln(os.Stderr, msg)
+	os.Exit(2)
+}
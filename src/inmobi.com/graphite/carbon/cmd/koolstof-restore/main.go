@@ -0,0 +1,57 @@
+/*
+Restores a snapshot taken by koolstof-snapshot into a leveltsd root; the
+daemon must be stopped beforehand. A root already holding data is only
+replaced with -force
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/vaughan0/go-ini"
+	"inmobi.com/graphite/carbon/leveltsd"
+	"inmobi.com/graphite/carbon/logging"
+	"os"
+)
+
+func main() {
+	config := flag.String("c", "", "config file path; root is read from its [storage-engine] section")
+	root := flag.String("root", "", "leveltsd root; overrides the one in the config file")
+	snapshot := flag.String("snapshot", "", "directory holding the snapshot")
+	force := flag.Bool("force", false, "delete the data the root already holds")
+	verbose := flag.Bool("v", false, "log progress")
+	flag.Parse()
+
+	if *snapshot == "" {
+		fail("-snapshot is needed")
+	}
+	if *root == "" && *config != "" {
+		file, err := ini.LoadFile(*config)
+		if err != nil {
+			fail("Error reading config file " + err.Error())
+		}
+		*root, _ = file.Get("storage-engine", "root")
+	}
+	if *root == "" {
+		fail("Either of -root or -c is needed")
+	}
+
+	level := "warn"
+	if *verbose {
+		level = "info"
+	}
+	if err := logging.Configure(map[string]string{"level": level}); err != nil {
+		fail(err.Error())
+	}
+
+	manifest, err := leveltsd.Restore(*snapshot, *root, *force)
+	if err != nil {
+		fail(err.Error())
+	}
+	fmt.Printf("restored %d db(s) & archive(s) as of %s into %s\n", len(manifest.Entries), manifest.Created, *root)
+}
+
+func fail(msg string) {
+	fmt.Fprintln(os.Stderr, msg)
+	os.Exit(2)
+}
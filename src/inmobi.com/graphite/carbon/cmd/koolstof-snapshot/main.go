@@ -0,0 +1,101 @@
+/*
+Takes a consistent snapshot of a leveltsd root into a new directory. With
+-admin the running daemon takes it, over its admin port, while it continues
+to take writes; otherwise the daemon must be stopped. Restore it with
+koolstof-restore
+*/
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/vaughan0/go-ini"
+	"inmobi.com/graphite/carbon/leveltsd"
+	"inmobi.com/graphite/carbon/logging"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	config := flag.String("c", "", "config file path; root is read from its [storage-engine] section")
+	root := flag.String("root", "", "leveltsd root; overrides the one in the config file")
+	adminAddr := flag.String("admin", "", "host:port of the admin listener of a running daemon")
+	dest := flag.String("dest", "", "directory to create & write the snapshot to")
+	asJson := flag.Bool("json", false, "print the manifest as JSON")
+	verbose := flag.Bool("v", false, "log progress")
+	flag.Parse()
+
+	if *dest == "" {
+		fail("-dest is needed")
+	}
+	abs, err := filepath.Abs(*dest)
+	if err != nil {
+		fail(err.Error())
+	}
+
+	var manifest *leveltsd.SnapshotManifest
+	if *adminAddr != "" {
+		manifest, err = remoteSnapshot(*adminAddr, abs)
+	} else {
+		if *root == "" && *config != "" {
+			file, err := ini.LoadFile(*config)
+			if err != nil {
+				fail("Error reading config file " + err.Error())
+			}
+			*root, _ = file.Get("storage-engine", "root")
+		}
+		if *root == "" {
+			fail("Either of -admin, -root or -c is needed")
+		}
+
+		level := "warn"
+		if *verbose {
+			level = "info"
+		}
+		if err := logging.Configure(map[string]string{"level": level}); err != nil {
+			fail(err.Error())
+		}
+		manifest, err = leveltsd.Snapshot(*root, abs)
+	}
+	if err != nil {
+		fail(err.Error())
+	}
+	printManifest(manifest, abs, *asJson)
+}
+
+func remoteSnapshot(addr string, dest string) (*leveltsd.SnapshotManifest, error) {
+	resp, err := http.PostForm("http://"+addr+"/snapshot", url.Values{"dest": {dest}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var failure map[string]string
+		json.NewDecoder(resp.Body).Decode(&failure)
+		return nil, fmt.Errorf("%s: %s", resp.Status, failure["error"])
+	}
+	retval := new(leveltsd.SnapshotManifest)
+	return retval, json.NewDecoder(resp.Body).Decode(retval)
+}
+
+func printManifest(manifest *leveltsd.SnapshotManifest, dest string, asJson bool) {
+	if asJson {
+		json.NewEncoder(os.Stdout).Encode(manifest)
+		return
+	}
+	counts := make(map[string]int)
+	for _, e := range manifest.Entries {
+		counts[e.Kind]++
+	}
+	fmt.Printf("%s as of %s: %d index(es), %d shard(s), %d archive(s)\n", dest, manifest.Created,
+		counts[leveltsd.SNAPSHOT_INDEX], counts[leveltsd.SNAPSHOT_SHARD], counts[leveltsd.SNAPSHOT_ARCHIVE])
+}
+
+func fail(msg string) {
+	fmt.Fprintln(os.Stderr, msg)
+	os.Exit(2)
+}
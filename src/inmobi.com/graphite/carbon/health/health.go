@@ -0,0 +1,105 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"inmobi.com/graphite/carbon/admin"
+	"inmobi.com/graphite/carbon/logging"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+var logger *logging.Logger
+
+/* A readiness check; a nil return means that the subsystem can take writes */
+type Check func() error
+
+var checks = make(map[string]Check)
+var checkLock sync.Mutex
+
+/* The probes alone, for a listener of their own */
+var mux = http.NewServeMux()
+
+func init() {
+	logger = logging.MakeLogger("health")
+	admin.Handle("/healthz", http.HandlerFunc(serveLiveness))
+	admin.Handle("/readyz", http.HandlerFunc(serveReadiness))
+	mux.HandleFunc("/healthz", serveLiveness)
+	mux.HandleFunc("/readyz", serveReadiness)
+}
+
+/* Starts a listener serving /healthz & /readyz alone in the background, so
+that probes reach them while the admin listener stays on loopback. It is up
+before the storage engine opens, thus liveness holds through a lengthy open;
+the probes reveal no more than the outcome of the checks */
+func Listen(bind string, port uint16) {
+	l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", bind, port))
+	if err != nil {
+		logger.Panicln(err)
+	}
+	logger.Infof("serving on %v", l.Addr())
+	go http.Serve(l, mux)
+}
+
+/* Adds a check to the set that decides readiness. Any subsystem may
+register checks, at any point in time */
+func Register(name string, c Check) {
+	checkLock.Lock()
+	defer checkLock.Unlock()
+
+	if _, dup := checks[name]; dup {
+		logger.Panicf("Check already registered under the name of %s", name)
+	}
+	checks[name] = c
+}
+
+/* Runs all the checks; the result maps every check to "ok" or the reason
+for it failing */
+func Ready() (map[string]string, bool) {
+	checkLock.Lock()
+	names := make([]string, 0, len(checks))
+	for name := range checks {
+		names = append(names, name)
+	}
+	checkLock.Unlock()
+	sort.Strings(names)
+
+	retval := make(map[string]string, len(names))
+	ready := true
+	for _, name := range names {
+		checkLock.Lock()
+		c := checks[name]
+		checkLock.Unlock()
+
+		if err := c(); err != nil {
+			retval[name] = err.Error()
+			ready = false
+		} else {
+			retval[name] = "ok"
+		}
+	}
+	return retval, ready
+}
+
+/* The process is alive as long as it can serve this */
+func serveLiveness(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func serveReadiness(w http.ResponseWriter, r *http.Request) {
+	results, ready := Ready()
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+		logger.Limited("not-ready").Warnf("not ready %v", logging.ObjectJsonifier(results))
+	}
+	writeJSON(w, status, results)
+}
+
+func writeJSON(w http.ResponseWriter, status int, val interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(val)
+}
@@ -0,0 +1,105 @@
+package leveltsd
+
+import (
+	"inmobi.com/graphite/carbon/admin"
+	"net/http"
+	"strconv"
+)
+
+/* Hooks up the federator's runtime inspection & control endpoints */
+func registerAdminEndpoints(federator *levelfederator) {
+	admin.HandleJSON("/leveldb", federator.serveStats)
+	admin.HandleJSON("/shards", func(r *http.Request) (interface{}, error) {
+		return federator.openShards(), nil
+	})
+	admin.HandleJSON("/shards/read", func(r *http.Request) (interface{}, error) {
+		return federator.readers.list(), nil
+	})
+	admin.HandleJSON("/metrics/conflicts", func(r *http.Request) (interface{}, error) {
+		return federator.idx.naming.list(), nil
+	})
+	admin.HandleAction("/shards/flush", func(r *http.Request) (interface{}, error) {
+		return map[string]int{"flushed": federator.flushAll()}, nil
+	})
+	admin.HandleAction("/shards/close", func(r *http.Request) (interface{}, error) {
+		id := r.FormValue("id")
+		switch err := federator.closeShard(id); err {
+		case nil:
+			return map[string]string{"closed": id}, nil
+		case errShardNotOpen:
+			return nil, admin.Errorf(http.StatusNotFound, "%s: %v", id, err)
+		case errShardBusy:
+			return nil, admin.Errorf(http.StatusConflict, "%s: %v", id, err)
+		default:
+			return nil, err
+		}
+	})
+	admin.HandleAction("/metrics/delete", func(r *http.Request) (interface{}, error) {
+		req := DeleteRequest{Path: r.FormValue("path")}
+		err := parseFlags(r, map[string]*bool{"subtree": &req.Subtree, "purge": &req.PurgeData, "dry_run": &req.DryRun})
+		if err != nil {
+			return nil, err
+		}
+		report, err := federator.deleteMetric(&req)
+		return report, maintenanceError(err, req.Path)
+	})
+	admin.HandleAction("/metrics/rename", func(r *http.Request) (interface{}, error) {
+		req := RenameRequest{From: r.FormValue("from"), To: r.FormValue("to")}
+		err := parseFlags(r, map[string]*bool{"subtree": &req.Subtree, "dry_run": &req.DryRun})
+		if err != nil {
+			return nil, err
+		}
+		if val := r.FormValue("alias_seconds"); val != "" {
+			if req.AliasSeconds, err = strconv.ParseUint(val, 10, 64); err != nil {
+				return nil, admin.Errorf(http.StatusBadRequest, "alias_seconds: %v", err)
+			}
+		}
+		report, err := federator.renameMetric(&req)
+		return report, maintenanceError(err, req.From)
+	})
+	admin.HandleAction("/snapshot", func(r *http.Request) (interface{}, error) {
+		dest := r.FormValue("dest")
+		manifest, err := federator.snapshot(dest)
+		switch err {
+		case errSnapshotDest:
+			return nil, admin.Errorf(http.StatusBadRequest, "%v", err)
+		case errSnapshotExists:
+			return nil, admin.Errorf(http.StatusConflict, "%s: %v", dest, err)
+		}
+		return manifest, err
+	})
+
+	admin.RegisterService(&MaintenanceService{federator}, "")
+}
+
+/* Parses optional boolean form values */
+func parseFlags(r *http.Request, flags map[string]*bool) error {
+	for name, flag := range flags {
+		if val := r.FormValue(name); val != "" {
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return admin.Errorf(http.StatusBadRequest, "%s: %v", name, err)
+			}
+			*flag = b
+		}
+	}
+	return nil
+}
+
+/* Maps the errors of maintenance operations onto HTTP statuses */
+func maintenanceError(err error, path string) error {
+	switch err {
+	case nil:
+		return nil
+	case errMetricNotFound:
+		return admin.Errorf(http.StatusNotFound, "%s: %v", path, err)
+	case errRootDelete, errRenameInvalid, errRenameAlias:
+		return admin.Errorf(http.StatusBadRequest, "%v", err)
+	case errRenameConflict:
+		return admin.Errorf(http.StatusConflict, "%v", err)
+	case errMigrationPending:
+		return admin.Errorf(http.StatusServiceUnavailable, "%v", err)
+	default:
+		return err
+	}
+}
@@ -0,0 +1,674 @@
+package leveltsd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/jmhodges/levigo"
+	"hash/crc32"
+	"inmobi.com/graphite/carbon/logging"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Read only archive of a shard that is no longer written to; all of its keys
+& values in order, in blocks that are flate compressed individually,
+followed by an index holding the first key of every block:
+
+	block* index footer
+
+	block   flate(record*)
+	record  uvarint(len(key)) key uvarint(len(value)) value
+	index   uvarint(number of blocks) entry*
+	entry   uvarint(len(first key)) first key uvarint(offset) uvarint(length) uvarint(crc32 of the block)
+	footer  offset of the index (8 bytes BE) length of the index (8 bytes BE) _ARCHIVE_MAGIC
+
+The scheme marker of the shard is one of the records, so an archive is read
+with the codec its shard was written with. Only the index stays in memory; a
+scan opens the file, inflates the blocks it needs & closes it
+*/
+const _ARCHIVE_MAGIC = "ksarchv1"
+
+/* Uncompressed size beyond which a block is cut */
+const _ARCHIVE_BLOCK_SIZE = 64 << 10
+
+const _ARCHIVE_FOOTER_SIZE = 16 + len(_ARCHIVE_MAGIC)
+
+var errArchiveCorrupt = errors.New("corrupt archive")
+var errArchiveAborted = errors.New("archival aborted")
+
+var aLogger *logging.Logger
+
+func init() {
+	aLogger = logging.MakeLogger("leveltsd-archive")
+}
+
+type archiveBlock struct {
+	first  []byte
+	offset uint64
+	length uint64
+	crc    uint32
+}
+
+type archive struct {
+	path   string
+	codec  shardCodec
+	blocks []archiveBlock
+	size   int64
+	logger *logging.Logger
+
+	busy     sync.RWMutex // held for reads by scans, for writes while the archive is replaced
+	released bool         // once replaced by a rewritten archive; see purgeArchive
+}
+
+/* Make the fs name for the archive of a given shard */
+func _archive_namer(baseDir string, shardId string) string {
+	return fmt.Sprintf("%s/tsd-archive-%s.arc", baseDir, shardId)
+}
+
+func _archive_label(fs_path string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(filepath.Base(fs_path), "tsd-archive-"), ".arc")
+}
+
+/* Ids of all the archived shards under a given root */
+func archiveIds(root string) []string {
+	paths, _ := filepath.Glob(_archive_namer(root, "*"))
+	retval := make([]string, 0, len(paths))
+	for _, p := range paths {
+		retval = append(retval, _archive_label(p))
+	}
+	sort.Strings(retval)
+	return retval
+}
+
+/* Writes every key of an iterator, which must be in order, to an archive.
+Gives up with errArchiveAborted once done is closed. Returns the number of
+records written */
+func writeArchive(fs_path string, it dataIterator, done chan bool) (int, error) {
+	f, err := os.Create(fs_path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	var offset uint64
+	var index []archiveBlock
+	var block bytes.Buffer
+	var first []byte
+	scratch := make([]byte, binary.MaxVarintLen64)
+
+	putUvarint := func(buf *bytes.Buffer, x uint64) {
+		buf.Write(scratch[:binary.PutUvarint(scratch, x)])
+	}
+
+	cut := func() error {
+		var compressed bytes.Buffer
+		fw, _ := flate.NewWriter(&compressed, flate.BestCompression)
+		fw.Write(block.Bytes())
+		if err := fw.Close(); err != nil {
+			return err
+		}
+		if _, err := w.Write(compressed.Bytes()); err != nil {
+			return err
+		}
+		n := uint64(compressed.Len())
+		index = append(index, archiveBlock{first, offset, n, crc32.ChecksumIEEE(compressed.Bytes())})
+		offset += n
+		block.Reset()
+		first = nil
+		return nil
+	}
+
+	n := 0
+	for it.Seek(nil); it.Valid(); it.Next() {
+		if n%_BATCH_SIZE == 0 {
+			select {
+			case <-done:
+				return n, errArchiveAborted
+			default:
+			}
+		}
+
+		k, v := it.Key(), it.Value()
+		if first == nil {
+			first = append([]byte{}, k...)
+		}
+		putUvarint(&block, uint64(len(k)))
+		block.Write(k)
+		putUvarint(&block, uint64(len(v)))
+		block.Write(v)
+		n++
+
+		if block.Len() >= _ARCHIVE_BLOCK_SIZE {
+			if err := cut(); err != nil {
+				return n, err
+			}
+		}
+	}
+	if block.Len() > 0 {
+		if err := cut(); err != nil {
+			return n, err
+		}
+	}
+
+	var idx bytes.Buffer
+	putUvarint(&idx, uint64(len(index)))
+	for _, b := range index {
+		putUvarint(&idx, uint64(len(b.first)))
+		idx.Write(b.first)
+		putUvarint(&idx, b.offset)
+		putUvarint(&idx, b.length)
+		putUvarint(&idx, uint64(b.crc))
+	}
+	footer := make([]byte, _ARCHIVE_FOOTER_SIZE)
+	binary.BigEndian.PutUint64(footer[0:8], offset)
+	binary.BigEndian.PutUint64(footer[8:16], uint64(idx.Len()))
+	copy(footer[16:], _ARCHIVE_MAGIC)
+
+	if _, err := w.Write(idx.Bytes()); err != nil {
+		return n, err
+	}
+	if _, err := w.Write(footer); err != nil {
+		return n, err
+	}
+	if err := w.Flush(); err != nil {
+		return n, err
+	}
+	return n, f.Sync()
+}
+
+/* Loads the index of an archive & looks up its codec */
+func openArchive(fs_path string) (*archive, error) {
+	f, err := os.Open(fs_path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() < int64(_ARCHIVE_FOOTER_SIZE) {
+		return nil, errArchiveCorrupt
+	}
+	footer := make([]byte, _ARCHIVE_FOOTER_SIZE)
+	if _, err := f.ReadAt(footer, stat.Size()-int64(_ARCHIVE_FOOTER_SIZE)); err != nil {
+		return nil, err
+	}
+	if string(footer[16:]) != _ARCHIVE_MAGIC {
+		return nil, errArchiveCorrupt
+	}
+	offset, length := binary.BigEndian.Uint64(footer[0:8]), binary.BigEndian.Uint64(footer[8:16])
+	if offset+length+uint64(_ARCHIVE_FOOTER_SIZE) != uint64(stat.Size()) {
+		return nil, errArchiveCorrupt
+	}
+	raw := make([]byte, length)
+	if _, err := f.ReadAt(raw, int64(offset)); err != nil {
+		return nil, err
+	}
+
+	retval := &archive{path: fs_path, size: stat.Size()}
+	retval.logger = aLogger.With("archive", fs_path)
+	r := bytes.NewReader(raw)
+	count, err := binary.ReadUvarint(r)
+	if err != nil || count > length {
+		return nil, errArchiveCorrupt
+	}
+	for i := uint64(0); i < count; i++ {
+		var b archiveBlock
+		var n, crc uint64
+		if n, err = binary.ReadUvarint(r); err != nil || n > uint64(r.Len()) {
+			return nil, errArchiveCorrupt
+		}
+		b.first = make([]byte, n)
+		io.ReadFull(r, b.first)
+		if b.offset, err = binary.ReadUvarint(r); err != nil {
+			return nil, errArchiveCorrupt
+		}
+		if b.length, err = binary.ReadUvarint(r); err != nil || b.offset+b.length > offset {
+			return nil, errArchiveCorrupt
+		}
+		if crc, err = binary.ReadUvarint(r); err != nil {
+			return nil, errArchiveCorrupt
+		}
+		b.crc = uint32(crc)
+		retval.blocks = append(retval.blocks, b)
+	}
+
+	it := &archiveIterator{a: retval, f: f}
+	it.Seek([]byte(SCHEME_MAGIC_ID))
+	if it.err != nil {
+		return nil, it.err
+	}
+	if !it.Valid() || string(it.Key()) != SCHEME_MAGIC_ID {
+		return nil, fmt.Errorf("%s lacks a schema stamp", fs_path)
+	}
+	c, ok := codecs[string(it.Value())]
+	if !ok {
+		return nil, fmt.Errorf("%s is stamped with %q, which is not a known codec", fs_path, it.Value())
+	}
+	retval.codec = c
+	return retval, nil
+}
+
+func (this *archive) newIterator() (*archiveIterator, error) {
+	f, err := os.Open(this.path)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveIterator{a: this, f: f}, nil
+}
+
+func (this *archive) dataScan(key *metricIndex, start uint64, end uint64) []Datapoint {
+	if retval := this.multiScan([]*metricIndex{key}, start, end); retval != nil {
+		return retval[0]
+	}
+	return make([]Datapoint, 0)
+}
+
+/* Nil if the archive has been replaced */
+func (this *archive) multiScan(keys []*metricIndex, start uint64, end uint64) [][]Datapoint {
+	this.busy.RLock()
+	defer this.busy.RUnlock()
+	if this.released {
+		return nil
+	}
+
+	it, err := this.newIterator()
+	if err != nil {
+		this.logger.Limited("scan").Errorf("opening failed: %v", err)
+		retval := make([][]Datapoint, len(keys))
+		for i := range retval {
+			retval[i] = make([]Datapoint, 0)
+		}
+		return retval
+	}
+	defer it.Close()
+
+	retval := scanMany(this.codec, it, this.logger, keys, start, end)
+	if it.err != nil {
+		this.logger.Limited("scan").Errorf("scan failed: %v", it.err)
+	}
+	return retval
+}
+
+/* A dataIterator over an archive; it turns invalid on an error, which is
+left in err */
+type archiveIterator struct {
+	a     *archive
+	f     *os.File
+	block int
+	keys  [][]byte
+	vals  [][]byte
+	pos   int
+	err   error
+}
+
+func (this *archiveIterator) _load(i int) {
+	this.block, this.keys, this.vals, this.pos = i, nil, nil, 0
+	b := this.a.blocks[i]
+	compressed := make([]byte, b.length)
+	if _, err := this.f.ReadAt(compressed, int64(b.offset)); err != nil {
+		this.err = err
+		return
+	}
+	if crc32.ChecksumIEEE(compressed) != b.crc {
+		this.err = errArchiveCorrupt
+		return
+	}
+	raw, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		this.err = err
+		return
+	}
+
+	for len(raw) > 0 {
+		var fields [2][]byte
+		for j := range fields {
+			n, used := binary.Uvarint(raw)
+			if used <= 0 || n > uint64(len(raw)-used) {
+				this.err = errArchiveCorrupt
+				return
+			}
+			fields[j] = raw[used : used+int(n)]
+			raw = raw[used+int(n):]
+		}
+		this.keys = append(this.keys, fields[0])
+		this.vals = append(this.vals, fields[1])
+	}
+}
+
+/* Moves on to the following blocks while past the end of the current one */
+func (this *archiveIterator) _skip() {
+	for this.err == nil && this.pos >= len(this.keys) && this.block+1 < len(this.a.blocks) {
+		this._load(this.block + 1)
+	}
+}
+
+func (this *archiveIterator) Seek(key []byte) {
+	if len(this.a.blocks) == 0 {
+		return
+	}
+	i := sort.Search(len(this.a.blocks), func(i int) bool {
+		return bytes.Compare(this.a.blocks[i].first, key) > 0
+	}) - 1
+	if i < 0 {
+		i = 0
+	}
+	this._load(i)
+	this.pos = sort.Search(len(this.keys), func(j int) bool {
+		return bytes.Compare(this.keys[j], key) >= 0
+	})
+	this._skip()
+}
+
+func (this *archiveIterator) Valid() bool {
+	return this.err == nil && this.pos < len(this.keys)
+}
+
+func (this *archiveIterator) Next() {
+	this.pos++
+	this._skip()
+}
+
+func (this *archiveIterator) Key() []byte {
+	return this.keys[this.pos]
+}
+
+func (this *archiveIterator) Value() []byte {
+	return this.vals[this.pos]
+}
+
+func (this *archiveIterator) Close() {
+	this.f.Close()
+}
+
+/* Counts the keys of an archive with any of the given short codes */
+func (this *archive) count(codes [][]byte) (uint64, error) {
+	it, err := this.newIterator()
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+
+	var n uint64
+	for _, code := range codes {
+		for it.Seek(code); it.Valid() && bytes.HasPrefix(it.Key(), code); it.Next() {
+			n++
+		}
+	}
+	return n, it.err
+}
+
+/* Writes a copy of an archive without the keys of the given short codes
+next to it; the copy is to be renamed over the archive */
+func (this *archive) without(codes [][]byte, done chan bool) (*archive, error) {
+	it, err := this.newIterator()
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	skip := make(map[string]bool, len(codes))
+	for _, code := range codes {
+		skip[string(code)] = true
+	}
+	tmp := this.path + ".tmp"
+	_, err = writeArchive(tmp, &skipIterator{it, skip}, done)
+	if err == nil {
+		err = it.err // or else the copy is cut short
+	}
+	var retval *archive
+	if err == nil {
+		retval, err = openArchive(tmp)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return retval, nil
+}
+
+/* A dataIterator passing over the keys of some short codes */
+type skipIterator struct {
+	dataIterator
+	skip map[string]bool
+}
+
+func (this *skipIterator) _skip() {
+	for this.dataIterator.Valid() {
+		if k := this.Key(); len(k) != 24 || !this.skip[string(k[:16])] {
+			return
+		}
+		this.dataIterator.Next()
+	}
+}
+
+func (this *skipIterator) Seek(key []byte) {
+	this.dataIterator.Seek(key)
+	this._skip()
+}
+
+func (this *skipIterator) Next() {
+	this.dataIterator.Next()
+	this._skip()
+}
+
+/* Rewrites the archive of a shard without the datapoints of the given short
+codes; returns the number of datapoints (that would be) deleted. Scans under way on the archive are waited for before it is
+replaced. To be invoked with snapshotLock held */
+func (this *levelfederator) purgeArchive(id string, codes [][]byte, dryRun bool) (uint64, error) {
+	this.archiveLock.RLock()
+	a, ok := this.archives[id]
+	this.archiveLock.RUnlock()
+	if !ok {
+		return 0, nil
+	}
+
+	n, err := a.count(codes)
+	if err != nil || n == 0 || dryRun {
+		return n, err
+	}
+	b, err := a.without(codes, this.done)
+	if err != nil {
+		return 0, err
+	}
+
+	a.busy.Lock()
+	defer a.busy.Unlock()
+	if err := os.Rename(b.path, a.path); err != nil {
+		os.Remove(b.path)
+		return 0, err
+	}
+	b.path, b.logger = a.path, a.logger
+	this.archiveLock.Lock()
+	this.archives[id] = b
+	this.archiveLock.Unlock()
+	a.released = true
+	return n, nil
+}
+
+/* Archives every shard on disk whose partition ended at least
+Archive_after before now. Returns the ids of the shards archived */
+func (this *levelfederator) archiveShards(now time.Time) []string {
+	retval := make([]string, 0)
+	for _, id := range this.diskShards() {
+		end, err := partitionEnd(id)
+		if err != nil || now.Sub(end) < this.config.Archive_after {
+			continue
+		}
+		select {
+		case <-this.done:
+			return retval
+		default:
+		}
+
+		this.snapshotLock.Lock()
+		err = this.archiveShard(id)
+		this.snapshotLock.Unlock()
+
+		switch err {
+		case nil:
+			fLogger.Infof("archived shard %s", id)
+			retval = append(retval, id)
+		case errShardBusy:
+			fLogger.Debugf("shard %s is still being written to; not archiving it", id)
+		default:
+			fLogger.Errorf("archiving shard %s failed: %v", id, err)
+		}
+	}
+	return retval
+}
+
+func (this *levelfederator) archiveLoop(interval time.Duration) {
+	defer this.archiver.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		this.archiveShards(time.Now())
+
+		select {
+		case <-ticker.C:
+		case <-this.done:
+			return
+		}
+	}
+}
+
+/* Converts a shard into an archive & destroys the shard. The shard continues
+to serve reads while being converted; writes to it are refused from the
+start. To be invoked with snapshotLock held */
+func (this *levelfederator) archiveShard(id string) error {
+	path := _shard_namer(this.config.Basedir, id)
+	opts := levigo.NewOptions()
+	defer opts.Close()
+
+	this.writeLock.Lock()
+	this._awaitOpen(id)
+	if this._isCold(id) {
+		/* Left behind by a crash after the archive was in place */
+		this.writeLock.Unlock()
+		return levigo.DestroyDatabase(path, opts)
+	}
+	s, ok := this.shards[id]
+	if ok {
+		if s.idleFor() < _IDLE_BATCH_INTERVALS*this.config.Sconfig.Write_batch_fill_timeout {
+			this.writeLock.Unlock()
+			return errShardBusy
+		}
+		delete(this.shards, id)
+		s.flush()
+	} else {
+		var err error
+		if s, err = this._open(id, false); err != nil {
+			this.writeLock.Unlock()
+			return err
+		}
+	}
+	this.archiveLock.Lock()
+	this.archiving[id] = s
+	this.archiveLock.Unlock()
+	this.writeLock.Unlock()
+
+	a, err := this._archive(id, s)
+
+	this.archiveLock.Lock()
+	delete(this.archiving, id)
+	if err == nil {
+		this.archives[id] = a
+	}
+	this.archiveLock.Unlock()
+	s.release()
+
+	if err != nil {
+		return err
+	}
+	return levigo.DestroyDatabase(path, opts)
+}
+
+func (this *levelfederator) _archive(id string, s *shard) (*archive, error) {
+	s.db.CompactRange(levigo.Range{nil, nil})
+
+	final := _archive_namer(this.config.Basedir, id)
+	tmp := final + ".tmp"
+	it := s.db.NewIterator(s.ro)
+	n, err := writeArchive(tmp, it, this.done)
+	it.Close()
+
+	var a *archive
+	if err == nil {
+		a, err = openArchive(tmp)
+	}
+	if err == nil {
+		err = os.Rename(tmp, final)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	a.path = final
+	a.logger = aLogger.With("archive", final)
+	fLogger.Debugf("shard %s archived as %d record(s) in %d block(s), %d bytes", id, n, len(a.blocks), a.size)
+	return a, nil
+}
+
+/* Whether a shard is archived or being archived */
+func (this *levelfederator) _isCold(id string) bool {
+	this.archiveLock.RLock()
+	defer this.archiveLock.RUnlock()
+	return this.archives[id] != nil || this.archiving[id] != nil
+}
+
+/* Scans a shard that is archived or being archived; false if it is
+neither. Nil, along with true, if the shard is released in the middle, once
+it is archived, or its archive is replaced */
+func (this *levelfederator) coldScan(id string, key *metricIndex, start uint64, end uint64) ([]Datapoint, bool) {
+	retval, ok := this.coldMultiScan(id, []*metricIndex{key}, start, end)
+	if retval == nil {
+		return nil, ok
+	}
+	return retval[0], true
+}
+
+/* coldScan for many metrics. The archive lock is only held to look the
+shard up, lest a long scan hold archival, & the writes waiting on it, up */
+func (this *levelfederator) coldMultiScan(id string, keys []*metricIndex, start uint64, end uint64) ([][]Datapoint, bool) {
+	this.archiveLock.RLock()
+	a, archived := this.archives[id]
+	s, archiving := this.archiving[id]
+	this.archiveLock.RUnlock()
+
+	switch {
+	case archived:
+		return a.multiScan(keys, start, end), true
+	case archiving:
+		return s.multiScan(keys, start, end), true
+	}
+	return nil, false
+}
+
+/* Loads the indices of the archives under root */
+func loadArchives(root string) map[string]*archive {
+	retval := make(map[string]*archive)
+	for _, id := range archiveIds(root) {
+		if a, err := openArchive(_archive_namer(root, id)); err != nil {
+			fLogger.Errorf("archive of shard %s is unreadable: %v", id, err)
+		} else {
+			retval[id] = a
+		}
+	}
+	return retval
+}
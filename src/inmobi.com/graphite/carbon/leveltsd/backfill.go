@@ -0,0 +1,320 @@
+package leveltsd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const _BACKFILL_BATCH_POINTS = 200000
+const _BACKFILL_MAX_POINTS_PER_SECOND = 200000
+const _BACKFILL_MAX_LEVEL0_FILES = 6
+
+/* Datapoints per leveldb batch; throttling is applied batch by batch */
+const _BACKFILL_CHUNK = 50000
+
+const _BACKFILL_QUEUE_LENGTH = 10000
+
+/* How often the level 0 file count of a shard is checked while waiting for
+compactions to catch up */
+const _BACKFILL_POLL_INTERVAL = 100 * time.Millisecond
+
+/*
+Ingestion of historical datapoints off the live pipeline. A separate
+listener takes the carbon plaintext protocol; metrics are created & datapoints
+written without going through the storage queues or counting against their
+rate limits. Datapoints are buffered, sorted by shard, short code & time and
+written straight to the shards in large leveldb batches.
+
+Backfill has throttling of its own in place of the rate limits; batches are
+held back to stay within a rate and while the level 0 files of a shard pile
+up beyond a limit, i.e. till compactions catch up, before leveldb would stall
+the live writes to that shard. Connections are not read from meanwhile, which
+slows the senders down rather than dropping what they send
+*/
+type backfiller struct {
+	stats     backfillStats // first for atomic alignment
+	federator *levelfederator
+	config    backfillConf
+	in        chan triplet
+	buffers   map[string][]triplet // by shard id
+	buffered  int
+	next      time.Time // earliest a batch may be written within the rate
+
+	quit     chan bool // closed once closing; throttling is given up on
+	listener net.Listener
+	conns    map[net.Conn]bool
+	connLock sync.Mutex
+	readers  sync.WaitGroup
+	writer   sync.WaitGroup
+}
+
+type backfillConf struct {
+	Port                  uint16 // 0 if there is no backfill listener
+	Batch_points          uint   // buffered before being written
+	Max_points_per_second uint   // 0 if unlimited
+	Max_level0_files      int    // 0 if unlimited
+}
+
+/* Served on the admin listener */
+type backfillStats struct {
+	Lines        uint64
+	Garbled      uint64
+	Datapoints   uint64 // written
+	Dropped      uint64 // meant for archived shards or metrics that cannot be created
+	Write_errors uint64
+	Throttled_ms uint64 // spent holding batches back
+	Buffered     int64
+	Connections  int64
+}
+
+func defaultBackfillConf() backfillConf {
+	return backfillConf{0, _BACKFILL_BATCH_POINTS, _BACKFILL_MAX_POINTS_PER_SECOND, _BACKFILL_MAX_LEVEL0_FILES}
+}
+
+/* Starts the writer of a backfiller; datapoints are taken over serve */
+func newBackfiller(federator *levelfederator, config backfillConf) *backfiller {
+	retval := &backfiller{
+		federator: federator,
+		config:    config,
+		in:        make(chan triplet, _BACKFILL_QUEUE_LENGTH),
+		quit:      make(chan bool),
+		buffers:   make(map[string][]triplet),
+		conns:     make(map[net.Conn]bool),
+	}
+	retval.writer.Add(1)
+	go retval._write_loop(federator.config.Sconfig.Write_batch_fill_timeout)
+	return retval
+}
+
+/* Listens on the configured backfill port */
+func startBackfill(federator *levelfederator) (*backfiller, error) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", federator.config.Backfill.Port))
+	if err != nil {
+		return nil, err
+	}
+	retval := newBackfiller(federator, federator.config.Backfill)
+	go retval.serve(l)
+	fLogger.Infof("backfill listener on %v", l.Addr())
+	return retval, nil
+}
+
+/* Accepts connections till the listener is closed */
+func (this *backfiller) serve(l net.Listener) {
+	this.connLock.Lock()
+	this.listener = l
+	this.connLock.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		this.connLock.Lock()
+		if this.conns == nil {
+			this.connLock.Unlock()
+			conn.Close()
+			return
+		}
+		this.conns[conn] = true
+		this.readers.Add(1)
+		this.connLock.Unlock()
+		go this.read(conn)
+	}
+}
+
+func (this *backfiller) read(conn net.Conn) {
+	defer this.readers.Done()
+	defer func() {
+		this.connLock.Lock()
+		delete(this.conns, conn)
+		this.connLock.Unlock()
+		conn.Close()
+	}()
+	atomic.AddInt64(&this.stats.Connections, 1)
+	defer atomic.AddInt64(&this.stats.Connections, -1)
+
+	f := this.federator
+	b := bufio.NewReader(conn)
+	for {
+		line, err := b.ReadString('\n')
+		if err != nil {
+			fLogger.Limited("backfill-disconnect").Infof("backfill connection from %v closing due to %v", conn.RemoteAddr(), err)
+			return
+		}
+		atomic.AddUint64(&this.stats.Lines, 1)
+
+		var metric string
+		var x Datapoint
+		if parts, _ := fmt.Sscanf(line, "%s %f %d", &metric, &x.Value, &x.Timestamp); parts != 3 {
+			atomic.AddUint64(&this.stats.Garbled, 1)
+			fLogger.Limited("backfill-garbled").Warnf("backfill connection from %v garbled message: %q", conn.RemoteAddr(), line)
+			continue
+		}
+		key, ok := f.createMetric(metric)
+		if !ok {
+			atomic.AddUint64(&this.stats.Dropped, 1)
+			continue
+		}
+		this.in <- triplet{key, x}
+	}
+}
+
+/* Stops taking datapoints & writes out whatever is buffered, without
+throttling */
+func (this *backfiller) close() {
+	close(this.quit)
+	this.connLock.Lock()
+	if this.listener != nil {
+		this.listener.Close()
+	}
+	for conn := range this.conns {
+		conn.Close()
+	}
+	this.conns = nil
+	this.connLock.Unlock()
+
+	this.readers.Wait()
+	close(this.in)
+	this.writer.Wait()
+}
+
+func (this *backfiller) _write_loop(interval time.Duration) {
+	defer this.writer.Done()
+	timeout := time.NewTicker(interval)
+	defer timeout.Stop()
+
+	f := this.federator
+	for {
+		select {
+		case x, ok := <-this.in:
+			if !ok {
+				this.flush()
+				return
+			}
+			id := f.partition.shardFor(x.val.Timestamp)
+			this.buffers[id] = append(this.buffers[id], x)
+			this.buffered++
+			atomic.StoreInt64(&this.stats.Buffered, int64(this.buffered))
+			if uint(this.buffered) >= this.config.Batch_points {
+				this.flush()
+			}
+		case <-timeout.C:
+			this.flush()
+		}
+	}
+}
+
+/* Writes out the buffered datapoints a shard at a time */
+func (this *backfiller) flush() {
+	ids := make([]string, 0, len(this.buffers))
+	for id := range this.buffers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		points := this.buffers[id]
+		delete(this.buffers, id)
+		sortTriplets(points)
+		this._writeShard(id, points)
+		this.buffered -= len(points)
+		atomic.StoreInt64(&this.stats.Buffered, int64(this.buffered))
+	}
+}
+
+/* Writes the datapoints of a shard through its read handle, unless it is
+open for writes, so that the shards being written to are neither evicted nor
+held up; see _shardHandle */
+func (this *backfiller) _writeShard(id string, points []triplet) {
+	for len(points) > 0 {
+		s := this.federator._shardHandle(id, true)
+		if s == nil {
+			atomic.AddUint64(&this.stats.Dropped, uint64(len(points)))
+			return
+		}
+
+		n := len(points)
+		if n > _BACKFILL_CHUNK {
+			n = _BACKFILL_CHUNK
+		}
+		this._throttle(s, n)
+		switch err := s.bulkWrite(points[:n]); err {
+		case nil:
+			atomic.AddUint64(&this.stats.Datapoints, uint64(n))
+		case errShardReleased:
+			continue // evicted in the meantime; open it again
+		default:
+			atomic.AddUint64(&this.stats.Write_errors, uint64(n))
+		}
+		points = points[n:]
+	}
+}
+
+/* Holds a batch of n datapoints back till the shard has compacted enough &
+writing it stays within the rate; given up on once the backfiller or the
+federator is closing */
+func (this *backfiller) _throttle(s *shard, n int) {
+	start := time.Now()
+	if max := this.config.Max_level0_files; max > 0 {
+		for s.level0Files() >= max && this._sleep(_BACKFILL_POLL_INTERVAL) {
+		}
+	}
+	if rate := this.config.Max_points_per_second; rate > 0 {
+		if wait := time.Until(this.next); wait > 0 {
+			this._sleep(wait)
+		}
+		now := time.Now()
+		if this.next.Before(now) {
+			this.next = now
+		}
+		this.next = this.next.Add(time.Duration(n) * time.Second / time.Duration(rate))
+	}
+	if waited := time.Since(start); waited > time.Millisecond {
+		atomic.AddUint64(&this.stats.Throttled_ms, uint64(waited/time.Millisecond))
+	}
+}
+
+/* Sleeps for d; false, sooner, if the backfiller or the federator is
+closing */
+func (this *backfiller) _sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-this.quit:
+	case <-this.federator.done:
+	}
+	return false
+}
+
+func (this *backfiller) getStats() backfillStats {
+	return backfillStats{
+		atomic.LoadUint64(&this.stats.Lines),
+		atomic.LoadUint64(&this.stats.Garbled),
+		atomic.LoadUint64(&this.stats.Datapoints),
+		atomic.LoadUint64(&this.stats.Dropped),
+		atomic.LoadUint64(&this.stats.Write_errors),
+		atomic.LoadUint64(&this.stats.Throttled_ms),
+		atomic.LoadInt64(&this.stats.Buffered),
+		atomic.LoadInt64(&this.stats.Connections),
+	}
+}
+
+/* Orders datapoints as they lie in a shard, by short code & then time;
+datapoints of the same metric & time keep their order, so the last one
+received is the one written last */
+func sortTriplets(points []triplet) {
+	sort.SliceStable(points, func(i, j int) bool {
+		if c := bytes.Compare(points[i].key.key, points[j].key.key); c != 0 {
+			return c < 0
+		}
+		return points[i].val.Timestamp < points[j].val.Timestamp
+	})
+}
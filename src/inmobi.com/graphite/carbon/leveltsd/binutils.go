@@ -5,13 +5,12 @@ import (
 	"crypto/md5"
 	"encoding/binary"
 	"inmobi.com/graphite/carbon/logging"
-	"log"
 )
 
-var bLogger *log.Logger
+var bLogger *logging.Logger
 
 func init() {
-	bLogger = logging.MakeLogger("leveltsd-marshall: ")
+	bLogger = logging.MakeLogger("leveltsd-marshall")
 }
 
 const SCHEME_MAGIC_ID = "__l3xedfRCTNUI7EFuFIw2CyffG7ggL7h8RE1VtBOrCvVvpdCORvCIRfSc49Zr"
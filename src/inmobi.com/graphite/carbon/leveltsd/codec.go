@@ -0,0 +1,120 @@
+package leveltsd
+
+import (
+	"bytes"
+	"github.com/jmhodges/levigo"
+	"inmobi.com/graphite/carbon/logging"
+)
+
+/*
+Layout of the datapoints within a shard.
+
+Every shard is stamped with the name of the codec it is written with, under
+SCHEME_MAGIC_ID, and is only ever opened with that very codec; a shard
+stamped with an unknown one is refused. The name carries the version of the
+layout, so a change in layout makes for a new codec that coexists with the
+older ones: existing shards continue to be read & written in their own
+layout while new shards are stamped with the one configured.
+
+SERIALIZATION_TECHNIQUE is the layout of the python implementation; a key per
+datapoint (see keyString) with the value as a little endian float64. Shards
+written by earlier versions of this implementation carry no stamp, but are
+in this layout; they get stamped when opened
+*/
+type shardCodec interface {
+	/* Adds datapoints to a batch that is about to be written to a shard */
+	encode(s *shard, batch *levigo.WriteBatch, points []triplet)
+
+	/* Visits the datapoints of a metric within a time range (both ends
+	inclusive) in order of time; stops early once visit returns false */
+	scan(it dataIterator, logger *logging.Logger, shortCode []byte, start uint64, end uint64, visit func(Datapoint) bool)
+
+	/* Whether flushes must not run concurrently; for codecs whose encoding
+	depends on what has already been written */
+	exclusive() bool
+}
+
+/* Sorted access to the keys of a shard; satisfied by the iterators of leveldb
+and of archives */
+type dataIterator interface {
+	Seek(key []byte)
+	Valid() bool
+	Next()
+	Key() []byte
+	Value() []byte
+	Close()
+}
+
+/* Scans the datapoints of several metrics over a single iterator; the
+result holds those of keys[i] at i */
+func scanMany(c shardCodec, it dataIterator, logger *logging.Logger, keys []*metricIndex, start uint64, end uint64) [][]Datapoint {
+	retval := make([][]Datapoint, len(keys))
+	for i, key := range keys {
+		points := make([]Datapoint, 0, 100)
+		c.scan(it, logger, key.key, start, end, func(x Datapoint) bool {
+			points = append(points, x)
+			return true
+		})
+		retval[i] = points
+	}
+	return retval
+}
+
+var codecs = make(map[string]shardCodec)
+
+/* Names of the codecs as used in the config (shard-codec) */
+var codecAliases = make(map[string]string)
+
+/* Makes a codec available under a given name; the name is stamped into
+shards and hence must never be reused for a different layout */
+func registerCodec(name string, alias string, c shardCodec) {
+	if _, dup := codecs[name]; dup {
+		bLogger.Panicf("Codec already registered under the name of %s", name)
+	}
+	if _, dup := codecAliases[alias]; dup {
+		bLogger.Panicf("Codec already registered under the alias of %s", alias)
+	}
+	codecs[name] = c
+	codecAliases[alias] = name
+}
+
+func init() {
+	registerCodec(SERIALIZATION_TECHNIQUE, "packed", packedCodec{})
+}
+
+/* A key per datapoint with the value packed as a float64 */
+type packedCodec struct{}
+
+func (packedCodec) encode(s *shard, batch *levigo.WriteBatch, points []triplet) {
+	for _, x := range points {
+		blob := makeMsg(x)
+		batch.Put(blob.key, blob.val)
+	}
+}
+
+func (packedCodec) exclusive() bool {
+	return false
+}
+
+func (packedCodec) scan(it dataIterator, logger *logging.Logger, shortCode []byte, start uint64, end uint64, visit func(Datapoint) bool) {
+	start_key := keyString(shortCode, start)
+	end_key := keyString(shortCode, end)
+
+	/* Levigo lacks a range scan; it only has a full scan operation. However, it
+	is possible to inexpensively seek to a given point, hence we use that to control
+	the startig point of a scan
+	*/
+	for it.Seek(start_key); it.Valid(); it.Next() {
+		k := it.Key()
+
+		/* We all need to terminate the end of range scan; else it would proceeed
+		till the end of the tree index */
+		if bytes.Compare(k, end_key) > 0 {
+			break
+		}
+
+		if !visit(Datapoint{extractTsFromFullKey(k), readVal(it.Value())}) {
+			break
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package leveltsd
+
+import (
+	"fmt"
+	"github.com/jmhodges/levigo"
+	"inmobi.com/graphite/carbon/audit"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Reverse map of the short codes, kept in the map db (tsd-map.db) alongside
+the forward one. Every short code in use is owned by exactly one metric;
+aliases (see rename.go) share the code of the metric they point to. Keys
+look like
+
+	_MAP_CODE_PREFIX short-code => metric name
+
+A new metric is handed the md5 of its scrubbed name as its short code. When
+that is owned by another metric (be it a genuine md5 collision or the
+metric renamed away from this very name) a salted md5 is used instead &
+the collision is reported.
+
+Metrics created before the reverse map existed are backfilled into it in the
+background; collisions against those can only be detected once that is over.
+Collisions found while backfilling have already merged the data of the
+metrics involved & are reported as such.
+
+Since scrubMetric drops characters, several raw names can map onto the same
+metric & silently merge their data. The raw name a metric was created with
+is recorded as its origin whenever it differs from the scrubbed one; other
+raw names resolving to the metric are reported. Keys look like
+
+	_MAP_ORIGIN_PREFIX metric name => raw name
+*/
+const _MAP_CODE_PREFIX = "\x00code\x00"
+const _MAP_ORIGIN_PREFIX = "\x00origin\x00"
+
+/* Marks a map db whose reverse map is complete */
+const _MAP_CODES_KEY = "\x00codes"
+const _MAP_CODES_COMPLETE = "complete"
+
+/* Number of metrics backfilled into the reverse map per batch */
+const _CODE_BACKFILL_BATCH = 1000
+
+/* Number of recent events retained for inspection */
+const _RECENT_NAMING_EVENTS = 100
+
+/* Number of raw names remembered as already checked for scrub aliasing */
+const _SCRUB_SEEN_SIZE = 100000
+
+const namingCollision = "shortcode-collision"
+const namingScrubAlias = "scrub-alias"
+
+/* A naming conflict that was detected */
+type namingEvent struct {
+	Kind   string
+	Metric string // the metric being created or written to
+	Other  string // the owner of the short code or the origin of the metric
+	Time   time.Time
+}
+
+/* Bookkeeping of naming conflicts */
+type namingEvents struct {
+	lock      sync.Mutex
+	recent    []namingEvent
+	scrubSeen map[string]bool
+}
+
+func codeKey(code []byte) []byte {
+	return append([]byte(_MAP_CODE_PREFIX), code...)
+}
+
+func originKey(spath string) []byte {
+	return []byte(_MAP_ORIGIN_PREFIX + spath)
+}
+
+func (this *namingEvents) record(kind string, metric string, other string) {
+	iLogger.Limited(kind).Warnf("%s: %s conflicts with %s", kind, metric, other)
+	if stats := audit.GetMetrics(); stats != nil {
+		if kind == namingCollision {
+			atomic.AddUint32(&stats.Writer.Shortcode_collisions, 1)
+		} else {
+			atomic.AddUint32(&stats.Writer.Scrub_aliases, 1)
+		}
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if len(this.recent) == _RECENT_NAMING_EVENTS {
+		this.recent = this.recent[1:]
+	}
+	this.recent = append(this.recent, namingEvent{kind, metric, other, time.Now()})
+}
+
+/* The most recent events, oldest first */
+func (this *namingEvents) list() []namingEvent {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return append([]namingEvent{}, this.recent...)
+}
+
+/* Whether a raw name needs checking for scrub aliasing; each raw name is
+checked once, till too many have been seen */
+func (this *namingEvents) unchecked(raw string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.scrubSeen[raw] {
+		return false
+	}
+	if this.scrubSeen == nil || len(this.scrubSeen) == _SCRUB_SEEN_SIZE {
+		this.scrubSeen = make(map[string]bool)
+	}
+	this.scrubSeen[raw] = true
+	return true
+}
+
+/* Metric a short code is owned by, if any */
+func (this *indices) _codeOwner(code []byte) (string, bool) {
+	val, err := this.pkey.Get(this.ro, codeKey(code))
+	if err != nil {
+		iLogger.Errorf("%v", err)
+		return "", false
+	}
+	return string(val), val != nil
+}
+
+/* The short code for a new metric; the md5 of its name unless that is owned
+by another metric */
+func (this *indices) _freeCode(bmetric []byte) []byte {
+	code := shortenMetricName(bmetric)
+	for salt := 1; ; salt++ {
+		owner, owned := this._codeOwner(code)
+		if !owned {
+			return code
+		}
+		this.naming.record(namingCollision, string(bmetric), owner)
+		code = shortenMetricName([]byte(fmt.Sprintf("%s\x00%d", bmetric, salt)))
+	}
+}
+
+/* Reports a raw name that resolved to a metric created from another one */
+func (this *indices) _checkScrubAlias(raw string, spath []byte) {
+	if !this.naming.unchecked(raw) {
+		return
+	}
+	origin, err := this.pkey.Get(this.ro, originKey(string(spath)))
+	if err != nil {
+		iLogger.Errorf("%v", err)
+		return
+	}
+	if origin == nil {
+		origin = spath
+	}
+	if string(origin) != raw {
+		this.naming.record(namingScrubAlias, raw, string(origin))
+	}
+}
+
+/* Kicks off the backfill of the reverse map unless it is complete */
+func (this *indices) _initCodes() {
+	done, err := this.pkey.Get(this.ro, []byte(_MAP_CODES_KEY))
+	if err != nil {
+		iLogger.Panicf("Cannot read map db %v", err)
+	}
+	if string(done) == _MAP_CODES_COMPLETE {
+		return
+	}
+
+	it := this.pkey.NewIterator(this.ro)
+	it.SeekToFirst()
+	empty := !it.Valid()
+	it.Close()
+
+	if empty {
+		if err := this.pkey.Put(this.wo, []byte(_MAP_CODES_KEY), []byte(_MAP_CODES_COMPLETE)); err != nil {
+			iLogger.Panicf("Cannot initialize map db %v", err)
+		}
+		return
+	}
+
+	iLogger.Infof("map db lacks a reverse map; backfilling in the background")
+	go this._backfillCodes()
+}
+
+func (this *indices) _backfillCodes() {
+	var n int
+	resume := []byte{1} // past the reserved keys
+
+	for resume != nil {
+		x, next, ok := this._backfillBatch(resume)
+		if !ok {
+			return
+		}
+		n, resume = n+x, next
+	}
+
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+	if this.closed {
+		return
+	}
+	if err := this.pkey.Put(this.wo, []byte(_MAP_CODES_KEY), []byte(_MAP_CODES_COMPLETE)); err != nil {
+		iLogger.Errorf("backfill could not be marked complete: %v", err)
+		return
+	}
+	iLogger.Infof("reverse map backfill complete; %d metric(s) added", n)
+}
+
+/* Backfills a batch of metrics starting at a given key. Returns the key to
+resume from, which is nil once there is nothing left */
+func (this *indices) _backfillBatch(resume []byte) (int, []byte, bool) {
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+
+	if this.closed {
+		return 0, nil, false
+	}
+
+	batch := levigo.NewWriteBatch()
+	defer batch.Close()
+
+	it := this.pkey.NewIterator(this.ro)
+	defer it.Close()
+
+	claimed := make(map[string]string)
+	aliases := this._aliases()
+
+	var n, seen int
+	var next []byte
+	for it.Seek(resume); it.Valid(); it.Next() {
+		if seen == _CODE_BACKFILL_BATCH {
+			next = append([]byte{}, it.Key()...)
+			break
+		}
+		seen++
+
+		metric, code := string(it.Key()), it.Value()
+		if _, ok := aliases[metric]; ok {
+			continue
+		}
+		owner, owned := claimed[string(code)]
+		if !owned {
+			owner, owned = this._codeOwner(code)
+		}
+		if !owned {
+			claimed[string(code)] = metric
+			batch.Put(codeKey(code), []byte(metric))
+			n++
+		} else if owner != metric {
+			this.naming.record(namingCollision, metric, owner)
+		}
+	}
+
+	if err := this.pkey.Write(this.wo, batch); err != nil {
+		iLogger.Errorf("backfill batch failed: %v", err)
+		return 0, nil, false
+	}
+	return n, next, true
+}
@@ -0,0 +1,150 @@
+package leveltsd
+
+import (
+	"fmt"
+	"math"
+)
+
+/* Functions datapoints within a bucket are consolidated with */
+const (
+	CONSOLIDATE_AVG  = "avg"
+	CONSOLIDATE_SUM  = "sum"
+	CONSOLIDATE_MIN  = "min"
+	CONSOLIDATE_MAX  = "max"
+	CONSOLIDATE_LAST = "last"
+)
+
+/*
+Reduces datapoints, visited in order of time, to a datapoint per bucket of
+time as they are read; nothing but the bucket being filled is held. Buckets
+are aligned to multiples of their size, so consolidating a range piecewise,
+e.g. page by page, yields the same buckets. A bucket is stamped with the time
+it starts at. NaN is disregarded; a bucket holding nothing else is NaN
+*/
+type consolidator struct {
+	bucket  uint64
+	fn      string
+	derived bool // worked out from maxPoints rather than asked for
+
+	start uint64 // of the bucket being filled
+	seen  bool   // whether any datapoint falls in it
+	n     int    // of the datapoints in it that are not NaN
+	sum   float64
+	min   float64
+	max   float64
+	last  float64
+}
+
+/*
+A consolidator for a range of a metric; nil if it is not to be consolidated.
+The bucket is either asked for as is, or else worked out such that the range
+makes for no more than maxPoints of them once aligned. Either is rounded up
+to a multiple of the step of the metric
+*/
+func newConsolidator(key *metricIndex, start uint64, end uint64, maxPoints uint64, bucket uint64, fn string) (*consolidator, error) {
+	switch fn {
+	case "":
+		fn = CONSOLIDATE_AVG
+	case CONSOLIDATE_AVG, CONSOLIDATE_SUM, CONSOLIDATE_MIN, CONSOLIDATE_MAX, CONSOLIDATE_LAST:
+	default:
+		return nil, fmt.Errorf("no consolidation function by the name of %q", fn)
+	}
+
+	step := uint64(key.step_in_seconds)
+	if step == 0 {
+		step = 1
+	}
+	derived := false
+	if bucket == 0 && maxPoints > 0 {
+		span := end - start + 1
+		bucket = (span + maxPoints - 1) / maxPoints
+		bucket = (bucket + step - 1) / step * step
+		/* An unaligned range may straddle one bucket more than the span
+		works out to */
+		for end/bucket-start/bucket+1 > maxPoints {
+			bucket += step
+		}
+		derived = true
+	}
+	if bucket <= step {
+		return nil, nil // no coarser than what is stored
+	}
+	bucket = (bucket + step - 1) / step * step
+	return &consolidator{bucket: bucket, fn: fn, derived: derived}, nil
+}
+
+/*
+Fails if the buckets worked out from maxPoints over a range may not fit in a
+page of limit datapoints (0 for no limit); the pages past the first, over
+narrower ranges, would work out smaller buckets that do not stitch together.
+Buckets asked for as is can be paged through; the error names the bucket to
+ask for
+*/
+func (this *consolidator) checkPaging(start uint64, end uint64, limit uint64) error {
+	if this == nil || !this.derived || limit == 0 {
+		return nil
+	}
+	if n := end/this.bucket - start/this.bucket + 1; n > limit {
+		return fmt.Errorf("maxDataPoints makes for up to %d buckets of %d seconds, more than a page of %d holds; page through them by asking for the bucket as is", n, this.bucket, limit)
+	}
+	return nil
+}
+
+/* Takes the datapoints of a chunk in; returns the buckets completed */
+func (this *consolidator) feed(points []Datapoint) []Datapoint {
+	retval := make([]Datapoint, 0)
+	for _, x := range points {
+		start := x.Timestamp - x.Timestamp%this.bucket
+		if this.seen && start != this.start {
+			retval = append(retval, this._emit())
+		}
+		if !this.seen {
+			this.start, this.seen = start, true
+		}
+		this._add(x.Value)
+	}
+	return retval
+}
+
+/* The bucket being filled, if any */
+func (this *consolidator) done() []Datapoint {
+	if !this.seen {
+		return nil
+	}
+	return []Datapoint{this._emit()}
+}
+
+func (this *consolidator) _add(v float64) {
+	if math.IsNaN(v) {
+		return
+	}
+	if this.n == 0 {
+		this.sum, this.min, this.max = v, v, v
+	} else {
+		this.sum += v
+		this.min = math.Min(this.min, v)
+		this.max = math.Max(this.max, v)
+	}
+	this.last = v
+	this.n++
+}
+
+func (this *consolidator) _emit() Datapoint {
+	retval := Datapoint{this.start, math.NaN()}
+	if this.n > 0 {
+		switch this.fn {
+		case CONSOLIDATE_AVG:
+			retval.Value = this.sum / float64(this.n)
+		case CONSOLIDATE_SUM:
+			retval.Value = this.sum
+		case CONSOLIDATE_MIN:
+			retval.Value = this.min
+		case CONSOLIDATE_MAX:
+			retval.Value = this.max
+		case CONSOLIDATE_LAST:
+			retval.Value = this.last
+		}
+	}
+	this.seen, this.n = false, 0
+	return retval
+}
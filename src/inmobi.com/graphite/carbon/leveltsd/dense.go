@@ -0,0 +1,166 @@
+package leveltsd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+/*
+A range of a series as a value per step, null where there is no datapoint;
+the shape graphite's finders return from fetch(). Start is aligned up to the
+step & End is past the last step, so there are (End - Start) / Step values.
+NaN & infinities are null as well
+*/
+type SeriesResult struct {
+	Start  uint64
+	End    uint64
+	Step   uint64
+	Values []*float64
+}
+
+/* Lays datapoints, visited in order of time, out at a fixed step */
+type gapFiller struct {
+	start uint64
+	step  uint64
+	slots uint64
+	next  uint64 // slot to be emitted next
+}
+
+/* Start is aligned up to the step, as whisper does, so no slot begins
+before it; the last slot is the one end falls in */
+func newGapFiller(start uint64, end uint64, step uint64) *gapFiller {
+	if start%step != 0 {
+		start += step - start%step
+	}
+	if start > end {
+		return &gapFiller{start, step, 0, 0}
+	}
+	return &gapFiller{start, step, (end-start)/step + 1, 0}
+}
+
+func (this *gapFiller) end() uint64 {
+	return this.start + this.slots*this.step
+}
+
+/* Emits the slots up to & including those of the datapoints; a slot already
+emitted is not revisited */
+func (this *gapFiller) fill(points []Datapoint, emit func(*float64)) {
+	for _, x := range points {
+		if x.Timestamp < this.start {
+			continue
+		}
+		slot := (x.Timestamp - this.start) / this.step
+		if slot < this.next {
+			continue
+		}
+		if slot >= this.slots {
+			return
+		}
+		for ; this.next < slot; this.next++ {
+			emit(nil)
+		}
+		if math.IsNaN(x.Value) || math.IsInf(x.Value, 0) {
+			emit(nil)
+		} else {
+			v := x.Value
+			emit(&v)
+		}
+		this.next++
+	}
+}
+
+/* Emits the slots left */
+func (this *gapFiller) done(emit func(*float64)) {
+	for ; this.next < this.slots; this.next++ {
+		emit(nil)
+	}
+}
+
+/* The step of a range; the bucket if consolidated, the step of the metric
+otherwise */
+func seriesStep(key *metricIndex, c *consolidator) uint64 {
+	if c != nil {
+		return c.bucket
+	}
+	if key.step_in_seconds == 0 {
+		return 1
+	}
+	return uint64(key.step_in_seconds)
+}
+
+/* Gap fills a range; fails if it makes for more than max-points-per-query
+values */
+func (this *levelfederator) series(ctx context.Context, key *metricIndex, start uint64, end uint64, c *consolidator) (*SeriesResult, error) {
+	filler := newGapFiller(start, end, seriesStep(key, c))
+	if err := this._checkSlots(filler); err != nil {
+		return nil, err
+	}
+
+	retval := &SeriesResult{filler.start, filler.end(), filler.step, make([]*float64, 0, filler.slots)}
+	emit := func(v *float64) {
+		retval.Values = append(retval.Values, v)
+	}
+	err := this.scanSeries(ctx, key, start, end, c, func(points []Datapoint) bool {
+		filler.fill(points, emit)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	filler.done(emit)
+	return retval, nil
+}
+
+func (this *levelfederator) _checkSlots(filler *gapFiller) error {
+	if max := this.config.Max_points_per_query; max > 0 && filler.slots > max {
+		return fmt.Errorf("%d steps of %d seconds are more than %d; consolidate them into fewer", filler.slots, filler.step, max)
+	}
+	return nil
+}
+
+/* serveData for shape=dense; the response is {"metric": ..., "start": ...,
+"end": ..., "step": ..., "values": [...]}, as in SeriesResult */
+func (this *levelfederator) serveSeries(ctx context.Context, w http.ResponseWriter, metric string, key *metricIndex, start uint64, end uint64, c *consolidator) {
+	filler := newGapFiller(start, end, seriesStep(key, c))
+	if err := this._checkSlots(filler); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	out := bufio.NewWriter(w)
+	quoted, _ := json.Marshal(metric)
+	fmt.Fprintf(out, "{\"metric\":%s,\"start\":%d,\"end\":%d,\"step\":%d,\"values\":[", quoted, filler.start, filler.end(), filler.step)
+
+	emit := func(v *float64) {
+		if filler.next > 0 {
+			out.WriteByte(',')
+		}
+		if v == nil {
+			out.WriteString("null")
+		} else {
+			out.WriteString(strconv.FormatFloat(*v, 'g', -1, 64))
+		}
+	}
+	err := this.scanSeries(ctx, key, start, end, c, func(points []Datapoint) bool {
+		filler.fill(points, emit)
+		if err := out.Flush(); err != nil {
+			return false // the client is gone
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		return true
+	})
+	if err != nil {
+		abortQuery(metric, err)
+	}
+	filler.done(emit)
+	out.WriteString("]}\n")
+	out.Flush()
+}
@@ -0,0 +1,359 @@
+package leveltsd
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/jmhodges/levigo"
+	"strings"
+	"sync/atomic"
+)
+
+/*
+Layout of the directory db (tsd-dir.db)
+
+Every parent/child edge of the metric tree is a key of its own with an empty
+value. The keys look like
+
+	_DIR_EDGE_PREFIX parent _DIR_EDGE_SEP child
+
+which lets the children of a node be listed with a prefix scan, in sorted
+order. Neither the prefix nor the separator can be a part of a metric name
+as scrubMetric strips them.
+
+The legacy layout, as written by the python implementation & earlier versions
+of this one, had every directory node be a key holding a JSON array of all
+its children. Adding a child meant an unmarshal, a linear scan & a re-marshal
+of the whole list; a node with 50k children made every creation under it
+O(n). Such dbs are migrated online by a background task that rewrites the
+legacy entries in batches. Until it completes, listings consult both layouts
+*/
+const _DIR_EDGE_PREFIX = "\x01"
+const _DIR_EDGE_SEP = "\x00"
+
+/* Marks a directory db with no legacy entries */
+const _DIR_LAYOUT_KEY = "\x00layout"
+const _DIR_LAYOUT_EDGES = "edges-v1"
+
+/* Number of legacy nodes rewritten per batch during the migration */
+const _DIR_MIGRATION_BATCH = 1000
+
+func edgePrefix(parent string) []byte {
+	return []byte(_DIR_EDGE_PREFIX + parent + _DIR_EDGE_SEP)
+}
+
+func edgeKey(parent string, child string) []byte {
+	return []byte(_DIR_EDGE_PREFIX + parent + _DIR_EDGE_SEP + child)
+}
+
+/* Legacy entries are keyed by the plain node path */
+func isLegacyDirKey(k []byte) bool {
+	return len(k) == 0 || (k[0] != _DIR_EDGE_PREFIX[0] && k[0] != _DIR_LAYOUT_KEY[0])
+}
+
+/* Children of a node as per the edge layout */
+func (this *indices) _lsEdges(spath []byte) []string {
+	prefix := edgePrefix(string(spath))
+
+	it := this.dir.NewIterator(this.ro)
+	defer it.Close()
+
+	retval := []string{}
+	for it.Seek(prefix); it.Valid(); it.Next() {
+		k := it.Key()
+		if !bytes.HasPrefix(k, prefix) {
+			break
+		}
+		retval = append(retval, string(k[len(prefix):]))
+	}
+	return retval
+}
+
+/* Children of a node as per the legacy layout */
+func (this *indices) _lsLegacy(spath []byte) []string {
+	val, err := this.dir.Get(this.ro, spath)
+	if err != nil {
+		iLogger.Errorf("%v", err)
+		return nil
+	}
+	return decodeLegacyChildren(spath, val)
+}
+
+func decodeLegacyChildren(spath []byte, val []byte) []string {
+	var retval []string
+	if len(val) == 0 {
+		return retval
+	}
+	if err := json.Unmarshal(val, &retval); err != nil {
+		iLogger.Errorf("legacy entry of #%s# is corrupt: %v", spath, err)
+		return nil
+	}
+	return retval
+}
+
+/* Union of two child lists; the order of the first one is retained */
+func mergeChildren(x []string, y []string) []string {
+	if len(y) == 0 {
+		return x
+	}
+	seen := make(map[string]bool, len(x))
+	for _, c := range x {
+		seen[c] = true
+	}
+	for _, c := range y {
+		if !seen[c] {
+			seen[c] = true
+			x = append(x, c)
+		}
+	}
+	return x
+}
+
+func (this *indices) _hasEdge(key []byte) bool {
+	val, err := this.dir.Get(this.ro, key)
+	if err != nil {
+		iLogger.Errorf("%v", err)
+		return false
+	}
+	return val != nil
+}
+
+/*
+Makes the directory entries for a new metric. Edges are written bottom up
+till an existing one is found, as all the ones above it must exist too.
+
+This is an unsafe method; to be called only inside the call stack of
+a safe method
+*/
+func (this *indices) _registerPath(parts []string) bool {
+	batch := levigo.NewWriteBatch()
+	defer batch.Close()
+
+	for n := len(parts); n > 0; n-- {
+		key := edgeKey(strings.Join(parts[:n-1], "."), parts[n-1])
+		if this._hasEdge(key) {
+			break
+		}
+		batch.Put(key, nil)
+	}
+
+	err := this.dir.Write(this.wo, batch)
+	if err != nil {
+		iLogger.Errorf("%v", err)
+	}
+	return err == nil
+}
+
+/* Stamps a fresh directory db with the current layout or kicks off the
+migration of a legacy one */
+func (this *indices) _initLayout() {
+	layout, err := this.dir.Get(this.ro, []byte(_DIR_LAYOUT_KEY))
+	if err != nil {
+		iLogger.Panicf("Cannot read dir db layout %v", err)
+	}
+	if string(layout) == _DIR_LAYOUT_EDGES {
+		this.migrated = 1
+		return
+	}
+
+	it := this.dir.NewIterator(this.ro)
+	it.SeekToFirst()
+	empty := !it.Valid()
+	it.Close()
+
+	if empty {
+		if err := this.dir.Put(this.wo, []byte(_DIR_LAYOUT_KEY), []byte(_DIR_LAYOUT_EDGES)); err != nil {
+			iLogger.Panicf("Cannot initialize dir db %v", err)
+		}
+		this.migrated = 1
+		return
+	}
+
+	iLogger.Infof("dir db has legacy entries; migrating in the background")
+	go this._migrateLegacy()
+}
+
+/* Rewrites all legacy entries into edges. Each batch is applied atomically
+under the write lock, with the legacy entries being deleted in the same
+batch; thus listings never miss a child midway through */
+func (this *indices) _migrateLegacy() {
+	var nodes, edges int
+	var resume []byte
+
+	for {
+		n, e, next, ok := this._migrateBatch(resume)
+		nodes, edges, resume = nodes+n, edges+e, next
+		if !ok {
+			return
+		}
+		if resume == nil {
+			break
+		}
+	}
+
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+	if this.closed {
+		return
+	}
+	if err := this.dir.Put(this.wo, []byte(_DIR_LAYOUT_KEY), []byte(_DIR_LAYOUT_EDGES)); err != nil {
+		iLogger.Errorf("migration could not be marked complete: %v", err)
+		return
+	}
+	atomic.StoreInt32(&this.migrated, 1)
+	iLogger.Infof("dir db migration complete; %d node(s) rewritten as %d edge(s)", nodes, edges)
+}
+
+/* Migrates a batch of legacy entries starting at a given key; a nil resume
+key refers to the very first one. Returns the key to resume from, which is
+nil once there is nothing left */
+func (this *indices) _migrateBatch(resume []byte) (int, int, []byte, bool) {
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+
+	if this.closed {
+		return 0, 0, nil, false
+	}
+
+	batch := levigo.NewWriteBatch()
+	defer batch.Close()
+
+	it := this.dir.NewIterator(this.ro)
+	defer it.Close()
+
+	if resume == nil {
+		it.SeekToFirst()
+	} else {
+		it.Seek(resume)
+	}
+
+	var nodes, edges int
+	var next []byte
+	for ; it.Valid(); it.Next() {
+		k := it.Key()
+		if !isLegacyDirKey(k) {
+			/* Save for the root, the reserved keys sort before all the
+			legacy ones; skip past them */
+			it.Seek([]byte{2})
+			if !it.Valid() {
+				break
+			}
+			k = it.Key()
+		}
+		if nodes == _DIR_MIGRATION_BATCH {
+			next = k
+			break
+		}
+		for _, c := range decodeLegacyChildren(k, it.Value()) {
+			batch.Put(edgeKey(string(k), c), nil)
+			edges++
+		}
+		batch.Delete(k)
+		nodes++
+	}
+
+	if err := this.dir.Write(this.wo, batch); err != nil {
+		iLogger.Errorf("migration batch failed: %v", err)
+		return 0, 0, nil, false
+	}
+	return nodes, edges, next, true
+}
+
+/*
+Edits of the directory db that are to be applied atomically. Queries made
+through it account for the edits made thus far.
+
+This is an unsafe type; to be used only under the write lock
+*/
+type dirEdit struct {
+	idx     *indices
+	batch   *levigo.WriteBatch
+	deleted map[string]bool
+	added   map[string]map[string]bool // parent -> children
+}
+
+func (this *indices) newDirEdit() *dirEdit {
+	return &dirEdit{this, levigo.NewWriteBatch(), make(map[string]bool), make(map[string]map[string]bool)}
+}
+
+func (this *dirEdit) close() {
+	this.batch.Close()
+}
+
+func (this *dirEdit) hasEdge(parent string, child string) bool {
+	if this.added[parent][child] {
+		return true
+	}
+	key := edgeKey(parent, child)
+	return !this.deleted[string(key)] && this.idx._hasEdge(key)
+}
+
+func (this *dirEdit) addEdge(parent string, child string) {
+	key := edgeKey(parent, child)
+	delete(this.deleted, string(key))
+	if this.added[parent] == nil {
+		this.added[parent] = make(map[string]bool)
+	}
+	this.added[parent][child] = true
+	this.batch.Put(key, nil)
+}
+
+func (this *dirEdit) deleteEdge(parent string, child string) {
+	key := edgeKey(parent, child)
+	delete(this.added[parent], child)
+	this.deleted[string(key)] = true
+	this.batch.Delete(key)
+}
+
+/* Number of children of a node */
+func (this *dirEdit) children(node string) int {
+	n := len(this.added[node])
+	for _, c := range this.idx._lsEdges([]byte(node)) {
+		if !this.deleted[string(edgeKey(node, c))] && !this.added[node][c] {
+			n++
+		}
+	}
+	return n
+}
+
+/* Adds a node along with any of its missing ancestors */
+func (this *dirEdit) addPath(path string) {
+	for node := path; node != ""; node = getParent(node) {
+		if this.hasEdge(getParent(node), leafName(node)) {
+			break
+		}
+		this.addEdge(getParent(node), leafName(node))
+	}
+}
+
+/* Removes a node provided it has no children, followed by the ancestors
+left without any children that are not metrics. Returns the nodes removed */
+func (this *dirEdit) removeNode(path string, isMetric func(string) bool) []string {
+	var retval []string
+	if !this.hasEdge(getParent(path), leafName(path)) || this.children(path) != 0 {
+		return retval
+	}
+	this.deleteEdge(getParent(path), leafName(path))
+	retval = append(retval, path)
+
+	for node := getParent(path); node != ""; node = getParent(node) {
+		if isMetric(node) || this.children(node) != 0 {
+			break
+		}
+		this.deleteEdge(getParent(node), leafName(node))
+		retval = append(retval, node)
+	}
+	return retval
+}
+
+/* Removes all the edges below the given nodes */
+func (this *dirEdit) clearChildren(nodes []string) {
+	for _, node := range nodes {
+		for _, c := range this.idx._lsEdges([]byte(node)) {
+			this.deleteEdge(node, c)
+		}
+	}
+}
+
+func (this *dirEdit) apply() error {
+	return this.idx.dir.Write(this.idx.wo, this.batch)
+}
@@ -0,0 +1,216 @@
+package leveltsd
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+/* Formats of an export */
+const (
+	EXPORT_CSV       = "csv"       // metric,timestamp,value with a header
+	EXPORT_JSONL     = "jsonl"     // {"metric":..., "timestamp":..., "value":...} per line; null for NaN & infinities
+	EXPORT_PLAINTEXT = "plaintext" // the carbon protocol; can be replayed into a daemon
+)
+
+type ExportRequest struct {
+	Glob   string
+	Start  uint64
+	End    uint64 // inclusive
+	Format string
+}
+
+/* Writes a datapoint in one of the export formats */
+type exportWriter interface {
+	write(metric string, x Datapoint) error
+	flush() error
+}
+
+func newExportWriter(w io.Writer, format string) (exportWriter, error) {
+	switch format {
+	case EXPORT_CSV:
+		retval := &csvExport{csv.NewWriter(w)}
+		return retval, retval.w.Write([]string{"metric", "timestamp", "value"})
+	case EXPORT_JSONL:
+		return &jsonlExport{bufio.NewWriter(w), "", nil}, nil
+	case EXPORT_PLAINTEXT:
+		return &plaintextExport{bufio.NewWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("no export format by the name of %q", format)
+	}
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type csvExport struct {
+	w *csv.Writer
+}
+
+func (this *csvExport) write(metric string, x Datapoint) error {
+	return this.w.Write([]string{metric, strconv.FormatUint(x.Timestamp, 10), formatValue(x.Value)})
+}
+
+func (this *csvExport) flush() error {
+	this.w.Flush()
+	return this.w.Error()
+}
+
+type jsonlExport struct {
+	w      *bufio.Writer
+	metric string
+	quoted []byte // metric as a JSON string
+}
+
+func (this *jsonlExport) write(metric string, x Datapoint) error {
+	if metric != this.metric || this.quoted == nil {
+		this.metric = metric
+		this.quoted, _ = json.Marshal(metric)
+	}
+	val := "null"
+	if !math.IsNaN(x.Value) && !math.IsInf(x.Value, 0) {
+		val = formatValue(x.Value)
+	}
+	_, err := fmt.Fprintf(this.w, "{\"metric\":%s,\"timestamp\":%d,\"value\":%s}\n", this.quoted, x.Timestamp, val)
+	return err
+}
+
+func (this *jsonlExport) flush() error {
+	return this.w.Flush()
+}
+
+type plaintextExport struct {
+	w *bufio.Writer
+}
+
+func (this *plaintextExport) write(metric string, x Datapoint) error {
+	_, err := fmt.Fprintf(this.w, "%s %s %d\n", metric, formatValue(x.Value), x.Timestamp)
+	return err
+}
+
+func (this *plaintextExport) flush() error {
+	return this.w.Flush()
+}
+
+/*
+Writes the datapoints of every metric matching a glob within a time range.
+Shards are visited one after another, each for all the metrics, so no shard
+is opened more than once; only the datapoints of a metric within a shard are
+held in memory at a time. While shards of several partition schemes are in
+use, metrics are visited one after another instead, as their datapoints are
+to be merged. Returns the number of datapoints written
+*/
+func (this *levelfederator) export(w io.Writer, req *ExportRequest) (uint64, error) {
+	if req.Start > req.End {
+		return 0, fmt.Errorf("start %d is past end %d", req.Start, req.End)
+	}
+	metrics := make([]*metricIndex, 0)
+	err := this.idx.globMetrics(req.Glob, func(metric string) bool {
+		if key, ok := this.getMetric(metric); ok {
+			metrics = append(metrics, key)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	out, err := newExportWriter(w, req.Format)
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	emit := func(key *metricIndex, points []Datapoint) error {
+		for _, x := range points {
+			if err := out.write(key.metric, x); err != nil {
+				return err
+			}
+		}
+		n += uint64(len(points))
+		return nil
+	}
+
+	if len(this.schemes) > 1 {
+		for _, key := range metrics {
+			if err := emit(key, this.dataScan(key, req.Start, req.End)); err != nil {
+				return n, err
+			}
+		}
+		return n, out.flush()
+	}
+
+	for _, id := range this.partition.rangeShards(req.Start, req.End) {
+		for _, key := range metrics {
+			points := this.shardScan(id, key, req.Start, req.End)
+			if points == nil {
+				break // no such shard
+			}
+			if err := emit(key, points); err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, out.flush()
+}
+
+/* Serves exports on the reader port; glob, from & until (unix time, both
+inclusive) and format (csv by default). Until defaults to now & from to a
+day before until */
+func (this *levelfederator) serveExport(w http.ResponseWriter, r *http.Request) {
+	req := ExportRequest{Glob: r.FormValue("glob"), Format: r.FormValue("format")}
+	if req.Format == "" {
+		req.Format = EXPORT_CSV
+	}
+	var err error
+	if req.Start, req.End, err = parseRange(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", exportContentTypes[req.Format])
+	out := &countingWriter{w: w}
+	n, err := this.export(out, &req)
+	if err != nil {
+		if out.n == 0 {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		/* Too late to tell the client other than by cutting the response short */
+		fLogger.Limited("export").Errorf("export of %s failed after %d datapoint(s): %v", req.Glob, n, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+var exportContentTypes = map[string]string{
+	EXPORT_CSV:       "text/csv; charset=utf-8",
+	EXPORT_JSONL:     "application/x-ndjson",
+	EXPORT_PLAINTEXT: "text/plain; charset=utf-8",
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (this *countingWriter) Write(b []byte) (int, error) {
+	n, err := this.w.Write(b)
+	this.n += int64(n)
+	return n, err
+}
+
+/* Exports from a root that no daemon is running on */
+func Export(root string, w io.Writer, req *ExportRequest) (uint64, error) {
+	f, err := openFederator(parseConfig(map[string]string{"root": root}))
+	if err != nil {
+		return 0, fmt.Errorf("%v; export from a running daemon over its reader port instead", err)
+	}
+	defer f.release()
+	return f.export(w, req)
+}
@@ -1,12 +1,14 @@
 package leveltsd
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"github.com/extemporalgenome/epochdate"
 	"inmobi.com/graphite/carbon/logging"
 	"inmobi.com/graphite/carbon/mq"
-	"log"
+	"math"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -14,14 +16,24 @@ import (
 	"time"
 )
 
-var fLogger *log.Logger
+var fLogger *logging.Logger
 
 var queryid uint32
 
 const _MAX_OPEN_SHARDS = 23
 
+/* How often shards are checked for being old enough to be archived */
+const _ARCHIVE_INTERVAL = time.Hour
+
+/* A shard is deemed idle once these many batch intervals pass without a write */
+const _IDLE_BATCH_INTERVALS = 2
+
+var errShardNotOpen = errors.New("shard is not open")
+var errShardBusy = errors.New("shard is not idle")
+var errShardReleased = errors.New("shard is released")
+
 func init() {
-	fLogger = logging.MakeLogger("leveltsd-federator: ")
+	fLogger = logging.MakeLogger("leveltsd-federator")
 }
 
 /*
@@ -32,20 +44,51 @@ needed for proper functioning of various operations
 type levelfederator struct {
 	idx       *indices
 	config     leveltsdConf
-	shards    map[string]*shard
-	writeLock sync.Locker
+	shards    map[string]*shard    // open for writes
+	opening   map[string]chan bool // being opened for writes; closed once open or failed to
+	readers   *readCache           // of the shards open for reads alone
+	writeLock *sync.RWMutex        // guards shards & opening; never held around readers
+	stats     map[string]dbStats
+	statsLock sync.Mutex
+	done      chan bool
+
+	partition *partitionScheme   // of new shards
+	schemes   []*partitionScheme // to read from; partition first
+
+	archives    map[string]*archive
+	archiving   map[string]*shard // shards being converted into archives
+	archiveLock sync.RWMutex
+	archiver    sync.WaitGroup
+
+	snapshotLock sync.Mutex // held by snapshots, archival & purges
+	pinned       bool       // no shard is closed while set
+
+	readSlots chan bool // taken by a shard scan while it is under way
 }
 
 type leveltsdConf struct {
-	Basedir string
-	Sconfig shard_config
+	Basedir        string
+	Sconfig        shard_config
+	Stats_interval time.Duration
+	Partition      string
+	Archive_after  time.Duration // 0 if shards are never archived
+	Backfill       backfillConf
+
+	Max_points_per_query uint64        // 0 if unlimited
+	Read_concurrency     uint          // shards scanned at once
+	Query_timeout        time.Duration // 0 if unlimited
+	Read_cache_shards    uint          // read handles kept open
+	Read_cache_ttl       time.Duration // a read handle is kept open unused for
+
+	Write_failure_window  time.Duration
+	Min_free_disk_percent uint
 }
 
 func buildStorage(configMap map[string]string) *levelfederator {
 	retval := new(levelfederator)
 
 	config := parseConfig(configMap)
-	fLogger.Printf("leveltsd config is %v\n", logging.ObjectJsonifier(config))
+	fLogger.Infof("leveltsd config is %v", logging.ObjectJsonifier(config))
 
 	retval.config = config
 	root := config.Basedir
@@ -57,11 +100,63 @@ func buildStorage(configMap map[string]string) *levelfederator {
 	}
 	retval.idx, _ = mkIndex(root)
 	retval.shards = make(map[string]*shard)
-	retval.writeLock = new(sync.Mutex)
+	retval.writeLock = new(sync.RWMutex)
+	retval.done = make(chan bool)
+	retval.readSlots = newReadSlots(config.Read_concurrency)
+	retval.opening = make(map[string]chan bool)
+	retval.readers = newReadCache(root, config.Sconfig, config.Read_cache_shards, config.Read_cache_ttl, retval.owns)
+
+	retval.partition, _ = getPartitionScheme(config.Partition)
+	retval.archives = loadArchives(root)
+	retval.archiving = make(map[string]*shard)
+	retval.schemes = readSchemes(retval.partition, append(shardIds(root), archiveIds(root)...))
+	if len(retval.schemes) > 1 {
+		names := make([]string, 0, len(retval.schemes))
+		for _, p := range retval.schemes {
+			names = append(names, p.name)
+		}
+		fLogger.Infof("shards partitioned by %s found on disk; reads consult all of them", strings.Join(names, ", "))
+	}
+
+	go retval.statsLoop(config.Stats_interval)
+	go retval.readers.expireLoop(retval.done)
+	go retval.idx.aliasLoop(_ALIAS_REAP_INTERVAL, retval.done)
+	if config.Archive_after > 0 {
+		retval.archiver.Add(1)
+		go retval.archiveLoop(_ARCHIVE_INTERVAL)
+	}
 
 	return retval
 }
 
+/* A federator for the offline tools; it runs none of the background tasks
+of buildStorage. Fails when the daemon is running on the same root */
+func openFederator(config leveltsdConf) (*levelfederator, error) {
+	root := config.Basedir
+	if stat, err := os.Stat(root); err != nil {
+		return nil, err
+	} else if !stat.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+
+	retval := new(levelfederator)
+	retval.config = config
+	if retval.idx, _ = mkIndex(root); retval.idx == nil {
+		return nil, errors.New("cannot open the indices; is the daemon running?")
+	}
+	retval.shards = make(map[string]*shard)
+	retval.writeLock = new(sync.RWMutex)
+	retval.done = make(chan bool)
+	retval.readSlots = newReadSlots(config.Read_concurrency)
+	retval.opening = make(map[string]chan bool)
+	retval.readers = newReadCache(root, config.Sconfig, config.Read_cache_shards, config.Read_cache_ttl, retval.owns)
+	retval.partition, _ = getPartitionScheme(config.Partition)
+	retval.archives = loadArchives(root)
+	retval.archiving = make(map[string]*shard)
+	retval.schemes = readSchemes(retval.partition, append(shardIds(root), archiveIds(root)...))
+	return retval, nil
+}
+
 func (this *levelfederator) getMetric(metric string) (*metricIndex, bool) {
 	return this.idx.getMetric(metric, false)
 }
@@ -81,13 +176,14 @@ func (this *levelfederator) uncheckedWrite(key *metricIndex, x mq.MetricReading)
 /* Returns handle to an open shard that would contain data for a given
 time range */
 func (this *levelfederator) getShard(ts uint64, createIfAbsent bool) *shard {
-	t := time.Unix(int64(ts), 0).UTC()
-	yyyymmdd := fmt.Sprintf("%4d%02d%02d", t.Year(), t.Month(), t.Day())
-
-	return this._getShardFromDate(yyyymmdd, createIfAbsent)
+	return this._getShardFromDate(this.partition.shardFor(ts), createIfAbsent)
 }
 
 func (this *levelfederator) release() {
+	close(this.done)
+	this.archiver.Wait()
+	this.readers.release()
+
 	this.writeLock.Lock()
 	defer this.writeLock.Unlock()
 
@@ -100,74 +196,290 @@ func (this *levelfederator) release() {
 }
 
 func (this *levelfederator) _getShardFromDate(d string, createIfAbsent bool) *shard {
-	if s, ok := this.shards[d]; ok {
+	this.writeLock.RLock()
+	s, ok := this.shards[d]
+	this.writeLock.RUnlock()
+	if ok {
 		return s
 	}
 	return this._makeShardFromDate(d, createIfAbsent)
 }
 
+/* The handle reads of a shard go through: the shard if it is open for
+writes, its read handle otherwise. Nil if there is no such shard or it is
+archived; neither opens it for writes. No federator lock is held while a read
+handle is opened */
+func (this *levelfederator) _readShard(d string) *shard {
+	return this._shardHandle(d, false)
+}
+
+/* _readShard, creating the shard, through a read handle, if there is no such
+shard; bulk writes that are best kept off the shards open for writes go
+through it */
+func (this *levelfederator) _shardHandle(d string, createIfAbsent bool) *shard {
+	for {
+		this.writeLock.RLock()
+		s, ok := this.shards[d]
+		opening := this.opening[d]
+		released := this.shards == nil
+		this.writeLock.RUnlock()
+
+		switch {
+		case ok:
+			return s
+		case released:
+			return nil
+		case opening != nil:
+			<-opening
+			continue
+		case this._isCold(d):
+			if createIfAbsent {
+				fLogger.Limited("archived").Warnf("shard %s is archived; dropping datapoints meant for it", d)
+			}
+			return nil
+		}
+		if s, ok := this.readers.get(d, createIfAbsent); ok {
+			return s
+		}
+	}
+}
+
+/* Whether a shard is open or being opened for writes, or is archived; no
+read handle is opened for such a shard */
+func (this *levelfederator) owns(id string) bool {
+	this.writeLock.RLock()
+	defer this.writeLock.RUnlock()
+
+	_, open := this.shards[id]
+	_, opening := this.opening[id]
+	return open || opening || this._isCold(id)
+}
+
 func (this *levelfederator) _makeShardFromDate(d string, createIfAbsent bool) *shard {
 	this.writeLock.Lock()
 	defer this.writeLock.Unlock()
 
+	this._awaitOpen(d)
 	if s, ok := this.shards[d]; ok {
 		return s
 	}
+	if this.shards == nil {
+		return nil
+	}
+	if this._isCold(d) {
+		if createIfAbsent {
+			fLogger.Limited("archived").Warnf("shard %s is archived; dropping datapoints meant for it", d)
+		}
+		return nil
+	}
 
-	path := _shard_namer(this.config.Basedir, d)
-	if s, err := mkShard(path, createIfAbsent, this.config.Sconfig); err != nil {
-		fLogger.Printf("mkshard for %s failed\n", path)
+	s, err := this._open(d, createIfAbsent)
+	if err != nil {
+		fLogger.Limited("mkshard").Errorf("mkshard for %s failed: %v", _shard_namer(this.config.Basedir, d), err)
 		return nil
-	} else {
-		/* limit max open shards
-		TODO: smarter, selective eviction logic */
-		if len(this.shards) > _MAX_OPEN_SHARDS {
-			for _, s := range this.shards {
-				s.release()
-			}
-			this.shards = make(map[string]*shard)
+	}
+	if this.shards == nil {
+		/* released in the meantime */
+		s.release()
+		return nil
+	}
+	/* limit max open shards */
+	if len(this.shards) >= _MAX_OPEN_SHARDS && !this.pinned {
+		this._evict(len(this.shards) - _MAX_OPEN_SHARDS + 1)
+	}
+	this.shards[d] = s
+	return s
+}
+
+/* Waits for a shard being opened for writes, if it is, to be opened.
+Expects the write lock to be held, & holds it again on return */
+func (this *levelfederator) _awaitOpen(id string) {
+	for {
+		opening, ok := this.opening[id]
+		if !ok {
+			return
 		}
-		this.shards[d] = s
-		return s
+		this.writeLock.Unlock()
+		<-opening
+		this.writeLock.Lock()
 	}
 }
 
-/* Finds a set of candidate shards for a given query */
-func _rangeShards(start uint64, end uint64) []string {
-	if start > end {
-		fLogger.Panicf("Start is greater than end: %d %d\n", start, end)
+/* Opens a shard for writes; the shard is claimed first, so that neither a
+read handle nor another shard is opened for it meanwhile, & its read handle
+is closed. The write lock, which is expected to be held, is let go of while
+the shard is opened & held again on return */
+func (this *levelfederator) _open(id string, createIfAbsent bool) (*shard, error) {
+	opening := make(chan bool)
+	this.opening[id] = opening
+	this.writeLock.Unlock()
+
+	this.readers.take(id)
+	s, err := mkShard(_shard_namer(this.config.Basedir, id), createIfAbsent, this.config.Sconfig)
+
+	this.writeLock.Lock()
+	delete(this.opening, id)
+	close(opening)
+	return s, err
+}
+
+/* Releases the n shards written to least lately, those never written to
+since they were opened first; a scan under way on one of them is finished
+first & any scan after is told to open it again. Expects the write lock to be
+held */
+func (this *levelfederator) _evict(n int) {
+	ids := make([]string, 0, len(this.shards))
+	for id := range this.shards {
+		ids = append(ids, id)
 	}
-	sdate, _ := epochdate.NewFromUnix(int64(start))
-	edate, _ := epochdate.NewFromUnix(int64(end))
-	retval := make([]string, 0, edate-sdate+1)
-	for i := sdate; i <= edate; i++ {
-		dashDate := i.String()
-		dashDate = strings.Replace(dashDate, "-", "", -1)
-		retval = append(retval, dashDate)
+	idle := make(map[string]time.Duration, len(ids))
+	for _, id := range ids {
+		idle[id] = this.shards[id].idleFor()
+	}
+	sort.Slice(ids, func(i, j int) bool { return idle[ids[i]] > idle[ids[j]] })
+	for _, id := range ids[:n] {
+		this.shards[id].release()
+		delete(this.shards, id)
+	}
+}
+
+/* Describes an open shard */
+type shardInfo struct {
+	Id           string
+	Queue_depth  int
+	Idle_seconds float64 // -1 if never written to since it was opened
+}
+
+func (this *levelfederator) openShards() []shardInfo {
+	this.writeLock.RLock()
+	defer this.writeLock.RUnlock()
+
+	retval := make([]shardInfo, 0, len(this.shards))
+	for id, s := range this.shards {
+		idle := s.idleFor()
+		info := shardInfo{id, len(s.wchan), idle.Seconds()}
+		if idle == time.Duration(math.MaxInt64) {
+			info.Idle_seconds = -1
+		}
+		retval = append(retval, info)
 	}
 	return retval
 }
 
-/* Dispatches and federates a search query across all candidate shards */
-func (this *levelfederator) dataScan(key *metricIndex, start uint64, end uint64) []Datapoint {
-	atomic.AddUint32(&queryid, 1)
-	queryLog := fmt.Sprintf("query(%010d)", queryid)
+/* Flushes the writers of all open shards; returns the number of shards.
+Writes, opens & reads go on meanwhile; a shard closed in the meantime has
+been flushed as it was closed & is skipped */
+func (this *levelfederator) flushAll() int {
+	this.writeLock.RLock()
+	shards := make([]*shard, 0, len(this.shards))
+	for _, s := range this.shards {
+		shards = append(shards, s)
+	}
+	this.writeLock.RUnlock()
 
-	shards := _rangeShards(start, end)
-	retval := make([]Datapoint, 0, 1440)
-	fLogger.Printf("%s shards to scan: %d\n", queryLog, len(shards))
+	flushed := 0
 	for _, s := range shards {
-		shandler := this._getShardFromDate(s, false)
-		if shandler != nil {
-			partial_result := shandler.dataScan(key, start, end)
-			fLogger.Printf("%s partial datapoints found %d\n", queryLog, len(partial_result))
-			retval = append(retval, partial_result...)
+		s.busy.RLock()
+		if !s.released {
+			s.flush()
+			flushed++
 		}
+		s.busy.RUnlock()
 	}
-	fLogger.Printf("%s total datapoints found %d\n", queryLog, len(retval))
+	return flushed
+}
+
+/* Closes an open shard provided nothing has been written to it lately.
+A subsequent write or read would simply open it again */
+func (this *levelfederator) closeShard(id string) error {
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+
+	s, ok := this.shards[id]
+	if !ok {
+		return errShardNotOpen
+	}
+	if this.pinned || s.idleFor() < _IDLE_BATCH_INTERVALS*this.config.Sconfig.Write_batch_fill_timeout {
+		return errShardBusy
+	}
+	delete(this.shards, id)
+	s.flush()
+	s.release()
+	return nil
+}
+
+/* Dispatches and federates a search query across all candidate shards;
+the query is neither timed out nor cancelled */
+func (this *levelfederator) dataScan(key *metricIndex, start uint64, end uint64) []Datapoint {
+	retval, _ := this.dataScanContext(context.Background(), key, start, end)
 	return retval
 }
 
+/* dataScan with the candidate shards scanned concurrently; fails once ctx is
+done */
+func (this *levelfederator) dataScanContext(ctx context.Context, key *metricIndex, start uint64, end uint64) ([]Datapoint, error) {
+	queryLog := fmt.Sprintf("query(%010d)", atomic.AddUint32(&queryid, 1))
+
+	parts := make([][]Datapoint, 0, len(this.schemes))
+	for _, p := range this.schemes {
+		shards := p.rangeShards(start, end)
+		retval := make([]Datapoint, 0, 1440)
+		fLogger.Debugf("%s %s shards to scan: %d", queryLog, p.name, len(shards))
+		partial := make([][]Datapoint, len(shards))
+		err := this.scanInOrder(ctx, len(shards), func(i int) {
+			partial[i] = this.shardScan(shards[i], key, start, end)
+		}, func(i int) bool {
+			if partial[i] != nil {
+				fLogger.Debugf("%s partial datapoints found %d", queryLog, len(partial[i]))
+				retval = append(retval, partial[i]...)
+			}
+			return true
+		})
+		if err != nil {
+			fLogger.Debugf("%s given up on: %v", queryLog, err)
+			return nil, err
+		}
+		parts = append(parts, retval)
+	}
+
+	retval := parts[0]
+	if len(parts) > 1 {
+		retval = mergeSchemes(parts)
+	}
+	fLogger.Debugf("%s total datapoints found %d", queryLog, len(retval))
+	return retval, nil
+}
+
+/* Scans a single shard, be it archived or not; nil if there is no such
+shard */
+func (this *levelfederator) shardScan(id string, key *metricIndex, start uint64, end uint64) []Datapoint {
+	if retval := this.shardMultiScan(id, []*metricIndex{key}, start, end); retval != nil {
+		return retval[0]
+	}
+	return nil
+}
+
+/* shardScan for many metrics; keys are best sorted by short code. A shard
+released in the middle, by eviction or being archived, is looked up again */
+func (this *levelfederator) shardMultiScan(id string, keys []*metricIndex, start uint64, end uint64) [][]Datapoint {
+	for attempt := 0; attempt < 3; attempt++ {
+		if retval, cold := this.coldMultiScan(id, keys, start, end); cold {
+			if retval != nil {
+				return retval
+			}
+			continue
+		}
+		if s := this._readShard(id); s != nil {
+			if retval := s.multiScan(keys, start, end); retval != nil {
+				return retval
+			}
+		} else if !this._isCold(id) {
+			return nil
+		}
+	}
+	return nil
+}
+
 /* Make the fs name for a given shard */
 func _shard_namer(baseDir string, shardId string) string {
 	return fmt.Sprintf("%s/tsd-data-%s.db", baseDir, shardId)
@@ -196,7 +508,92 @@ func parseConfig(config map[string]string) leveltsdConf {
 		sconfig.Data_cache = int(*val)
 	}
 
+	if val := _getInt(config, "write-queue-length", 32); val != nil {
+		sconfig.Write_queue_length = uint(*val)
+	}
+
+	if val, ok := config["shard-codec"]; ok {
+		codec, ok := codecAliases[val]
+		if !ok {
+			fLogger.Panicf("parse error in shard-codec; no codec by the name of %s", val)
+		}
+		sconfig.Codec = codec
+	}
+
 	retval.Sconfig = sconfig
+
+	retval.Partition = _DEFAULT_PARTITION
+	if val, ok := config["shard-partition"]; ok {
+		if _, ok := getPartitionScheme(val); !ok {
+			fLogger.Panicf("parse error in shard-partition; expected one of hour, day, week or month but got %s", val)
+		}
+		retval.Partition = val
+	}
+
+	if val := _getInt(config, "archive-after-days", 32); val != nil {
+		retval.Archive_after = time.Duration(*val) * 24 * time.Hour
+	}
+
+	retval.Backfill = defaultBackfillConf()
+	if val := _getInt(config, "backfill-port", 16); val != nil {
+		retval.Backfill.Port = uint16(*val)
+	}
+	if val := _getInt(config, "backfill-batch-points", 32); val != nil {
+		retval.Backfill.Batch_points = uint(*val)
+	}
+	if val := _getInt(config, "backfill-max-points-per-second", 32); val != nil {
+		retval.Backfill.Max_points_per_second = uint(*val)
+	}
+	if val := _getInt(config, "backfill-max-level0-files", 16); val != nil {
+		retval.Backfill.Max_level0_files = int(*val)
+	}
+
+	retval.Max_points_per_query = _MAX_POINTS_PER_QUERY
+	if val := _getInt(config, "max-points-per-query", 64); val != nil {
+		retval.Max_points_per_query = *val
+	}
+
+	retval.Read_concurrency = _READ_CONCURRENCY
+	if val := _getInt(config, "read-concurrency", 8); val != nil {
+		if *val == 0 || *val >= _MAX_OPEN_SHARDS {
+			fLogger.Panicf("parse error in read-concurrency; expected 1 to %d but got %d", _MAX_OPEN_SHARDS-1, *val)
+		}
+		retval.Read_concurrency = uint(*val)
+	}
+
+	retval.Query_timeout = _QUERY_TIMEOUT_SECONDS * time.Second
+	if val := _getInt(config, "query-timeout-seconds", 32); val != nil {
+		retval.Query_timeout = time.Duration(*val) * time.Second
+	}
+
+	retval.Read_cache_shards = _READ_CACHE_SHARDS
+	if val := _getInt(config, "read-cache-shards", 16); val != nil {
+		retval.Read_cache_shards = uint(*val)
+	}
+
+	retval.Read_cache_ttl = _READ_CACHE_TTL_SECONDS * time.Second
+	if val := _getInt(config, "read-cache-ttl-seconds", 32); val != nil {
+		retval.Read_cache_ttl = time.Duration(*val) * time.Second
+	}
+
+	retval.Stats_interval = _STATS_INTERVAL_SECONDS * time.Second
+	if val := _getInt(config, "stats-interval-seconds", 32); val != nil {
+		if *val == 0 {
+			fLogger.Panicf("parse error in stats-interval-seconds; expected a positive number of seconds but got 0")
+		}
+		retval.Stats_interval = time.Duration(*val) * time.Second
+	}
+
+	retval.Write_failure_window = _WRITE_FAILURE_WINDOW_SECONDS * time.Second
+	if val := _getInt(config, "write-failure-window-seconds", 32); val != nil {
+		retval.Write_failure_window = time.Duration(*val) * time.Second
+	}
+
+	retval.Min_free_disk_percent = _MIN_FREE_DISK_PERCENT
+	if val := _getInt(config, "min-free-disk-percent", 8); val != nil {
+		retval.Min_free_disk_percent = uint(*val)
+	}
+
 	return retval
 }
 
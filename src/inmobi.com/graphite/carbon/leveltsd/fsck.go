@@ -0,0 +1,429 @@
+package leveltsd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/jmhodges/levigo"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+/* Kinds of problems reported by Fsck */
+const (
+	FSCK_DANGLING_LEAF      = "dangling-leaf"      // a leaf of tsd-dir.db that is not a metric
+	FSCK_DETACHED_NODE      = "detached-node"      // a node of tsd-dir.db missing from its parent
+	FSCK_UNLISTED_METRIC    = "unlisted-metric"    // a metric of tsd-map.db missing from tsd-dir.db
+	FSCK_MALFORMED_CODE     = "malformed-code"     // a metric whose short code is not 16 bytes
+	FSCK_MISSING_CODE_OWNER = "missing-code-owner" // a short code absent from the reverse map
+	FSCK_CODE_COLLISION     = "code-collision"     // a short code shared by metrics
+	FSCK_STALE_CODE_OWNER   = "stale-code-owner"   // a reverse map entry of a metric that is gone
+	FSCK_STALE_ALIAS        = "stale-alias"        // an alias of a metric that is gone
+	FSCK_STALE_ORIGIN       = "stale-origin"       // the raw name of a metric that is gone
+	FSCK_MISSING_MAGIC      = "missing-magic"      // a shard without the scheme marker
+	FSCK_BAD_MAGIC          = "bad-magic"          // a shard stamped with an unknown codec
+	FSCK_MALFORMED_KEY      = "malformed-key"      // a shard key that is not short code + timestamp
+	FSCK_ORPHANED_CODE      = "orphaned-code"      // datapoints of a short code no metric resolves to
+	FSCK_CORRUPT_ARCHIVE    = "corrupt-archive"    // an archive that cannot be read through
+)
+
+/* How often the background tasks of the indices are polled for completion */
+const _FSCK_POLL_INTERVAL = 100 * time.Millisecond
+
+type FsckProblem struct {
+	Kind     string
+	Db       string
+	Key      string
+	Detail   string
+	Repaired bool
+}
+
+type FsckReport struct {
+	Metrics  int
+	Nodes    int
+	Shards   int
+	Archives int
+	Problems []FsckProblem
+}
+
+/* Number of problems that were not repaired */
+func (this *FsckReport) Outstanding() int {
+	n := 0
+	for _, p := range this.Problems {
+		if !p.Repaired {
+			n++
+		}
+	}
+	return n
+}
+
+func (this *FsckReport) add(kind string, db string, key string, detail string, repaired bool) {
+	this.Problems = append(this.Problems, FsckProblem{kind, db, key, detail, repaired})
+}
+
+/*
+Cross checks the indices & the shards under a root; the daemon must not be
+running. With repair set, the indices are brought in line with each other:
+missing entries are added in preference to existing ones being removed, save
+for directory leaves that do not resolve to a metric. Shards missing the
+scheme marker are stamped. Datapoints of short codes that no metric resolves
+to are only deleted with purgeOrphans set, archives being rewritten without
+them; such datapoints are left behind by design when metrics are deleted
+without purging their data. Corrupt archives are only reported.
+
+With repair set, a legacy directory db is migrated & the reverse map
+backfilled before any checks are made; without it, nothing is written to the
+indices & Fsck fails on indices that are yet to be migrated or backfilled
+*/
+func Fsck(root string, repair bool, purgeOrphans bool) (*FsckReport, error) {
+	if stat, err := os.Stat(root); err != nil {
+		return nil, err
+	} else if !stat.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+
+	if _, err := os.Stat(root + "/tsd-map.db"); err != nil {
+		return nil, err
+	}
+
+	idx, _ := openIndex(root, repair)
+	if idx == nil {
+		return nil, errors.New("cannot open the indices; is the daemon running?")
+	}
+	defer idx.release()
+	if repair {
+		idx.waitBackground()
+	} else if err := idx.pendingBackground(); err != nil {
+		return nil, err
+	}
+
+	retval := new(FsckReport)
+	codes, err := idx.fsck(retval, repair)
+	if err != nil {
+		return retval, err
+	}
+
+	for _, id := range shardIds(root) {
+		if err := fsckShard(_shard_namer(root, id), codes, retval, repair, purgeOrphans); err != nil {
+			return retval, err
+		}
+		retval.Shards++
+	}
+	for _, id := range archiveIds(root) {
+		if err := fsckArchive(_archive_namer(root, id), codes, retval, purgeOrphans); err != nil {
+			return retval, err
+		}
+		retval.Archives++
+	}
+	return retval, nil
+}
+
+/* Waits for the migration of the directory db & the backfill of the
+reverse map to complete */
+func (this *indices) waitBackground() {
+	for atomic.LoadInt32(&this.migrated) == 0 {
+		time.Sleep(_FSCK_POLL_INTERVAL)
+	}
+	for {
+		done, err := this.pkey.Get(this.ro, []byte(_MAP_CODES_KEY))
+		if err == nil && string(done) == _MAP_CODES_COMPLETE {
+			return
+		}
+		time.Sleep(_FSCK_POLL_INTERVAL)
+	}
+}
+
+/* Fails if the directory db is yet to be migrated or the reverse map to be
+backfilled; neither is checked for while they are */
+func (this *indices) pendingBackground() error {
+	layout, err := this.dir.Get(this.ro, []byte(_DIR_LAYOUT_KEY))
+	if err != nil {
+		return err
+	}
+	if string(layout) != _DIR_LAYOUT_EDGES && !isEmptyDb(this.dir, this.ro) {
+		return errors.New("the directory db is yet to be migrated; run with repair")
+	}
+	done, err := this.pkey.Get(this.ro, []byte(_MAP_CODES_KEY))
+	if err != nil {
+		return err
+	}
+	if string(done) != _MAP_CODES_COMPLETE && !isEmptyDb(this.pkey, this.ro) {
+		return errors.New("the reverse map is yet to be backfilled; run with repair")
+	}
+	return nil
+}
+
+func isEmptyDb(db *levigo.DB, ro *levigo.ReadOptions) bool {
+	it := db.NewIterator(ro)
+	defer it.Close()
+	it.SeekToFirst()
+	return !it.Valid()
+}
+
+/* Checks the indices against one another. Returns all the short codes in
+use */
+func (this *indices) fsck(report *FsckReport, repair bool) (map[string]bool, error) {
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+
+	/* The whole tree */
+	nodes := make(map[string]bool)
+	parents := make(map[string]bool)
+	it := this.dir.NewIterator(this.ro)
+	for it.Seek([]byte(_DIR_EDGE_PREFIX)); it.Valid(); it.Next() {
+		k := it.Key()
+		if !bytes.HasPrefix(k, []byte(_DIR_EDGE_PREFIX)) {
+			break
+		}
+		i := bytes.IndexByte(k, _DIR_EDGE_SEP[0])
+		parent, child := string(k[1:i]), string(k[i+1:])
+		nodes[childPath(parent, child)] = true
+		parents[parent] = true
+	}
+	it.Close()
+	report.Nodes = len(nodes)
+
+	/* The metrics & the reserved entries of the map db */
+	metrics := make(map[string][]byte)
+	owners := make(map[string]string)
+	origins := make(map[string]bool)
+	it = this.pkey.NewIterator(this.ro)
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		k, v := string(it.Key()), it.Value()
+		switch {
+		case len(k) > len(_MAP_CODE_PREFIX) && k[:len(_MAP_CODE_PREFIX)] == _MAP_CODE_PREFIX:
+			owners[k[len(_MAP_CODE_PREFIX):]] = string(v)
+		case len(k) > len(_MAP_ORIGIN_PREFIX) && k[:len(_MAP_ORIGIN_PREFIX)] == _MAP_ORIGIN_PREFIX:
+			origins[k[len(_MAP_ORIGIN_PREFIX):]] = true
+		case len(k) > 0 && k[0] == 0:
+			/* aliases & markers */
+		default:
+			metrics[k] = v
+		}
+	}
+	it.Close()
+	report.Metrics = len(metrics)
+	aliases := this._aliases()
+
+	edit := this.newDirEdit()
+	defer edit.close()
+	mapBatch := levigo.NewWriteBatch()
+	defer mapBatch.Close()
+
+	isMetric := func(node string) bool {
+		_, ok := metrics[node]
+		return ok
+	}
+	detached := make(map[string]bool)
+	for node := range nodes {
+		parent := getParent(node)
+		if parent != "" && !nodes[parent] && !detached[parent] {
+			detached[parent] = true
+			if repair {
+				edit.addPath(parent)
+			}
+			report.add(FSCK_DETACHED_NODE, "tsd-dir.db", parent, "has children but is not listed under its parent", repair)
+		}
+		if !parents[node] && !isMetric(node) {
+			if repair {
+				edit.removeNode(node, isMetric)
+			}
+			report.add(FSCK_DANGLING_LEAF, "tsd-dir.db", node, "no such metric in tsd-map.db", repair)
+		}
+	}
+
+	codes := make(map[string]bool)
+	for metric, code := range metrics {
+		if !nodes[metric] {
+			if repair {
+				edit.addPath(metric)
+			}
+			report.add(FSCK_UNLISTED_METRIC, "tsd-map.db", metric, "not listed in tsd-dir.db", repair)
+		}
+		if len(code) != 16 {
+			report.add(FSCK_MALFORMED_CODE, "tsd-map.db", metric, fmt.Sprintf("short code is %d bytes", len(code)), false)
+			continue
+		}
+		codes[string(code)] = true
+
+		if a, ok := aliases[metric]; ok {
+			if target, ok := metrics[a.target]; ok && bytes.Equal(target, code) {
+				continue
+			}
+			if repair {
+				mapBatch.Delete(aliasKey(metric))
+			}
+			report.add(FSCK_STALE_ALIAS, "tsd-map.db", metric, "points to "+a.target+" which does not share its short code", repair)
+		}
+
+		owner, ok := owners[string(code)]
+		if ok && owner != metric {
+			_, alias := aliases[owner]
+			ok = !alias && bytes.Equal(metrics[owner], code) // or else a stale owner
+			if ok {
+				report.add(FSCK_CODE_COLLISION, "tsd-map.db", metric, fmt.Sprintf("shares %x with %s", code, owner), false)
+			}
+		}
+		if !ok {
+			if repair {
+				mapBatch.Put(codeKey(code), []byte(metric))
+				owners[string(code)] = metric
+			}
+			report.add(FSCK_MISSING_CODE_OWNER, "tsd-map.db", metric, fmt.Sprintf("%x", code), repair)
+		}
+	}
+
+	for code, owner := range owners {
+		if x, ok := metrics[owner]; ok && bytes.Equal(x, []byte(code)) {
+			if _, alias := aliases[owner]; !alias {
+				continue
+			}
+		}
+		if repair {
+			mapBatch.Delete(codeKey([]byte(code)))
+		}
+		report.add(FSCK_STALE_CODE_OWNER, "tsd-map.db", owner, fmt.Sprintf("%x", code), repair)
+	}
+
+	for metric := range origins {
+		if !isMetric(metric) {
+			if repair {
+				mapBatch.Delete(originKey(metric))
+			}
+			report.add(FSCK_STALE_ORIGIN, "tsd-map.db", metric, "no such metric", repair)
+		}
+	}
+
+	if !repair {
+		return codes, nil
+	}
+	if err := this.pkey.Write(this.wo, mapBatch); err != nil {
+		return codes, err
+	}
+	return codes, edit.apply()
+}
+
+/* Checks the scheme marker of a shard & looks for datapoints that do not
+belong to any metric */
+func fsckShard(fs_path string, codes map[string]bool, report *FsckReport, repair bool, purgeOrphans bool) error {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	db, err := levigo.Open(fs_path, opts)
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs_path, err)
+	}
+	defer db.Close()
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+
+	label := _shard_label(fs_path)
+	magic, err := db.Get(ro, []byte(SCHEME_MAGIC_ID))
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs_path, err)
+	}
+	switch {
+	case magic == nil:
+		if repair {
+			if err := db.Put(wo, []byte(SCHEME_MAGIC_ID), []byte(SERIALIZATION_TECHNIQUE)); err != nil {
+				return fmt.Errorf("%s: %v", fs_path, err)
+			}
+		}
+		report.add(FSCK_MISSING_MAGIC, label, SCHEME_MAGIC_ID, "", repair)
+	case codecs[string(magic)] == nil:
+		report.add(FSCK_BAD_MAGIC, label, SCHEME_MAGIC_ID, fmt.Sprintf("%q is not a known codec", magic), false)
+	}
+
+	it := db.NewIterator(ro)
+	orphans := orphanedCodes(it, codes, report, label)
+	it.Close()
+
+	for _, code := range orphans {
+		n, err := purgePrefix(db, ro, wo, code, !purgeOrphans)
+		if err != nil {
+			return fmt.Errorf("%s: %v", fs_path, err)
+		}
+		report.add(FSCK_ORPHANED_CODE, label, fmt.Sprintf("%x", code), fmt.Sprintf("%d datapoint(s)", n), purgeOrphans)
+	}
+	return nil
+}
+
+/* Reads an archive through & looks for datapoints that do not belong to any
+metric; with purgeOrphans set, the archive is rewritten without them */
+func fsckArchive(fs_path string, codes map[string]bool, report *FsckReport, purgeOrphans bool) error {
+	label := filepath.Base(fs_path)
+	a, err := openArchive(fs_path)
+	if err != nil {
+		report.add(FSCK_CORRUPT_ARCHIVE, label, "", err.Error(), false)
+		return nil
+	}
+
+	it, err := a.newIterator()
+	if err != nil {
+		return fmt.Errorf("%s: %v", fs_path, err)
+	}
+	for it.Seek(nil); it.Valid(); it.Next() {
+	}
+	if it.err != nil {
+		it.Close()
+		report.add(FSCK_CORRUPT_ARCHIVE, label, "", it.err.Error(), false)
+		return nil
+	}
+	orphans := orphanedCodes(it, codes, report, label)
+	it.Close()
+	if len(orphans) == 0 {
+		return nil
+	}
+
+	counts := make([]uint64, len(orphans))
+	for i, code := range orphans {
+		if counts[i], err = a.count([][]byte{code}); err != nil {
+			return fmt.Errorf("%s: %v", fs_path, err)
+		}
+	}
+	if purgeOrphans {
+		b, err := a.without(orphans, nil)
+		if err == nil {
+			err = os.Rename(b.path, fs_path)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", fs_path, err)
+		}
+	}
+	for i, code := range orphans {
+		report.add(FSCK_ORPHANED_CODE, label, fmt.Sprintf("%x", code), fmt.Sprintf("%d datapoint(s)", counts[i]), purgeOrphans)
+	}
+	return nil
+}
+
+/* The short codes of the datapoints of a shard or an archive that do not
+belong to any metric; malformed keys are reported along the way. A single
+key of every short code is visited */
+func orphanedCodes(it dataIterator, codes map[string]bool, report *FsckReport, label string) [][]byte {
+	var retval [][]byte
+	for it.Seek(nil); it.Valid(); {
+		k := it.Key()
+		if string(k) == SCHEME_MAGIC_ID {
+			it.Next()
+			continue
+		}
+		if len(k) != 24 {
+			report.add(FSCK_MALFORMED_KEY, label, fmt.Sprintf("%x", k), "", false)
+			it.Next()
+			continue
+		}
+		code := append([]byte{}, k[:16]...)
+		if !codes[string(code)] {
+			retval = append(retval, code)
+		}
+		next := prefixEnd(code)
+		if next == nil {
+			break
+		}
+		it.Seek(next)
+	}
+	return retval
+}
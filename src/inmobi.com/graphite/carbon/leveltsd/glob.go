@@ -0,0 +1,75 @@
+package leveltsd
+
+import (
+	"path"
+	"strings"
+)
+
+/*
+Visits the metrics matching a graphite style glob in order of name. Every
+node of the glob is matched against a single node of the path; within a
+node, * ? & [...] are as with path.Match and {a,b} matches either of a or b.
+Stops early once visit returns false
+*/
+func (this *indices) globMetrics(pattern string, visit func(metric string) bool) error {
+	nodes := strings.Split(pattern, ".")
+	alternatives := make([][]string, len(nodes))
+	for i, node := range nodes {
+		alternatives[i] = expandBraces(node)
+		for _, alt := range alternatives[i] {
+			if _, err := path.Match(alt, ""); err != nil {
+				return err
+			}
+		}
+	}
+	this._glob("", alternatives, visit)
+	return nil
+}
+
+func (this *indices) _glob(parent string, alternatives [][]string, visit func(metric string) bool) bool {
+	for _, child := range this.listChildern(parent) {
+		matched := false
+		for _, alt := range alternatives[0] {
+			if ok, _ := path.Match(alt, child); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+
+		node := childPath(parent, child)
+		if len(alternatives) > 1 {
+			if !this._glob(node, alternatives[1:], visit) {
+				return false
+			}
+		} else if _, ok := this.getMetric(node, false); ok {
+			if !visit(node) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+/* a{b,c}d{e,f} is abde, abdf, acde & acdf; braces do not nest */
+func expandBraces(pattern string) []string {
+	open := strings.IndexByte(pattern, '{')
+	if open < 0 {
+		return []string{pattern}
+	}
+	end := strings.IndexByte(pattern[open:], '}')
+	if end < 0 {
+		return []string{pattern}
+	}
+	end += open
+
+	retval := make([]string, 0)
+	for _, alt := range strings.Split(pattern[open+1:end], ",") {
+		for _, rest := range expandBraces(pattern[end+1:]) {
+			retval = append(retval, pattern[:open]+alt+rest)
+		}
+	}
+	return retval
+}
@@ -0,0 +1,281 @@
+package leveltsd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/jmhodges/levigo"
+	"inmobi.com/graphite/carbon/logging"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+/*
+A key per metric per hour, with all the datapoints of that hour compressed
+into its value as described in "Gorilla: A Fast, Scalable, In-Memory Time
+Series Database" (VLDB 2015): timestamps as delta of deltas & values XORed
+with their predecessor. A metric recorded every minute takes up ~1.5 bytes
+per datapoint instead of ~32.
+
+The key is keyString(short code, start of the hour) so blocks sort by time
+within a metric, just as datapoints do in the python layout. The value is
+
+	uvarint(number of datapoints) bitstream
+
+Writes merge into the existing block, which is a read followed by a write;
+hence flushes of a shard are serialized
+*/
+const GORILLA_CODEC = "gorilla 1h v1"
+
+const _GORILLA_BLOCK_SECONDS = 3600
+
+var errCorruptBlock = errors.New("corrupt gorilla block")
+
+func init() {
+	registerCodec(GORILLA_CODEC, "gorilla", gorillaCodec{})
+}
+
+type gorillaCodec struct{}
+
+func blockStart(ts uint64) uint64 {
+	return ts / _GORILLA_BLOCK_SECONDS * _GORILLA_BLOCK_SECONDS
+}
+
+func (gorillaCodec) exclusive() bool {
+	return true
+}
+
+func (gorillaCodec) encode(s *shard, batch *levigo.WriteBatch, points []triplet) {
+	/* Group by block; a later datapoint for a timestamp wins */
+	blocks := make(map[string]map[uint64]float64)
+	for _, x := range points {
+		ts := rounder(x.val.Timestamp, x.key.step_in_seconds)
+		k := string(keyString(x.key.key, blockStart(ts)))
+		if blocks[k] == nil {
+			blocks[k] = make(map[uint64]float64)
+		}
+		blocks[k][ts] = x.val.Value
+	}
+
+	for k, fresh := range blocks {
+		val, err := s.db.Get(s.ro, []byte(k))
+		if err != nil {
+			s.logger.Limited("gorilla").Errorf("reading block %x failed: %v", k, err)
+			continue
+		}
+		existing, err := decodeBlock(val)
+		if err != nil {
+			s.logger.Limited("gorilla").Errorf("block %x: %v; overwriting it", k, err)
+		}
+		for _, x := range existing {
+			if _, ok := fresh[x.Timestamp]; !ok {
+				fresh[x.Timestamp] = x.Value
+			}
+		}
+
+		merged := make([]Datapoint, 0, len(fresh))
+		for ts, v := range fresh {
+			merged = append(merged, Datapoint{ts, v})
+		}
+		sort.Slice(merged, func(i, j int) bool { return merged[i].Timestamp < merged[j].Timestamp })
+		batch.Put([]byte(k), encodeBlock(merged))
+	}
+}
+
+func (gorillaCodec) scan(it dataIterator, logger *logging.Logger, shortCode []byte, start uint64, end uint64, visit func(Datapoint) bool) {
+	start_key := keyString(shortCode, blockStart(start))
+	end_key := keyString(shortCode, end)
+
+	for it.Seek(start_key); it.Valid(); it.Next() {
+		k := it.Key()
+		if bytes.Compare(k, end_key) > 0 {
+			break
+		}
+		points, err := decodeBlock(it.Value())
+		if err != nil {
+			logger.Limited("gorilla").Errorf("block %x: %v", k, err)
+		}
+		for _, x := range points {
+			if x.Timestamp < start || x.Timestamp > end {
+				continue
+			}
+			if !visit(x) {
+				return
+			}
+		}
+	}
+}
+
+/* Compresses datapoints sorted by time with no duplicate timestamps */
+func encodeBlock(points []Datapoint) []byte {
+	var w bitWriter
+	header := make([]byte, binary.MaxVarintLen64)
+	w.buf = append(w.buf, header[:binary.PutUvarint(header, uint64(len(points)))]...)
+	if len(points) == 0 {
+		return w.buf
+	}
+
+	w.write(points[0].Timestamp, 64)
+	w.write(math.Float64bits(points[0].Value), 64)
+
+	var delta int64
+	prevTs, prevVal := points[0].Timestamp, math.Float64bits(points[0].Value)
+	leading, trailing := uint(64), uint(0)
+
+	for _, x := range points[1:] {
+		d := int64(x.Timestamp - prevTs)
+		dod := d - delta
+		switch {
+		case dod == 0:
+			w.write(0, 1)
+		case -64 <= dod && dod <= 63:
+			w.write(0x2, 2)
+			w.write(uint64(dod), 7)
+		case -256 <= dod && dod <= 255:
+			w.write(0x6, 3)
+			w.write(uint64(dod), 9)
+		case -2048 <= dod && dod <= 2047:
+			w.write(0xe, 4)
+			w.write(uint64(dod), 12)
+		default:
+			w.write(0xf, 4)
+			w.write(uint64(dod), 64)
+		}
+		delta, prevTs = d, x.Timestamp
+
+		v := math.Float64bits(x.Value)
+		xor := v ^ prevVal
+		prevVal = v
+		if xor == 0 {
+			w.write(0, 1)
+			continue
+		}
+		l, t := uint(bits.LeadingZeros64(xor)), uint(bits.TrailingZeros64(xor))
+		if l > 31 {
+			l = 31 // what fits in 5 bits
+		}
+		if leading != 64 && l >= leading && t >= trailing {
+			/* Within the window of the previous value */
+			w.write(0x2, 2)
+			w.write(xor>>trailing, 64-leading-trailing)
+			continue
+		}
+		leading, trailing = l, t
+		w.write(0x3, 2)
+		w.write(uint64(leading), 5)
+		w.write(uint64(64-leading-trailing-1), 6) // a length of 64 is stored as 63
+		w.write(xor>>trailing, 64-leading-trailing)
+	}
+	return w.buf
+}
+
+/* The inverse of encodeBlock; an empty value makes for an empty block */
+func decodeBlock(b []byte) ([]Datapoint, error) {
+	if len(b) == 0 {
+		return nil, nil
+	}
+	n, used := binary.Uvarint(b)
+	if used <= 0 || n > uint64(len(b))*8 {
+		return nil, errCorruptBlock
+	}
+	r := bitReader{buf: b[used:]}
+	retval := make([]Datapoint, 0, n)
+	if n == 0 {
+		return retval, nil
+	}
+
+	ts := r.read(64)
+	val := r.read(64)
+	if r.err {
+		return retval, errCorruptBlock
+	}
+	retval = append(retval, Datapoint{ts, math.Float64frombits(val)})
+
+	var delta int64
+	leading, trailing := uint(0), uint(0)
+	for i := uint64(1); i < n; i++ {
+		var dod int64
+		switch {
+		case r.read(1) == 0:
+		case r.read(1) == 0:
+			dod = signExtend(r.read(7), 7)
+		case r.read(1) == 0:
+			dod = signExtend(r.read(9), 9)
+		case r.read(1) == 0:
+			dod = signExtend(r.read(12), 12)
+		default:
+			dod = int64(r.read(64))
+		}
+		delta += dod
+		ts += uint64(delta)
+
+		if r.read(1) == 1 {
+			if r.read(1) == 1 {
+				leading = uint(r.read(5))
+				trailing = 64 - leading - uint(r.read(6)) - 1
+			}
+			val ^= r.read(64-leading-trailing) << trailing
+		}
+		if r.err {
+			return retval, errCorruptBlock
+		}
+		retval = append(retval, Datapoint{ts, math.Float64frombits(val)})
+	}
+	return retval, nil
+}
+
+func signExtend(x uint64, n uint) int64 {
+	shift := 64 - n
+	return int64(x<<shift) >> shift
+}
+
+type bitWriter struct {
+	buf  []byte
+	free uint // unused bits in the last byte
+}
+
+/* Appends the lowest n bits of x, most significant first */
+func (this *bitWriter) write(x uint64, n uint) {
+	for n > 0 {
+		if this.free == 0 {
+			this.buf = append(this.buf, 0)
+			this.free = 8
+		}
+		k := n
+		if k > this.free {
+			k = this.free
+		}
+		chunk := byte(x>>(n-k)) & byte(1<<k-1)
+		this.buf[len(this.buf)-1] |= chunk << (this.free - k)
+		this.free -= k
+		n -= k
+	}
+}
+
+type bitReader struct {
+	buf []byte
+	pos uint // in bits
+	err bool // set on reading past the end
+}
+
+func (this *bitReader) read(n uint) uint64 {
+	var retval uint64
+	for n > 0 {
+		i := this.pos / 8
+		if i >= uint(len(this.buf)) {
+			this.err = true
+			return 0
+		}
+		avail := 8 - this.pos%8
+		k := n
+		if k > avail {
+			k = avail
+		}
+		chunk := uint64(this.buf[i]>>(avail-k)) & (1<<k - 1)
+		retval = retval<<k | chunk
+		this.pos += k
+		n -= k
+	}
+	return retval
+}
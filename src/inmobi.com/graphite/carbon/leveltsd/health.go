@@ -0,0 +1,59 @@
+package leveltsd
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const _WRITE_FAILURE_WINDOW_SECONDS = 300
+const _MIN_FREE_DISK_PERCENT = 5
+
+var errIndexClosed = errors.New("index is not open")
+
+/* unix nanoseconds of the most recent failed leveldb write across shards */
+var lastWriteFailure int64
+
+func recordWriteFailure() {
+	atomic.StoreInt64(&lastWriteFailure, time.Now().UnixNano())
+}
+
+func (this *levelfederator) checkIndex() error {
+	this.writeLock.RLock()
+	defer this.writeLock.RUnlock()
+
+	if this.idx == nil {
+		return errIndexClosed
+	}
+	return nil
+}
+
+/* Fails for a while after any shard fails to write a batch */
+func (this *levelfederator) checkWrites() error {
+	last := atomic.LoadInt64(&lastWriteFailure)
+	if last == 0 {
+		return nil
+	}
+	if since := time.Since(time.Unix(0, last)); since < this.config.Write_failure_window {
+		return fmt.Errorf("leveldb write failed %v ago", since)
+	}
+	return nil
+}
+
+/* Fails when the file system holding the root is nearly full */
+func (this *levelfederator) checkDisk() error {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(this.config.Basedir, &fs); err != nil {
+		return err
+	}
+	if fs.Blocks == 0 {
+		return nil
+	}
+	free := float64(fs.Bavail) * 100 / float64(fs.Blocks)
+	if free < float64(this.config.Min_free_disk_percent) {
+		return fmt.Errorf("%.1f%% free on %s", free, this.config.Basedir)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package leveltsd
+
+import (
+	"fmt"
+	"sort"
+)
+
+/*
+Bulk loading of datapoints by the offline tools, e.g. when migrating history
+from another store. Datapoints are buffered by shard and, at checkpoints,
+sorted & written straight to the shards in large batches a shard at a time,
+so loading years of history opens every shard but once per checkpoint. The federator's eviction is held off;
+the importer closes the least recently used shards itself instead, while no
+datapoints are in flight.
+
+Not safe for concurrent use
+*/
+type Importer struct {
+	federator *levelfederator
+	buffers   map[string][]triplet // by shard id
+	buffered  int
+	opened    []string // shards opened; least recently used first
+	Stats     ImportStats
+}
+
+type ImportStats struct {
+	Metrics    uint64 // metrics added to, be they created or not
+	Datapoints uint64 // written to the shards
+	Dropped    uint64 // meant for archived shards
+}
+
+/* Opens the root of a storage engine config; the daemon must not be
+running on it */
+func OpenImporter(config map[string]string) (*Importer, error) {
+	f, err := openFederator(parseConfig(config))
+	if err != nil {
+		return nil, err
+	}
+	f.pinned = true
+	return &Importer{federator: f, buffers: make(map[string][]triplet)}, nil
+}
+
+/* Creates a metric, if need be, and buffers datapoints for it */
+func (this *Importer) Add(metric string, points []Datapoint) error {
+	key, ok := this.federator.idx.getMetric(metric, true)
+	if !ok {
+		return fmt.Errorf("%s: cannot be created", metric)
+	}
+	for _, x := range points {
+		id := this.federator.partition.shardFor(x.Timestamp)
+		this.buffers[id] = append(this.buffers[id], triplet{key, x})
+	}
+	this.buffered += len(points)
+	this.Stats.Metrics++
+	return nil
+}
+
+/* Number of datapoints added since the last checkpoint */
+func (this *Importer) Buffered() int {
+	return this.buffered
+}
+
+/* Writes out every datapoint added thus far; once it returns they are on
+disk */
+func (this *Importer) Checkpoint() error {
+	ids := make([]string, 0, len(this.buffers))
+	for id := range this.buffers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		points := this.buffers[id]
+		s := this._open(id)
+		if s == nil {
+			if !this.federator._isCold(id) {
+				return fmt.Errorf("shard %s cannot be opened", id)
+			}
+			this.Stats.Dropped += uint64(len(points))
+		} else {
+			sortTriplets(points)
+			for i := 0; i < len(points); i += _BACKFILL_CHUNK {
+				end := i + _BACKFILL_CHUNK
+				if end > len(points) {
+					end = len(points)
+				}
+				if err := s.bulkWrite(points[i:end]); err != nil {
+					return fmt.Errorf("shard %s: %v", id, err)
+				}
+			}
+			this.Stats.Datapoints += uint64(len(points))
+		}
+		delete(this.buffers, id)
+		this.buffered -= len(points)
+	}
+	return nil
+}
+
+/* Checkpoints & closes the root */
+func (this *Importer) Close() error {
+	err := this.Checkpoint()
+	this.federator.release()
+	return err
+}
+
+func (this *Importer) _open(id string) *shard {
+	s := this.federator._getShardFromDate(id, true)
+	if s == nil {
+		return nil
+	}
+
+	for i, x := range this.opened {
+		if x == id {
+			this.opened = append(this.opened[:i], this.opened[i+1:]...)
+			break
+		}
+	}
+	this.opened = append(this.opened, id)
+	if len(this.opened) > _MAX_OPEN_SHARDS {
+		lru := this.opened[0]
+		this.opened = this.opened[1:]
+
+		f := this.federator
+		f.writeLock.Lock()
+		if s, ok := f.shards[lru]; ok {
+			delete(f.shards, lru)
+			s.flush()
+			s.release()
+		}
+		f.writeLock.Unlock()
+	}
+	return s
+}
@@ -2,26 +2,25 @@ package leveltsd
 
 import (
 	"bytes"
-	"encoding/json"
 	"github.com/jmhodges/levigo"
 	"inmobi.com/graphite/carbon/logging"
-	"log"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 const INDEX_CACHE_SIZE = 128 << 20 // 128 MB
 const _DEFAULT_METRIC_INTERVAL = 60
 
-var iLogger *log.Logger
+var iLogger *logging.Logger
 
 var _BANNED_BYTES []byte
 
-var _EMPTY_JSON_ARRAY_BYTES = []byte("")
-
 func init() {
-	iLogger = logging.MakeLogger("leveltsd-index: ")
-	_BANNED_BYTES = []byte{byte('?'), byte('*'), byte('['), byte(']'), byte('/')}
+	iLogger = logging.MakeLogger("leveltsd-index")
+	/* The control characters are reserved for the key layout of the
+	directory db; see dirindex.go */
+	_BANNED_BYTES = []byte{byte('?'), byte('*'), byte('['), byte(']'), byte('/'), 0, 1}
 }
 
 type indices struct {
@@ -31,6 +30,9 @@ type indices struct {
 	wo        *levigo.WriteOptions
 	ro        *levigo.ReadOptions
 	cache     *levigo.Cache
+	migrated  int32 // set once the directory db has no legacy entries left
+	closed    bool
+	naming    namingEvents
 }
 
 type metricIndex struct {
@@ -46,17 +48,11 @@ slice
 func (this *indices) listChildern(path string) []string {
 	spath := scrubMetric(path)
 
-	var val []byte
-	if val = this._lsPath(spath); val == nil {
-		return []string{}
-	}
-	var retval []string
-
-	if err := json.Unmarshal(val, &retval); err != nil {
-		return []string{}
-	} else {
-		return retval
+	retval := this._lsEdges(spath)
+	if atomic.LoadInt32(&this.migrated) == 0 {
+		retval = mergeChildren(retval, this._lsLegacy(spath))
 	}
+	return retval
 }
 
 /*
@@ -81,15 +77,18 @@ func (this *indices) getMetric(metric string, createIfAbsent bool) (*metricIndex
 
 	val, err := this.pkey.Get(this.ro, spath)
 	if err != nil {
-		iLogger.Println(err)
+		iLogger.Errorf("%v", err)
 		return nil, false
 	}
 	if val != nil {
+		if len(spath) != len(metric) {
+			this._checkScrubAlias(metric, spath)
+		}
 		retval := metricIndex{metric, val, _DEFAULT_METRIC_INTERVAL}
 		return &retval, true
 	}
 	if createIfAbsent {
-		return this.unsafeCreateMetric(spath)
+		return this.unsafeCreateMetric(metric, spath)
 	}
 	return nil, false
 }
@@ -99,7 +98,7 @@ Create a new metrix. This is an unsafe function
 
 It neither checks if the metric already exists nor is threadsafe
 */
-func (this *indices) unsafeCreateMetric(smetric []byte) (*metricIndex, bool) {
+func (this *indices) unsafeCreateMetric(raw string, smetric []byte) (*metricIndex, bool) {
 	metric := string(smetric)
 
 	retval := true
@@ -107,7 +106,7 @@ func (this *indices) unsafeCreateMetric(smetric []byte) (*metricIndex, bool) {
 
 	parts := strings.Split(metric, ".")
 	if retval = this._registerPath(parts); retval {
-		idx, retval = this._recordId(metric, smetric)
+		idx, retval = this._recordId(raw, smetric)
 	} else {
 		return nil, false
 	}
@@ -116,115 +115,35 @@ func (this *indices) unsafeCreateMetric(smetric []byte) (*metricIndex, bool) {
 }
 
 /*
-Records a given metric's shortcode as part of the creation process
+Records a given metric's shortcode, along with the reverse mapping & the raw
+name it was created with, as part of the creation process
 
 This is an unsafe method; to be called only inside the call stack of
 a safe method
 */
 func (this *indices) _recordId(metric string, bmetric []byte) (*metricIndex, bool) {
-	shortCode := shortenMetricName(bmetric)
+	shortCode := this._freeCode(bmetric)
 	retval := metricIndex{metric, shortCode, _DEFAULT_METRIC_INTERVAL}
-	err := this.pkey.Put(this.wo, bmetric, shortCode)
-	if err != nil {
-		iLogger.Println(err)
-	}
-	return &retval, err == nil
-}
-
-/*
-Makes the directory entries for a new metric.
 
-This is an unsafe method; to be called only inside the call stack of
-a safe method
-*/
-func (this *indices) _registerPath(parts []string) bool {
-	n := len(parts)
-	if n == 0 {
-		return true
+	batch := levigo.NewWriteBatch()
+	defer batch.Close()
+	batch.Put(bmetric, shortCode)
+	batch.Put(codeKey(shortCode), bmetric)
+	if metric != string(bmetric) {
+		batch.Put(originKey(string(bmetric)), []byte(metric))
 	}
-
-	parent_chunk := parts[:n-1]
-	parent := strings.Join(parent_chunk, ".")
-
-	if siblings := this._lsPath([]byte(parent)); siblings == nil {
-		if ok := this._registerPath(parent_chunk); !ok {
-			return false
-		} else {
-			return this._addChild(parent, parts[n-1], siblings)
-		}
-	} else {
-		return this._addChild(parent, parts[n-1], siblings)
-	}
-}
-
-/*
-Internal method for fetching uninterpreted bytes stored with a
-directory node
-*/
-func (this *indices) _lsPath(spath []byte) []byte {
-	val, err := this.dir.Get(this.ro, spath)
+	err := this.pkey.Write(this.wo, batch)
 	if err != nil {
-		iLogger.Println(err)
-		return nil
-	}
-	return val
-}
-
-/*
-Attaches a child node to a given directory path
-
-This is an unsafe method; to be called only inside the call stack of
-a safe method
-*/
-func (this *indices) _addChild(parent string, child string, siblings_as_bytes []byte) bool {
-	var siblings []string
-	if len(siblings_as_bytes) == 0 {
-		siblings = []string{}
-	} else {
-		if err := json.Unmarshal(siblings_as_bytes, &siblings); err != nil {
-			iLogger.Println(err, siblings_as_bytes, len(siblings_as_bytes))
-			return false
-		}
-	}
-
-	for _, c := range siblings {
-		if c == child {
-			return true
-		}
-	}
-	siblings = append(siblings, child)
-	return this._replaceChildren(parent, siblings)
-}
-
-/* Ultra low level function; super unsafe, used to do an inplace update of
-data associated with a directory node */
-func (this *indices) _replaceChildren(parent string, children []string) bool {
-	var val []byte
-	if children == nil || len(children) == 0 {
-		val = _EMPTY_JSON_ARRAY_BYTES
-	} else {
-		val, _ = json.Marshal(children)
-	}
-	iLogger.Printf("child-setter #%s#  ----> %s aka %s\n", parent, children, val)
-	err := this.dir.Put(this.wo, []byte(parent), val)
-	if err != nil {
-		iLogger.Println(err)
-	}
-	return err == nil
-}
-
-/* Create a directory entry for the root path */
-func (this *indices) _mkRoot() {
-	var empty []string
-	if curr, _ := this.dir.Get(this.ro, nil); curr == nil {
-		ok := this._replaceChildren("", empty)
-		if !ok {
-			iLogger.Panicln("Cannot initialize dir db")
-		}
+		iLogger.Errorf("%v", err)
 	}
+	return &retval, err == nil
 }
 
 func (this *indices) release() {
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+
+	this.closed = true
 	this.dir.Close()
 	this.pkey.Close()
 	this.ro.Close()
@@ -277,6 +196,12 @@ func getParent(path string) string {
 
 /* The "mkfs" for a given directory db */
 func mkIndex(root string) (*indices, error) {
+	return openIndex(root, true)
+}
+
+/* Opens the indices; the migration of a legacy directory db & the backfill
+of the reverse map are only started in the background when asked to */
+func openIndex(root string, background bool) (*indices, error) {
 	retval := new(indices)
 
 	retval.writeLock = new(sync.Mutex)
@@ -309,9 +234,12 @@ func mkIndex(root string) (*indices, error) {
 	retval.wo = levigo.NewWriteOptions()
 	retval.ro = levigo.NewReadOptions()
 
-	retval._mkRoot()
-
 	retval.cache = cache
 
+	if background {
+		retval._initLayout()
+		retval._initCodes()
+	}
+
 	return retval, err
 }
@@ -0,0 +1,212 @@
+package leveltsd
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/jmhodges/levigo"
+	"inmobi.com/graphite/carbon/audit"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const _STATS_INTERVAL_SECONDS = 60
+
+/* Key range spanning everything in a db; used for size approximation */
+var _FULL_RANGE = levigo.Range{[]byte{}, []byte(strings.Repeat("\xff", 32))}
+
+/* Per level numbers as reported by leveldb */
+type levelStats struct {
+	Level              int
+	Files              int
+	Bytes              uint64
+	Compaction_seconds float64
+	Read_mb            float64
+	Write_mb           float64
+}
+
+/* A point in time view of the internals of one leveldb instance */
+type dbStats struct {
+	Levels            []levelStats
+	Approximate_bytes uint64
+
+	/* Block cache plus memtable usage. The C API does not expose the cache
+	by itself, hence this is the closest available approximation. Older
+	leveldb releases do not support the property and report 0 */
+	Memory_usage_bytes uint64
+}
+
+/* Reads the stats related properties of an open db. Only to be invoked
+while the db is guaranteed to be open */
+func inspectDb(db *levigo.DB) dbStats {
+	var retval dbStats
+
+	retval.Levels = parseLevelStats(db.PropertyValue("leveldb.stats"), db.PropertyValue("leveldb.sstables"))
+	retval.Approximate_bytes = db.GetApproximateSizes([]levigo.Range{_FULL_RANGE})[0]
+	retval.Memory_usage_bytes, _ = strconv.ParseUint(db.PropertyValue("leveldb.approximate-memory-usage"), 10, 64)
+
+	return retval
+}
+
+/* Combines the two textual reports leveldb produces. "leveldb.sstables"
+lists every table file along with its size; "leveldb.stats" carries the
+compaction history, but only for levels that have seen any activity */
+func parseLevelStats(stats string, sstables string) []levelStats {
+	levels := make(map[int]*levelStats)
+	get := func(n int) *levelStats {
+		if x, ok := levels[n]; ok {
+			return x
+		}
+		x := &levelStats{Level: n}
+		levels[n] = x
+		return x
+	}
+
+	/* Lines look like
+	--- level 1 ---
+	 5:1234['a' @ 1 : 1 .. 'b' @ 2 : 1]
+	*/
+	current := -1
+	scanner := bufio.NewScanner(strings.NewReader(sstables))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		var n int
+		if _, err := fmt.Sscanf(line, "--- level %d ---", &n); err == nil {
+			current = n
+			get(n)
+			continue
+		}
+		if current < 0 {
+			continue
+		}
+		var number, size uint64
+		if _, err := fmt.Sscanf(line, "%d:%d[", &number, &size); err == nil {
+			x := get(current)
+			x.Files++
+			x.Bytes += size
+		}
+	}
+
+	/* Lines look like
+	Level  Files Size(MB) Time(sec) Read(MB) Write(MB)
+	--------------------------------------------------
+	  1        5        8         1       12        10
+	*/
+	scanner = bufio.NewScanner(strings.NewReader(stats))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 6 {
+			continue
+		}
+		n, err := strconv.Atoi(fields[0])
+		if err != nil {
+			continue
+		}
+		var parsed [5]float64
+		for i := range parsed {
+			if parsed[i], err = strconv.ParseFloat(fields[i+1], 64); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			continue
+		}
+		x := get(n)
+		if x.Files == 0 {
+			x.Files = int(parsed[0])
+		}
+		x.Compaction_seconds, x.Read_mb, x.Write_mb = parsed[2], parsed[3], parsed[4]
+	}
+
+	retval := make([]levelStats, 0, len(levels))
+	for _, x := range levels {
+		retval = append(retval, *x)
+	}
+	sort.Sort(byLevel(retval))
+	return retval
+}
+
+type byLevel []levelStats
+
+func (x byLevel) Len() int           { return len(x) }
+func (x byLevel) Less(i, j int) bool { return x[i].Level < x[j].Level }
+func (x byLevel) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+
+/* Walks the indices and every open shard. The federator lock is only held
+for reading, while the indices are walked & the open shards listed; each
+shard is walked under its own busy lock so that it is not released from
+under us, & skipped if it was released in the meantime */
+func (this *levelfederator) collectStats() map[string]dbStats {
+	retval := make(map[string]dbStats)
+
+	this.writeLock.RLock()
+	if this.idx == nil {
+		this.writeLock.RUnlock()
+		return retval
+	}
+	retval["index.dir"] = inspectDb(this.idx.dir)
+	retval["index.map"] = inspectDb(this.idx.pkey)
+	shards := make(map[string]*shard, len(this.shards))
+	for id, s := range this.shards {
+		shards[id] = s
+	}
+	this.writeLock.RUnlock()
+
+	for id, s := range shards {
+		s.busy.RLock()
+		if !s.released {
+			retval["shard."+id] = inspectDb(s.db)
+		}
+		s.busy.RUnlock()
+	}
+	return retval
+}
+
+/* Periodically refreshes the stats snapshot till the federator is released */
+func (this *levelfederator) statsLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		stats := this.collectStats()
+		this.statsLock.Lock()
+		this.stats = stats
+		this.statsLock.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-this.done:
+			return
+		}
+	}
+}
+
+/* The most recent stats snapshot */
+func (this *levelfederator) lastStats() map[string]dbStats {
+	this.statsLock.Lock()
+	defer this.statsLock.Unlock()
+	return this.stats
+}
+
+/* Publishes the last snapshot via audit. Collection itself happens in
+statsLoop so that the audit reporter is never held up by leveldb */
+func (this *levelfederator) auditStats(emit audit.Emitter) {
+	for name, db := range this.lastStats() {
+		for _, l := range db.Levels {
+			prefix := fmt.Sprintf("%s.level%d.", name, l.Level)
+			emit(prefix+"files", float64(l.Files))
+			emit(prefix+"bytes", float64(l.Bytes))
+			emit(prefix+"compaction_seconds", l.Compaction_seconds)
+			emit(prefix+"read_mb", l.Read_mb)
+			emit(prefix+"write_mb", l.Write_mb)
+		}
+		emit(name+".approximate_bytes", float64(db.Approximate_bytes))
+		emit(name+".memory_usage_bytes", float64(db.Memory_usage_bytes))
+	}
+}
+
+func (this *levelfederator) serveStats(r *http.Request) (interface{}, error) {
+	return this.lastStats(), nil
+}
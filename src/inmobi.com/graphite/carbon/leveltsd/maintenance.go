@@ -0,0 +1,84 @@
+package leveltsd
+
+import (
+	"net/http"
+	"time"
+)
+
+/* Operations that alter the data held; served over JSON-RPC on the admin
+listener rather than the reader port */
+type MaintenanceService struct {
+	federator *levelfederator
+}
+
+type DeleteRequest struct {
+	Path      string
+	Subtree   bool // delete everything under Path as well
+	PurgeData bool // delete the datapoints from the shards too
+	DryRun    bool // only report what would be deleted
+}
+
+type DeleteReport struct {
+	DryRun     bool
+	Metrics    []string
+	Aliases    []string
+	Nodes      []string
+	Shards     []string
+	Datapoints uint64
+}
+
+func (this *MaintenanceService) DeleteMetric(r *http.Request, req *DeleteRequest, report *DeleteReport) error {
+	retval, err := this.federator.deleteMetric(req)
+	if retval != nil {
+		*report = *retval
+	}
+	return err
+}
+
+type RenameRequest struct {
+	From         string
+	To           string
+	Subtree      bool   // move everything under From as well
+	AliasSeconds uint64 // keep the old names resolving for these many seconds
+	DryRun       bool   // only report what would be renamed
+}
+
+type RenameReport struct {
+	DryRun  bool
+	Renamed map[string]string // old name -> new name
+	Aliases map[string]string // alias -> new name
+	Nodes   []string          // directory nodes removed
+}
+
+func (this *MaintenanceService) RenameMetric(r *http.Request, req *RenameRequest, report *RenameReport) error {
+	retval, err := this.federator.renameMetric(req)
+	if retval != nil {
+		*report = *retval
+	}
+	return err
+}
+
+func (this *levelfederator) renameMetric(req *RenameRequest) (*RenameReport, error) {
+	alias := time.Duration(req.AliasSeconds) * time.Second
+	renaming, err := this.idx.renameMetrics(req.From, req.To, req.Subtree, alias, req.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	nodes := renaming.nodes
+	if nodes == nil {
+		nodes = []string{}
+	}
+	return &RenameReport{req.DryRun, renaming.moved, renaming.aliases, nodes}, nil
+}
+
+type SnapshotRequest struct {
+	Dest string // absolute path of a directory to be created
+}
+
+func (this *MaintenanceService) Snapshot(r *http.Request, req *SnapshotRequest, manifest *SnapshotManifest) error {
+	retval, err := this.federator.snapshot(req.Dest)
+	if retval != nil {
+		*manifest = *retval
+	}
+	return err
+}
@@ -0,0 +1,167 @@
+package leveltsd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+type MultiRangeQuery struct {
+	Nodes []string // metrics or globs
+	Start uint64
+	End   uint64
+
+	/* As with RangeQuery; applied to each series */
+	MaxDataPoints uint64
+	BucketSeconds uint64
+	Consolidate   string
+}
+
+type SeriesData struct {
+	Node   string // the metric; the node asked for if it resolves to none
+	Data   []Datapoint
+	Bucket uint64 // seconds a datapoint spans if consolidated; 0 otherwise
+	Error  string // why Data is missing, if it is
+}
+
+type MultiRangeResult struct {
+	Series []SeriesData
+}
+
+/*
+Reads the datapoints of many series over a single time range. Globs are
+expanded & every series is returned in the order asked for, each with an
+error of its own; a series of more than max-points-per-query datapoints
+fails while the rest succeed
+*/
+func (this *ReaderService) GetMultiRangeData(r *http.Request, query *MultiRangeQuery, response *MultiRangeResult) error {
+	f := this.federator
+	if query.Start > query.End {
+		return fmt.Errorf("Start %d is past End %d", query.Start, query.End)
+	}
+
+	response.Series = make([]SeriesData, 0, len(query.Nodes))
+	keys := make([]*metricIndex, 0, len(query.Nodes))
+	slots := make([]int, 0, len(query.Nodes)) // of the series of keys[i]
+	for _, node := range query.Nodes {
+		matched, err := f.resolveNode(node)
+		if err == nil && len(matched) == 0 {
+			err = fmt.Errorf("key not found: %s", node)
+		}
+		if err != nil {
+			response.Series = append(response.Series, SeriesData{Node: node, Error: err.Error()})
+			continue
+		}
+		for _, key := range matched {
+			slots = append(slots, len(response.Series))
+			keys = append(keys, key)
+			response.Series = append(response.Series, SeriesData{Node: key.metric})
+		}
+	}
+
+	ctx, cancel := f.queryContext(r)
+	defer cancel()
+	scanned, err := f.multiScan(ctx, keys, query.Start, query.End)
+	if err != nil {
+		return queryError(fmt.Sprintf("%d series", len(keys)), err)
+	}
+	for i, parts := range scanned {
+		series := &response.Series[slots[i]]
+		c, err := newConsolidator(keys[i], query.Start, query.End, query.MaxDataPoints, query.BucketSeconds, query.Consolidate)
+		if err != nil {
+			return err
+		}
+
+		data := make([]Datapoint, 0)
+		for _, points := range parts {
+			if c != nil {
+				points = c.feed(points)
+			}
+			data = append(data, points...)
+		}
+		if c != nil {
+			data = append(data, c.done()...)
+			series.Bucket = c.bucket
+		}
+		if max := f.config.Max_points_per_query; max > 0 && uint64(len(data)) > max {
+			series.Error = fmt.Sprintf("%s has more than %d datapoints in range; read it with GetRangeData a page at a time", series.Node, max)
+			continue
+		}
+		series.Data = data
+	}
+	return nil
+}
+
+/* The metric of a node, or those matching it if it is a glob */
+func (this *levelfederator) resolveNode(node string) ([]*metricIndex, error) {
+	if !strings.ContainsAny(node, "*?[{") {
+		if key, ok := this.getMetric(node); ok {
+			return []*metricIndex{key}, nil
+		}
+		return nil, nil
+	}
+	retval := make([]*metricIndex, 0)
+	err := this.idx.globMetrics(node, func(metric string) bool {
+		if key, ok := this.getMetric(metric); ok {
+			retval = append(retval, key)
+		}
+		return true
+	})
+	return retval, err
+}
+
+/*
+Scans many metrics over a time range, a shard at a time, each with a single
+iterator that visits the metrics in order of short code; the shards are
+scanned concurrently, see scanInOrder. The result holds, at i, the datapoints
+of keys[i] per shard in order of time. Fails once ctx is done
+*/
+func (this *levelfederator) multiScan(ctx context.Context, keys []*metricIndex, start uint64, end uint64) ([][][]Datapoint, error) {
+	retval := make([][][]Datapoint, len(keys))
+	if len(keys) == 0 {
+		return retval, nil
+	}
+	if len(this.schemes) > 1 {
+		for i, key := range keys {
+			points, err := this.dataScanContext(ctx, key, start, end)
+			if err != nil {
+				return nil, err
+			}
+			retval[i] = [][]Datapoint{points}
+		}
+		return retval, nil
+	}
+
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return bytes.Compare(keys[order[i]].key, keys[order[j]].key) < 0 })
+	sorted := make([]*metricIndex, len(keys))
+	for i, k := range order {
+		sorted[i] = keys[k]
+	}
+
+	ids := this.partition.rangeShards(start, end)
+	parts := make([][][]Datapoint, len(ids)) // by shard, then as sorted
+	err := this.scanInOrder(ctx, len(ids), func(i int) {
+		parts[i] = this.shardMultiScan(ids[i], sorted, start, end)
+	}, func(i int) bool {
+		if parts[i] == nil {
+			return true // no such shard
+		}
+		for j, k := range order {
+			if len(parts[i][j]) > 0 {
+				retval[k] = append(retval[k], parts[i][j])
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return retval, nil
+}
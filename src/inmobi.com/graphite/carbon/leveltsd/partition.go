@@ -0,0 +1,177 @@
+package leveltsd
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+)
+
+/*
+Partitioning of datapoints into shards by time (UTC). A shard is named after
+the partition it holds, tsd-data-<id>.db, where the format of the id gives
+away the granularity:
+
+	hour   YYYYMMDDHH
+	day    YYYYMMDD (that of the python implementation)
+	week   YYYYwWW (ISO 8601 week)
+	month  YYYYMM
+
+New datapoints go to partitions of the configured granularity. Reads consult
+every granularity present on disk, so that a change of granularity leaves the
+data written thus far readable
+*/
+type partitionScheme struct {
+	name  string
+	match *regexp.Regexp
+	id    func(t time.Time) string
+	floor func(t time.Time) time.Time // start of the partition holding t
+	next  func(t time.Time) time.Time // start of the partition after the one starting at t
+	parse func(id string) (time.Time, error) // start of the partition of an id
+}
+
+const _DEFAULT_PARTITION = "day"
+
+var partitionSchemes = []*partitionScheme{
+	{
+		"hour",
+		regexp.MustCompile(`^[0-9]{10}$`),
+		func(t time.Time) string { return t.Format("2006010215") },
+		func(t time.Time) time.Time { return t.Truncate(time.Hour) },
+		func(t time.Time) time.Time { return t.Add(time.Hour) },
+		func(id string) (time.Time, error) { return time.Parse("2006010215", id) },
+	},
+	{
+		"day",
+		regexp.MustCompile(`^[0-9]{8}$`),
+		func(t time.Time) string { return t.Format("20060102") },
+		func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC) },
+		func(t time.Time) time.Time { return t.AddDate(0, 0, 1) },
+		func(id string) (time.Time, error) { return time.Parse("20060102", id) },
+	},
+	{
+		"week",
+		regexp.MustCompile(`^[0-9]{4}w[0-9]{2}$`),
+		func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%04dw%02d", year, week)
+		},
+		func(t time.Time) time.Time {
+			monday := int(t.Weekday()+6) % 7
+			return time.Date(t.Year(), t.Month(), t.Day()-monday, 0, 0, 0, 0, time.UTC)
+		},
+		func(t time.Time) time.Time { return t.AddDate(0, 0, 7) },
+		func(id string) (time.Time, error) {
+			var year, week int
+			if _, err := fmt.Sscanf(id, "%4dw%2d", &year, &week); err != nil {
+				return time.Time{}, err
+			}
+			/* The 4th of January is always in the first week */
+			jan4 := time.Date(year, time.January, 4, 0, 0, 0, 0, time.UTC)
+			return jan4.AddDate(0, 0, 7*(week-1)-int(jan4.Weekday()+6)%7), nil
+		},
+	},
+	{
+		"month",
+		regexp.MustCompile(`^[0-9]{6}$`),
+		func(t time.Time) string { return t.Format("200601") },
+		func(t time.Time) time.Time { return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC) },
+		func(t time.Time) time.Time { return t.AddDate(0, 1, 0) },
+		func(id string) (time.Time, error) { return time.Parse("200601", id) },
+	},
+}
+
+func getPartitionScheme(name string) (*partitionScheme, bool) {
+	for _, p := range partitionSchemes {
+		if p.name == name {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+/* The scheme a shard id belongs to, if any */
+func classifyShard(id string) (*partitionScheme, bool) {
+	for _, p := range partitionSchemes {
+		if p.match.MatchString(id) {
+			return p, true
+		}
+	}
+	return nil, false
+}
+
+/* Id of the shard that would hold a given timestamp */
+func (this *partitionScheme) shardFor(ts uint64) string {
+	return this.id(time.Unix(int64(ts), 0).UTC())
+}
+
+/* Ids of the shards that would hold a given time range */
+func (this *partitionScheme) rangeShards(start uint64, end uint64) []string {
+	if start > end {
+		fLogger.Panicf("Start is greater than end: %d %d\n", start, end)
+	}
+
+	last := time.Unix(int64(end), 0).UTC()
+	retval := make([]string, 0)
+	for t := this.floor(time.Unix(int64(start), 0).UTC()); !t.After(last); t = this.next(t) {
+		retval = append(retval, this.id(t))
+	}
+	return retval
+}
+
+/* End of the partition of a shard id, exclusive */
+func partitionEnd(id string) (time.Time, error) {
+	p, ok := classifyShard(id)
+	if !ok {
+		return time.Time{}, fmt.Errorf("%s is not a shard id", id)
+	}
+	t, err := p.parse(id)
+	if err != nil {
+		return t, err
+	}
+	return p.next(t), nil
+}
+
+/* The schemes to read from: the one configured followed by any others with
+shards on disk */
+func readSchemes(configured *partitionScheme, shardIds []string) []*partitionScheme {
+	present := make(map[*partitionScheme]bool)
+	for _, id := range shardIds {
+		if p, ok := classifyShard(id); ok {
+			present[p] = true
+		}
+	}
+
+	retval := []*partitionScheme{configured}
+	for _, p := range partitionSchemes {
+		if p != configured && present[p] {
+			retval = append(retval, p)
+		}
+	}
+	return retval
+}
+
+/* Merges datapoints read from shards of several schemes. The datapoints of
+each scheme are in order of time; where they overlap, those of the scheme
+listed first win as that would have been written last */
+func mergeSchemes(parts [][]Datapoint) []Datapoint {
+	n := 0
+	for _, part := range parts {
+		n += len(part)
+	}
+	retval := make([]Datapoint, 0, n)
+	for i := len(parts) - 1; i >= 0; i-- {
+		retval = append(retval, parts[i]...)
+	}
+	sort.SliceStable(retval, func(i, j int) bool { return retval[i].Timestamp < retval[j].Timestamp })
+
+	/* Keep the last of each run of equal timestamps */
+	out := retval[:0]
+	for i, x := range retval {
+		if i+1 < len(retval) && retval[i+1].Timestamp == x.Timestamp {
+			continue
+		}
+		out = append(out, x)
+	}
+	return out
+}
@@ -0,0 +1,314 @@
+package leveltsd
+
+import (
+	"bytes"
+	"errors"
+	"github.com/jmhodges/levigo"
+	"path/filepath"
+	"sort"
+)
+
+var errMigrationPending = errors.New("directory index migration is in progress")
+var errMetricNotFound = errors.New("no such metric or directory")
+var errRootDelete = errors.New("refusing to delete the root")
+
+/* What gets (or would get) removed from the indices */
+type indexDeletion struct {
+	metrics []metricIndex
+	aliases []string
+	nodes   []string // directory nodes that cease to exist
+}
+
+/* Path of a child node */
+func childPath(parent string, child string) string {
+	if parent == "" {
+		return child
+	}
+	return parent + "." + child
+}
+
+/* Name of a node relative to its parent */
+func leafName(path string) string {
+	if parent := getParent(path); parent != "" {
+		return path[len(parent)+1:]
+	}
+	return path
+}
+
+/* Depth first listing of all the nodes under a given one */
+func (this *indices) _descendants(spath string) []string {
+	var retval []string
+	for _, c := range this._lsEdges([]byte(spath)) {
+		node := childPath(spath, c)
+		retval = append(retval, node)
+		retval = append(retval, this._descendants(node)...)
+	}
+	return retval
+}
+
+func (this *indices) _shortCode(spath string) ([]byte, bool) {
+	val, err := this.pkey.Get(this.ro, []byte(spath))
+	if err != nil {
+		iLogger.Errorf("%v", err)
+		return nil, false
+	}
+	return val, val != nil
+}
+
+/*
+Removes a metric, or a whole subtree of metrics, from the indices. Directory
+nodes that are left without any children & are not metrics themselves are
+pruned all the way up. Aliases of the metrics removed go along with them;
+removing an alias leaves the metric it points to untouched. Nothing is
+written in a dry run; the returned value describes what would have been
+removed.
+
+Data held in the shards is left untouched
+*/
+func (this *indices) deleteMetrics(path string, subtree bool, dryRun bool) (*indexDeletion, error) {
+	spath := string(scrubMetric(path))
+	if spath == "" {
+		return nil, errRootDelete
+	}
+
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+
+	if this.migrated == 0 {
+		return nil, errMigrationPending
+	}
+
+	retval := new(indexDeletion)
+	edit := this.newDirEdit()
+	defer edit.close()
+	mapBatch := levigo.NewWriteBatch()
+	defer mapBatch.Close()
+
+	nodes := []string{spath}
+	if subtree {
+		nodes = append(nodes, this._descendants(spath)...)
+	}
+
+	aliases := this._aliases()
+	gone := make(map[string]bool)
+	for _, node := range nodes {
+		code, ok := this._shortCode(node)
+		if !ok {
+			continue
+		}
+		gone[node] = true
+		mapBatch.Delete([]byte(node))
+		mapBatch.Delete(originKey(node))
+		if _, ok := aliases[node]; ok {
+			retval.aliases = append(retval.aliases, node)
+			mapBatch.Delete(aliasKey(node))
+			continue
+		}
+		retval.metrics = append(retval.metrics, metricIndex{node, code, _DEFAULT_METRIC_INTERVAL})
+		if owner, _ := this._codeOwner(code); owner == node {
+			mapBatch.Delete(codeKey(code))
+		}
+	}
+
+	/* Aliases elsewhere in the tree of the metrics removed */
+	var orphans []string
+	for a, x := range aliases {
+		if gone[x.target] && !gone[a] {
+			gone[a] = true
+			orphans = append(orphans, a)
+			retval.aliases = append(retval.aliases, a)
+			mapBatch.Delete([]byte(a))
+			mapBatch.Delete(aliasKey(a))
+		}
+	}
+
+	exists := edit.hasEdge(getParent(spath), leafName(spath))
+	if !exists && len(gone) == 0 {
+		return nil, errMetricNotFound
+	}
+
+	isMetric := func(node string) bool {
+		_, ok := this._shortCode(node)
+		return ok && !gone[node]
+	}
+	if subtree {
+		edit.clearChildren(nodes)
+	}
+	if removed := edit.removeNode(spath, isMetric); len(removed) != 0 && subtree {
+		retval.nodes = append(nodes, removed[1:]...)
+	} else {
+		retval.nodes = removed
+	}
+	for _, a := range orphans {
+		retval.nodes = append(retval.nodes, edit.removeNode(a, isMetric)...)
+	}
+
+	if dryRun {
+		return retval, nil
+	}
+
+	/* The metrics go first; a failure midway leaves behind directory nodes
+	that do not resolve to a metric, which are harmless */
+	if err := this.pkey.Write(this.wo, mapBatch); err != nil {
+		return nil, err
+	}
+	if err := edit.apply(); err != nil {
+		return nil, err
+	}
+	iLogger.Infof("deleted %d metric(s), %d alias(es) & %d node(s) under %s", len(retval.metrics), len(retval.aliases), len(retval.nodes), spath)
+	return retval, nil
+}
+
+/* The smallest key that is greater than all keys with a given prefix */
+func prefixEnd(prefix []byte) []byte {
+	retval := make([]byte, len(prefix))
+	copy(retval, prefix)
+	for i := len(retval) - 1; i >= 0; i-- {
+		if retval[i] != 0xff {
+			retval[i]++
+			return retval[:i+1]
+		}
+	}
+	return nil
+}
+
+/* Deletes all datapoints of a metric from a shard; returns the number of
+datapoints (that would be) deleted. Fails once the shard is released */
+func (this *shard) purge(shortCode []byte, dryRun bool) (uint64, error) {
+	this.busy.RLock()
+	defer this.busy.RUnlock()
+	if this.released {
+		return 0, errShardReleased
+	}
+	return purgePrefix(this.db, this.ro, this.wo, shortCode, dryRun)
+}
+
+/* Deletes all keys with a given prefix from a db; returns the number of
+keys (that would be) deleted */
+func purgePrefix(db *levigo.DB, ro *levigo.ReadOptions, wo *levigo.WriteOptions, prefix []byte, dryRun bool) (uint64, error) {
+	it := db.NewIterator(ro)
+	defer it.Close()
+
+	batch := levigo.NewWriteBatch()
+	defer batch.Close()
+
+	var n, pending uint64
+	for it.Seek(prefix); it.Valid(); it.Next() {
+		k := it.Key()
+		if !bytes.HasPrefix(k, prefix) {
+			break
+		}
+		n++
+		if dryRun {
+			continue
+		}
+		batch.Delete(k)
+		if pending++; pending == _BATCH_SIZE {
+			if err := db.Write(wo, batch); err != nil {
+				return n, err
+			}
+			batch.Clear()
+			pending = 0
+		}
+	}
+	if dryRun || n == 0 {
+		return n, nil
+	}
+	if err := db.Write(wo, batch); err != nil {
+		return n, err
+	}
+	db.CompactRange(levigo.Range{prefix, prefixEnd(prefix)})
+	return n, nil
+}
+
+/* Ids of all the shards present on disk */
+func (this *levelfederator) diskShards() []string {
+	return shardIds(this.config.Basedir)
+}
+
+/* Ids of all the shards under a given root */
+func shardIds(root string) []string {
+	paths, _ := filepath.Glob(_shard_namer(root, "*"))
+	retval := make([]string, 0, len(paths))
+	for _, p := range paths {
+		retval = append(retval, _shard_label(p))
+	}
+	sort.Strings(retval)
+	return retval
+}
+
+/* Removes metrics from the indices and optionally their datapoints from
+every shard on disk & every archive; the datapoints of an alias belong to the
+metric it points to and are never purged. Datapoints written concurrently with
+the purge can survive it; the source of the metrics is best silenced
+beforehand. Archival is held off while the data is purged */
+func (this *levelfederator) deleteMetric(req *DeleteRequest) (*DeleteReport, error) {
+	deletion, err := this.idx.deleteMetrics(req.Path, req.Subtree, req.DryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	retval := &DeleteReport{DryRun: req.DryRun, Metrics: []string{}, Shards: []string{}}
+	retval.Aliases = append([]string{}, deletion.aliases...)
+	retval.Nodes = append([]string{}, deletion.nodes...)
+	for _, m := range deletion.metrics {
+		retval.Metrics = append(retval.Metrics, m.metric)
+	}
+	if !req.PurgeData || len(deletion.metrics) == 0 {
+		return retval, nil
+	}
+
+	this.snapshotLock.Lock()
+	defer this.snapshotLock.Unlock()
+
+	for _, id := range this.diskShards() {
+		n, err := this._purgeShard(id, deletion.metrics, req.DryRun)
+		if err != nil {
+			return retval, err
+		}
+		if n != 0 {
+			retval.Shards = append(retval.Shards, id)
+			retval.Datapoints += n
+		}
+	}
+
+	codes := make([][]byte, 0, len(deletion.metrics))
+	for _, m := range deletion.metrics {
+		codes = append(codes, m.key)
+	}
+	for _, id := range archiveIds(this.config.Basedir) {
+		n, err := this.purgeArchive(id, codes, req.DryRun)
+		if err != nil {
+			return retval, err
+		}
+		if n != 0 {
+			retval.Shards = append(retval.Shards, id)
+			retval.Datapoints += n
+		}
+	}
+	return retval, nil
+}
+
+/* Purges metrics from a shard through a read handle, or its write handle if
+it is open for writes; it is never opened for writes here. Should the handle
+be released midway, the rest of the metrics are purged through a new one */
+func (this *levelfederator) _purgeShard(id string, metrics []metricIndex, dryRun bool) (uint64, error) {
+	var n uint64
+	for i := 0; i < len(metrics); {
+		s := this._readShard(id)
+		if s == nil {
+			return n, nil
+		}
+		for ; i < len(metrics); i++ {
+			x, err := s.purge(metrics[i].key, dryRun)
+			if err == errShardReleased {
+				break
+			}
+			n += x
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
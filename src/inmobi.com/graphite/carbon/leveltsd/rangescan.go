@@ -0,0 +1,234 @@
+package leveltsd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const _MAX_POINTS_PER_QUERY = 1000000
+
+/*
+Visits the datapoints of a metric within a time range a shard at a time, in
+order of time, so no more than a few shards' worth is held at once; the
+shards are scanned concurrently, see scanInOrder. Stops early once visit
+returns false & fails once ctx is done. While shards of several partition
+schemes are in use the datapoints are merged & visited in one go instead
+*/
+func (this *levelfederator) scanShards(ctx context.Context, key *metricIndex, start uint64, end uint64, visit func([]Datapoint) bool) error {
+	if len(this.schemes) > 1 {
+		points, err := this.dataScanContext(ctx, key, start, end)
+		if err == nil {
+			visit(points)
+		}
+		return err
+	}
+	ids := this.partition.rangeShards(start, end)
+	parts := make([][]Datapoint, len(ids))
+	return this.scanInOrder(ctx, len(ids), func(i int) {
+		parts[i] = this.shardScan(ids[i], key, start, end)
+	}, func(i int) bool {
+		points := parts[i]
+		parts[i] = nil
+		return len(points) == 0 || visit(points)
+	})
+}
+
+/* As scanShards, with the datapoints consolidated on the way unless c is
+nil */
+func (this *levelfederator) scanSeries(ctx context.Context, key *metricIndex, start uint64, end uint64, c *consolidator, visit func([]Datapoint) bool) error {
+	if c == nil {
+		return this.scanShards(ctx, key, start, end, visit)
+	}
+	more := true
+	err := this.scanShards(ctx, key, start, end, func(points []Datapoint) bool {
+		if buckets := c.feed(points); len(buckets) > 0 {
+			more = visit(buckets)
+		}
+		return more
+	})
+	if err == nil && more {
+		if last := c.done(); last != nil {
+			visit(last)
+		}
+	}
+	return err
+}
+
+/*
+Up to limit datapoints of a metric from start onwards, consolidated unless c
+is nil, along with the timestamp the next page starts at; 0 once there is
+none. All of them with limit 0
+*/
+func (this *levelfederator) rangePage(ctx context.Context, key *metricIndex, start uint64, end uint64, c *consolidator, limit uint64) ([]Datapoint, uint64, error) {
+	if limit == 0 && c == nil {
+		retval, err := this.dataScanContext(ctx, key, start, end)
+		return retval, 0, err
+	}
+	retval := make([]Datapoint, 0)
+	var next uint64
+	err := this.scanSeries(ctx, key, start, end, c, func(points []Datapoint) bool {
+		if limit == 0 {
+			retval = append(retval, points...)
+			return true
+		}
+		if room := limit - uint64(len(retval)); uint64(len(points)) > room {
+			retval = append(retval, points[:room]...)
+			next = points[room].Timestamp
+			return false
+		}
+		retval = append(retval, points...)
+		return true
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return retval, next, nil
+}
+
+/* The number of datapoints a page may hold given the limit asked for; 0
+for no limit */
+func (this *levelfederator) pageLimit(asked uint64) uint64 {
+	max := this.config.Max_points_per_query
+	if asked == 0 || (max > 0 && asked > max) {
+		return max
+	}
+	return asked
+}
+
+/*
+Serves the datapoints of a metric on the reader port as JSON, written a
+shard at a time as they are read; target, from & until (unix time, both
+inclusive) and limit. Until defaults to now & from to a day before until.
+With maxDataPoints or bucket_seconds the datapoints are consolidated by
+consolidateBy (avg by default) into buckets; see newConsolidator & its
+checkPaging. With
+shape=dense the response is gap filled instead; see serveSeries. A query
+running past query-timeout-seconds is cut short.
+The response is {"metric": ..., "data": [{"Timestamp": ..., "Value": ...},
+...], "next": ...}; NaN & infinities are written as null. A response cut
+short by the limit, or else by max-points-per-query, carries in next the
+from of the following page; next is 0 when there is none
+*/
+func (this *levelfederator) serveData(w http.ResponseWriter, r *http.Request) {
+	metric := r.FormValue("target")
+	start, end, err := parseRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ints := map[string]uint64{"limit": 0, "maxDataPoints": 0, "bucket_seconds": 0}
+	for name := range ints {
+		if val := r.FormValue(name); val != "" {
+			if ints[name], err = strconv.ParseUint(val, 10, 64); err != nil {
+				http.Error(w, name+": "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	key, ok := this.getMetric(metric)
+	if !ok {
+		http.Error(w, "key not found: "+metric, http.StatusNotFound)
+		return
+	}
+	c, err := newConsolidator(key, start, end, ints["maxDataPoints"], ints["bucket_seconds"], r.FormValue("consolidateBy"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ctx, cancel := this.queryContext(r)
+	defer cancel()
+	switch r.FormValue("shape") {
+	case "", "points":
+	case "dense":
+		this.serveSeries(ctx, w, metric, key, start, end, c)
+		return
+	default:
+		http.Error(w, "shape: expected points or dense", http.StatusBadRequest)
+		return
+	}
+	limit := this.pageLimit(ints["limit"])
+	if err := c.checkPaging(start, end, limit); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	out := bufio.NewWriter(w)
+	quoted, _ := json.Marshal(metric)
+	fmt.Fprintf(out, "{\"metric\":%s,", quoted)
+	if c != nil {
+		fmt.Fprintf(out, "\"bucket\":%d,", c.bucket)
+	}
+	out.WriteString("\"data\":[")
+
+	var n, next uint64
+	err = this.scanSeries(ctx, key, start, end, c, func(points []Datapoint) bool {
+		for _, x := range points {
+			if limit > 0 && n == limit {
+				next = x.Timestamp
+				return false
+			}
+			if n > 0 {
+				out.WriteByte(',')
+			}
+			val := "null"
+			if !math.IsNaN(x.Value) && !math.IsInf(x.Value, 0) {
+				val = strconv.FormatFloat(x.Value, 'g', -1, 64)
+			}
+			fmt.Fprintf(out, "{\"Timestamp\":%d,\"Value\":%s}", x.Timestamp, val)
+			n++
+		}
+		if err := out.Flush(); err != nil {
+			return false // the client is gone
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		return true
+	})
+	if err != nil {
+		abortQuery(metric, err)
+	}
+	fmt.Fprintf(out, "],\"next\":%d}\n", next)
+	out.Flush()
+}
+
+/* Cuts a streamed response short; by now it is too late to tell the client
+other than that way */
+func abortQuery(metric string, err error) {
+	if err == context.DeadlineExceeded {
+		fLogger.Limited("query-timeout").Warnf("query for %s timed out", metric)
+	}
+	panic(http.ErrAbortHandler)
+}
+
+/* from & until of a request to the reader port; until defaults to now & from
+to a day before until */
+func parseRange(r *http.Request) (uint64, uint64, error) {
+	end := uint64(time.Now().Unix())
+	if val := r.FormValue("until"); val != "" {
+		x, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("until: %v", err)
+		}
+		end = x
+	}
+	start := end - 86400
+	if val := r.FormValue("from"); val != "" {
+		x, err := strconv.ParseUint(val, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("from: %v", err)
+		}
+		start = x
+	}
+	if start > end {
+		return 0, 0, fmt.Errorf("from %d is past until %d", start, end)
+	}
+	return start, end, nil
+}
@@ -0,0 +1,259 @@
+package leveltsd
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const _READ_CACHE_SHARDS = 8
+const _READ_CACHE_TTL_SECONDS = 300
+
+/*
+Handles of the shards read from, or bulk written to by backfill, but not open
+for writes. They are opened without writers, & without stamping shards that
+lack the scheme marker, & are kept apart from the shards open for writes,
+with a budget & a TTL of their own, so that a query over a long range
+neither evicts the shards being written to nor holds them up.
+
+A shard is never open both ways. No handle is opened or closed with a lock
+held, be it the federator's or the cache's own; the cache keeps track of the
+handles being opened & closed, & a get of such a shard waits for it. Shards
+owned by the federator, i.e. open or being opened for writes or archived,
+are not opened here at all; opening one for writes takes its handle over,
+see take
+*/
+type readCache struct {
+	basedir string
+	config  shard_config
+	max     int
+	ttl     time.Duration
+	owned   func(id string) bool
+
+	handles map[string]*readHandle // open or being opened
+	closing map[string]chan bool   // closed once the handle is
+	closed  bool
+	lock    sync.Mutex
+}
+
+type readHandle struct {
+	id    string
+	s     *shard // nil till opened, & if it fails to be
+	used  time.Time
+	ready chan bool // closed once s is opened or fails to be
+}
+
+/* Describes an open read handle */
+type readHandleInfo struct {
+	Id           string
+	Idle_seconds float64 // since it was last read from
+}
+
+/* The budget & TTL default when 0 */
+func newReadCache(basedir string, config shard_config, max uint, ttl time.Duration, owned func(id string) bool) *readCache {
+	if max == 0 {
+		max = _READ_CACHE_SHARDS
+	}
+	if ttl == 0 {
+		ttl = _READ_CACHE_TTL_SECONDS * time.Second
+	}
+	config.Write_concurrency = 0
+	config.Leave_unstamped = true
+	return &readCache{
+		basedir: basedir,
+		config:  config,
+		max:     int(max),
+		ttl:     ttl,
+		owned:   owned,
+		handles: make(map[string]*readHandle),
+		closing: make(map[string]chan bool),
+	}
+}
+
+/* The read handle of a shard, opened if need be; nil if there is no such
+shard, unless it is to be created. False, along with nil, if the shard is
+owned by the federator. Once it is opened, the handles least lately read from
+are closed to stay within the budget, in the background as they may have
+scans under way */
+func (this *readCache) get(id string, createIfAbsent bool) (*shard, bool) {
+	this.lock.Lock()
+	for {
+		if this.closed {
+			this.lock.Unlock()
+			return nil, true
+		}
+		if h, ok := this.handles[id]; ok {
+			h.used = time.Now()
+			this.lock.Unlock()
+			<-h.ready
+			if h.s != nil || !createIfAbsent {
+				return h.s, true
+			}
+			/* Failed to be opened by a get that would not create it */
+			this.lock.Lock()
+			continue
+		}
+		done, ok := this.closing[id]
+		if !ok {
+			break
+		}
+		this.lock.Unlock()
+		<-done
+		this.lock.Lock()
+	}
+	if this.owned(id) {
+		this.lock.Unlock()
+		return nil, false
+	}
+
+	h := &readHandle{id: id, used: time.Now(), ready: make(chan bool)}
+	this.handles[id] = h
+	this.lock.Unlock()
+
+	s, err := mkShard(_shard_namer(this.basedir, id), createIfAbsent, this.config)
+
+	this.lock.Lock()
+	evicted := make([]*readHandle, 0)
+	if err == nil {
+		h.s = s
+		for this._open() > this.max {
+			evicted = append(evicted, this._detach(this._lru(id)))
+		}
+	} else if this.handles[id] == h {
+		delete(this.handles, id)
+	}
+	close(h.ready)
+	this.lock.Unlock()
+
+	go this._close(evicted)
+	return h.s, true
+}
+
+/* The number of handles opened, rather than being opened; expects the lock
+to be held */
+func (this *readCache) _open() int {
+	n := 0
+	for _, h := range this.handles {
+		if h.s != nil {
+			n++
+		}
+	}
+	return n
+}
+
+/* The id of the opened handle least lately read from, other than that of a
+given shard; expects the lock to be held */
+func (this *readCache) _lru(except string) string {
+	lru := ""
+	for id, h := range this.handles {
+		if id != except && h.s != nil && (lru == "" || h.used.Before(this.handles[lru].used)) {
+			lru = id
+		}
+	}
+	return lru
+}
+
+/* Takes a handle out of the cache, to be closed by _close with the lock let
+go of; a get of the shard waits till then. Expects the lock to be held */
+func (this *readCache) _detach(id string) *readHandle {
+	h := this.handles[id]
+	delete(this.handles, id)
+	this.closing[id] = make(chan bool)
+	return h
+}
+
+/* Closes detached handles, once they are opened if they are being opened &
+once the scans under way on them are done */
+func (this *readCache) _close(handles []*readHandle) {
+	for _, h := range handles {
+		<-h.ready
+		if h.s != nil {
+			h.s.release()
+		}
+		this.lock.Lock()
+		done := this.closing[h.id]
+		delete(this.closing, h.id)
+		this.lock.Unlock()
+		close(done)
+	}
+}
+
+/* Closes the read handle of a shard, if it has one, so that it can be opened
+otherwise; to be invoked once the federator owns the shard, lest a handle be
+opened anew. Blocks till the scans under way on the handle are done */
+func (this *readCache) take(id string) {
+	this.lock.Lock()
+	if _, ok := this.handles[id]; ok {
+		h := this._detach(id)
+		this.lock.Unlock()
+		this._close([]*readHandle{h})
+		return
+	}
+	done, ok := this.closing[id]
+	this.lock.Unlock()
+	if ok {
+		<-done
+	}
+}
+
+/* Closes the handles not read from for longer than the TTL; returns how many */
+func (this *readCache) expire(now time.Time) int {
+	this.lock.Lock()
+	expired := make([]*readHandle, 0)
+	for id, h := range this.handles {
+		if now.Sub(h.used) > this.ttl {
+			expired = append(expired, this._detach(id))
+		}
+	}
+	this.lock.Unlock()
+
+	this._close(expired)
+	return len(expired)
+}
+
+/* Expires handles till done is closed */
+func (this *readCache) expireLoop(done chan bool) {
+	interval := this.ttl / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if n := this.expire(now); n > 0 {
+				fLogger.Debugf("closed %d read handle(s) unused for %v", n, this.ttl)
+			}
+		}
+	}
+}
+
+func (this *readCache) list() []readHandleInfo {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	retval := make([]readHandleInfo, 0, len(this.handles))
+	for id, h := range this.handles {
+		if h.s != nil {
+			retval = append(retval, readHandleInfo{id, time.Since(h.used).Seconds()})
+		}
+	}
+	sort.Slice(retval, func(i, j int) bool { return retval[i].Id < retval[j].Id })
+	return retval
+}
+
+/* Closes every handle; none is opened after */
+func (this *readCache) release() {
+	this.lock.Lock()
+	this.closed = true
+	handles := make([]*readHandle, 0, len(this.handles))
+	for id := range this.handles {
+		handles = append(handles, this._detach(id))
+	}
+	this.lock.Unlock()
+
+	this._close(handles)
+}
@@ -1,7 +1,9 @@
 package leveltsd
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net/http"
 )
 
@@ -25,10 +27,22 @@ type RangeQuery struct {
 	Node  string
 	Start uint64
 	End   uint64
+	Limit uint64 // datapoints per page; 0 for all of them within max-points-per-query
+
+	/* Consolidation into buckets of BucketSeconds, or else as many as make
+	for no more than MaxDataPoints over the range; none if both are 0. The
+	buckets of MaxDataPoints are to fit in a page, as pages past the first
+	would work out smaller buckets over their narrower range; to page
+	through buckets, ask for the Bucket as BucketSeconds on every page */
+	MaxDataPoints uint64
+	BucketSeconds uint64
+	Consolidate   string // avg (the default), sum, min, max or last
 }
 
 type RangeResult struct {
-	Data []Datapoint
+	Data   []Datapoint
+	Next   uint64 // Start of the next page; 0 once there is none
+	Bucket uint64 // seconds a datapoint spans if consolidated; 0 otherwise
 }
 
 func (this *ReaderService) GetChildNodes(r *http.Request, parent *Nodename, children *Nodelist) error {
@@ -45,8 +59,64 @@ func (this *ReaderService) IsNodeLeaf(r *http.Request, node *Nodename, response
 func (this *ReaderService) GetRangeData(r *http.Request, query *RangeQuery, response *RangeResult) error {
 	if key, ok := this.federator.getMetric(query.Node); !ok {
 		return errors.New("key not found: " + query.Node)
+	} else if query.Start > query.End {
+		return fmt.Errorf("Start %d is past End %d", query.Start, query.End)
 	} else {
-		response.Data = this.federator.dataScan(key, query.Start, query.End)
+		c, err := newConsolidator(key, query.Start, query.End, query.MaxDataPoints, query.BucketSeconds, query.Consolidate)
+		if err != nil {
+			return err
+		}
+		limit := this.federator.pageLimit(query.Limit)
+		if err := c.checkPaging(query.Start, query.End, limit); err != nil {
+			return err
+		}
+		if c != nil {
+			response.Bucket = c.bucket
+		}
+		ctx, cancel := this.federator.queryContext(r)
+		defer cancel()
+		response.Data, response.Next, err = this.federator.rangePage(ctx, key, query.Start, query.End, c, limit)
+		if err != nil {
+			return queryError(query.Node, err)
+		}
+		if query.Limit == 0 && response.Next != 0 {
+			response.Data, response.Next = nil, 0
+			return fmt.Errorf("%s has more than %d datapoints in range; page through them with Limit", query.Node, this.federator.config.Max_points_per_query)
+		}
 		return nil
 	}
 }
+
+/* A range gap filled at the step of the metric, or the bucket if consolidated;
+Limit is disregarded */
+func (this *ReaderService) GetSeries(r *http.Request, query *RangeQuery, response *SeriesResult) error {
+	key, ok := this.federator.getMetric(query.Node)
+	if !ok {
+		return errors.New("key not found: " + query.Node)
+	}
+	if query.Start > query.End {
+		return fmt.Errorf("Start %d is past End %d", query.Start, query.End)
+	}
+	c, err := newConsolidator(key, query.Start, query.End, query.MaxDataPoints, query.BucketSeconds, query.Consolidate)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := this.federator.queryContext(r)
+	defer cancel()
+	series, err := this.federator.series(ctx, key, query.Start, query.End, c)
+	if err == context.DeadlineExceeded || err == context.Canceled {
+		return queryError(query.Node, err)
+	} else if err != nil {
+		return err
+	}
+	*response = *series
+	return nil
+}
+
+/* The error of a query given up on, be it timed out or cancelled */
+func queryError(node string, err error) error {
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("query for %s timed out", node)
+	}
+	return fmt.Errorf("query for %s: %v", node, err)
+}
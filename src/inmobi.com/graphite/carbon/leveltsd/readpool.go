@@ -0,0 +1,88 @@
+package leveltsd
+
+import (
+	"context"
+	"net/http"
+)
+
+const _READ_CONCURRENCY = 4
+const _QUERY_TIMEOUT_SECONDS = 60
+
+/*
+The context a query runs in; done once the client disconnects or, unless
+query-timeout-seconds is 0, once the query has taken that long. r is nil for
+queries not made over the reader port
+*/
+func (this *levelfederator) queryContext(r *http.Request) (context.Context, context.CancelFunc) {
+	parent := context.Background()
+	if r != nil {
+		parent = r.Context()
+	}
+	if this.config.Query_timeout > 0 {
+		return context.WithTimeout(parent, this.config.Query_timeout)
+	}
+	return context.WithCancel(parent)
+}
+
+/* Read slots shared by all the queries of a federator */
+func newReadSlots(concurrency uint) chan bool {
+	if concurrency == 0 {
+		concurrency = _READ_CONCURRENCY
+	}
+	return make(chan bool, concurrency)
+}
+
+/*
+Scans n shards concurrently & visits them in order, i.e. in order of time.
+scan(i) is run for every shard through the read slots, which bound the
+shards being scanned at once across all queries, so a long range neither
+opens more shards at a time than read-concurrency nor starves the other
+queries. visit(i) is called once scan(i) is done & those before it are
+visited; a query scans no more than read-concurrency shards ahead of the one
+being visited, so a slow visitor holds little in memory. Stops early once
+visit returns false; fails once ctx is done, leaving the scans under way to
+finish on their own
+*/
+func (this *levelfederator) scanInOrder(ctx context.Context, n int, scan func(i int), visit func(i int) bool) error {
+	ahead := make(chan bool, cap(this.readSlots))
+	done := make([]chan bool, n)
+	for i := range done {
+		done[i] = make(chan bool, 1)
+	}
+	stop := make(chan bool)
+	defer close(stop)
+
+	go func() {
+		for i := 0; i < n; i++ {
+			select {
+			case ahead <- true:
+			case <-stop:
+				return
+			}
+			select {
+			case this.readSlots <- true:
+			case <-stop:
+				return
+			}
+			go func(i int) {
+				defer func() { <-this.readSlots }()
+				scan(i)
+				done[i] <- true
+			}(i)
+		}
+	}()
+
+	for i := 0; i < n; i++ {
+		select {
+		case <-done[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		<-ahead
+		if !visit(i) {
+			return nil
+		}
+	}
+	return nil
+}
+
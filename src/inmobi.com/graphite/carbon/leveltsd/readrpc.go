@@ -17,7 +17,14 @@ func make_rpc_server(federator *levelfederator, port uint16) func() {
 	s.RegisterCodec(codec, "application/json")
 	s.RegisterCodec(codec, "application/json-rpc")
 	s.RegisterService(readService, "")
-	http.Handle("/", s)
+
+	/* A private mux keeps anything registered on the default one (such as
+	net/http/pprof) off the reader port */
+	mux := http.NewServeMux()
+	mux.Handle("/", s)
+	mux.HandleFunc("/export", federator.serveExport)
+	mux.HandleFunc("/data", federator.serveData)
+	mux.HandleFunc("/render", federator.serveRender)
 
 	l, e := net.Listen("tcp", fmt.Sprintf(":%d", int(port)))
 	if e != nil {
@@ -25,7 +32,7 @@ func make_rpc_server(federator *levelfederator, port uint16) func() {
 	}
 
 	anon := func() {
-		http.Serve(l, nil)
+		http.Serve(l, mux)
 	}
 	return anon
 }
@@ -0,0 +1,261 @@
+package leveltsd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/jmhodges/levigo"
+	"strings"
+	"time"
+)
+
+/*
+Reserved keys of the map db (tsd-map.db); metric names cannot start with a
+NUL as scrubMetric strips it.
+
+A renamed metric retains its short code, which is the md5 of its original
+name; the code changes hands in the reverse map (see codes.go) so that a
+later metric with the original name is not handed the same code.
+
+An alias is the original name of a renamed metric that continues to point
+at its short code for a transition period; writes & reads under either name
+see the same series. Keys look like
+
+	_MAP_ALIAS_PREFIX alias => expiry (8 bytes, big endian unix time) metric name
+*/
+const _MAP_ALIAS_PREFIX = "\x00alias\x00"
+
+/* How often expired aliases are looked for */
+const _ALIAS_REAP_INTERVAL = time.Hour
+
+var errRenameConflict = errors.New("destination already exists")
+var errRenameInvalid = errors.New("cannot rename the root, onto itself or into its own subtree")
+var errRenameAlias = errors.New("cannot rename an alias; rename the metric it points to")
+
+type metricAlias struct {
+	target  string
+	expires time.Time
+}
+
+func aliasKey(alias string) []byte {
+	return []byte(_MAP_ALIAS_PREFIX + alias)
+}
+
+func encodeAlias(a metricAlias) []byte {
+	retval := make([]byte, 8, 8+len(a.target))
+	binary.BigEndian.PutUint64(retval, uint64(a.expires.Unix()))
+	return append(retval, a.target...)
+}
+
+/* All the aliases, keyed by the alias */
+func (this *indices) _aliases() map[string]metricAlias {
+	prefix := []byte(_MAP_ALIAS_PREFIX)
+
+	it := this.pkey.NewIterator(this.ro)
+	defer it.Close()
+
+	retval := make(map[string]metricAlias)
+	for it.Seek(prefix); it.Valid(); it.Next() {
+		k := it.Key()
+		if !bytes.HasPrefix(k, prefix) {
+			break
+		}
+		v := it.Value()
+		if len(v) < 8 {
+			iLogger.Errorf("alias #%s# is corrupt", k[len(prefix):])
+			continue
+		}
+		expires := time.Unix(int64(binary.BigEndian.Uint64(v)), 0)
+		retval[string(k[len(prefix):])] = metricAlias{string(v[8:]), expires}
+	}
+	return retval
+}
+
+/* What gets (or would get) changed by a rename */
+type renaming struct {
+	moved   map[string]string
+	aliases map[string]string
+	nodes   []string // directory nodes that cease to exist
+}
+
+/*
+Renames a metric, or moves a whole subtree, by pointing the new names at the
+existing short codes; no datapoints are rewritten. With a non zero alias
+period, the old names continue to resolve (and be listed) till it elapses.
+Nothing is written in a dry run
+*/
+func (this *indices) renameMetrics(from string, to string, subtree bool, alias time.Duration, dryRun bool) (*renaming, error) {
+	sfrom, sto := string(scrubMetric(from)), string(scrubMetric(to))
+	if sfrom == "" || sto == "" || sfrom == sto || strings.HasPrefix(sto, sfrom+".") {
+		return nil, errRenameInvalid
+	}
+
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+
+	if this.migrated == 0 {
+		return nil, errMigrationPending
+	}
+
+	nodes := []string{sfrom}
+	if subtree {
+		nodes = append(nodes, this._descendants(sfrom)...)
+	}
+	target := func(node string) string {
+		return sto + node[len(sfrom):]
+	}
+
+	edit := this.newDirEdit()
+	defer edit.close()
+	mapBatch := levigo.NewWriteBatch()
+	defer mapBatch.Close()
+
+	existing := this._aliases()
+	expires := time.Now().Add(alias)
+	retval := &renaming{make(map[string]string), make(map[string]string), nil}
+
+	for _, node := range nodes {
+		code, ok := this._shortCode(node)
+		if !ok {
+			continue
+		}
+		if _, ok := existing[node]; ok {
+			return nil, errRenameAlias
+		}
+		dest := target(node)
+		if _, taken := this._shortCode(dest); taken {
+			return nil, errRenameConflict
+		}
+		retval.moved[node] = dest
+		mapBatch.Put([]byte(dest), code)
+		mapBatch.Put(codeKey(code), []byte(dest))
+		if alias > 0 {
+			retval.aliases[node] = dest
+			mapBatch.Put(aliasKey(node), encodeAlias(metricAlias{dest, expires}))
+		} else {
+			mapBatch.Delete([]byte(node))
+			mapBatch.Delete(originKey(node))
+		}
+	}
+
+	/* Aliases left behind by earlier renames follow the metric */
+	for a, x := range existing {
+		if dest, ok := retval.moved[x.target]; ok {
+			mapBatch.Put(aliasKey(a), encodeAlias(metricAlias{dest, x.expires}))
+		}
+	}
+
+	exists := edit.hasEdge(getParent(sfrom), leafName(sfrom))
+	if len(retval.moved) == 0 && (!subtree || !exists) {
+		return nil, errMetricNotFound
+	}
+	if subtree && edit.hasEdge(getParent(sto), leafName(sto)) {
+		return nil, errRenameConflict
+	}
+
+	edit.addPath(sto)
+	if subtree {
+		for _, node := range nodes {
+			for _, c := range this._lsEdges([]byte(node)) {
+				edit.addEdge(target(node), c)
+			}
+		}
+	}
+	if alias == 0 {
+		if subtree {
+			edit.clearChildren(nodes)
+		}
+		moved := func(node string) bool {
+			_, ok := retval.moved[node]
+			return ok
+		}
+		isMetric := func(node string) bool {
+			_, ok := this._shortCode(node)
+			return ok && !moved(node)
+		}
+		if removed := edit.removeNode(sfrom, isMetric); len(removed) != 0 && subtree {
+			retval.nodes = append(nodes, removed[1:]...)
+		} else {
+			retval.nodes = removed
+		}
+	}
+
+	if dryRun {
+		return retval, nil
+	}
+
+	/* The new names go in first; a failure midway leaves behind directory
+	nodes that do not resolve to a metric, which are harmless */
+	if err := this.pkey.Write(this.wo, mapBatch); err != nil {
+		return nil, err
+	}
+	if err := edit.apply(); err != nil {
+		return nil, err
+	}
+	iLogger.Infof("renamed %d metric(s) from %s to %s", len(retval.moved), sfrom, sto)
+	return retval, nil
+}
+
+/* Drops the aliases that have expired as of a given time. Returns the
+number of aliases dropped */
+func (this *indices) expireAliases(now time.Time) (int, error) {
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+
+	if this.closed || this.migrated == 0 {
+		return 0, nil
+	}
+
+	edit := this.newDirEdit()
+	defer edit.close()
+	mapBatch := levigo.NewWriteBatch()
+	defer mapBatch.Close()
+
+	gone := make(map[string]bool)
+	for a, x := range this._aliases() {
+		if x.expires.After(now) {
+			continue
+		}
+		gone[a] = true
+		mapBatch.Delete(aliasKey(a))
+		mapBatch.Delete([]byte(a))
+	}
+	if len(gone) == 0 {
+		return 0, nil
+	}
+
+	isMetric := func(node string) bool {
+		_, ok := this._shortCode(node)
+		return ok && !gone[node]
+	}
+	for a := range gone {
+		edit.removeNode(a, isMetric)
+	}
+
+	if err := this.pkey.Write(this.wo, mapBatch); err != nil {
+		return 0, err
+	}
+	if err := edit.apply(); err != nil {
+		return 0, err
+	}
+	iLogger.Infof("dropped %d expired alias(es)", len(gone))
+	return len(gone), nil
+}
+
+/* Periodically drops expired aliases; stops once done is closed */
+func (this *indices) aliasLoop(interval time.Duration, done chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := this.expireAliases(time.Now()); err != nil {
+			iLogger.Errorf("expiring aliases: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+	}
+}
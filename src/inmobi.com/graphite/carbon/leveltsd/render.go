@@ -0,0 +1,105 @@
+package leveltsd
+
+import (
+	"context"
+	"fmt"
+	"inmobi.com/graphite/carbon/query"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+/* Fetches series for the query engine; each is read by dataScan & gap
+filled at the step of its metric */
+type seriesFetcher struct {
+	federator *levelfederator
+}
+
+func (this seriesFetcher) Fetch(ctx context.Context, pathExpr string, from uint64, until uint64) ([]*query.Series, error) {
+	f := this.federator
+	keys, err := f.resolveNode(pathExpr)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].metric < keys[j].metric })
+
+	retval := make([]*query.Series, 0, len(keys))
+	for _, key := range keys {
+		filler := newGapFiller(from, until, seriesStep(key, nil))
+		if err := f._checkSlots(filler); err != nil {
+			return nil, fmt.Errorf("%s: %v", key.metric, err)
+		}
+		points, err := f.dataScanContext(ctx, key, from, until)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]float64, 0, filler.slots)
+		emit := func(v *float64) {
+			if v == nil {
+				values = append(values, math.NaN())
+			} else {
+				values = append(values, *v)
+			}
+		}
+		filler.fill(points, emit)
+		filler.done(emit)
+		retval = append(retval, &query.Series{key.metric, pathExpr, filler.start, filler.end(), filler.step, values})
+	}
+	return retval, nil
+}
+
+/*
+Serves graphite's render API on the reader port, for format=json alone:
+target (any number of them), from & until, either unix time or an offset from
+now such as -6h. Until defaults to now & from to a day before until. The
+response is [{"target": ..., "datapoints": [[value, timestamp], ...]}, ...],
+a series per target in order, as graphite-web renders them; see the query
+package for the functions targets may call
+*/
+func (this *levelfederator) serveRender(w http.ResponseWriter, r *http.Request) {
+	if format := r.FormValue("format"); format != "" && format != "json" {
+		http.Error(w, "format: only json is supported", http.StatusBadRequest)
+		return
+	}
+	now := time.Now()
+	until := uint64(now.Unix())
+	var err error
+	if val := r.FormValue("until"); val != "" {
+		if until, err = query.ParseTime(val, now); err != nil {
+			http.Error(w, "until: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	from := until - 86400
+	if val := r.FormValue("from"); val != "" {
+		if from, err = query.ParseTime(val, now); err != nil {
+			http.Error(w, "from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if from > until {
+		http.Error(w, fmt.Sprintf("from %d is past until %d", from, until), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := this.queryContext(r)
+	defer cancel()
+	qctx := &query.Context{Ctx: ctx, From: from, Until: until, Fetcher: seriesFetcher{this}}
+	series := make([]*query.Series, 0)
+	for _, target := range r.Form["target"] {
+		result, err := query.Eval(qctx, target)
+		if ctx.Err() == context.DeadlineExceeded {
+			http.Error(w, "query timed out", http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		series = append(series, result...)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	query.WriteJSON(w, series)
+}
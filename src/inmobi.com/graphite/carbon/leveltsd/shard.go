@@ -1,14 +1,18 @@
 package leveltsd
 
 import (
-	"bytes"
 	"container/list"
-	"errors"
 	"fmt"
 	"github.com/jmhodges/levigo"
+	"inmobi.com/graphite/carbon/audit"
 	"inmobi.com/graphite/carbon/logging"
-	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -16,6 +20,7 @@ const _BATCH_SIZE = 10000
 const _DATA_CACHE_SIZE = (1 << 20) * 16 // 16 MB
 const _BATCH_TIME_SECONDS = 10
 const _CONCURRENT_WRITERS = 4
+const _WRITE_QUEUE_LENGTH = 1000
 
 /*
 Represents a single shard of timeseries data.
@@ -25,15 +30,22 @@ it holds. This is by design. All such information is expected to be managed
 at a higher level. This allows for flexibile migration of data if needed
 */
 type shard struct {
-	db      *levigo.DB
-	writers *list.List
-	ro      *levigo.ReadOptions
-	wo      *levigo.WriteOptions
-	filter  *levigo.FilterPolicy
-	logger  *log.Logger
-	wchan   chan<- triplet
-	config  shard_config
-	cache   *levigo.Cache
+	last_write int64 // unix nanoseconds; first for atomic alignment
+	db         *levigo.DB
+	writers    *list.List
+	ro         *levigo.ReadOptions
+	wo         *levigo.WriteOptions
+	filter     *levigo.FilterPolicy
+	logger     *logging.Logger
+	wchan      chan<- triplet
+	config     shard_config
+	cache      *levigo.Cache
+	label      string
+	codec      shardCodec
+	codec_name string
+	flush_lock sync.Mutex // serializes flushes of exclusive codecs
+	busy       sync.RWMutex // held by bulk writes & scans; keeps db from being closed under them
+	released   bool
 }
 
 type shard_config struct {
@@ -41,13 +53,17 @@ type shard_config struct {
 	Write_batch_size         uint
 	Write_batch_fill_timeout time.Duration
 	Write_concurrency        uint8
+	Write_queue_length       uint
+	Codec                    string // stamped into new shards
+	Leave_unstamped          bool   // read shards lacking the scheme marker as SERIALIZATION_TECHNIQUE rather than stamp them
 }
 
 type shard_writer struct {
-	s   *shard
-	c   <-chan triplet
-	end chan bool
-	id  uint8
+	s     *shard
+	c     <-chan triplet
+	end   chan bool
+	id    uint8
+	flush chan chan bool
 }
 
 type Datapoint struct {
@@ -57,7 +73,7 @@ type Datapoint struct {
 
 type writeBatch struct {
 	next uint
-	data []msg
+	data []triplet
 }
 
 type triplet struct {
@@ -72,7 +88,7 @@ type msg struct {
 
 /* Opens an existing shard or creates it if absent */
 func mkShard(fs_path string, createIfAbsent bool, config shard_config) (*shard, error) {
-	iLogger.Printf("shard make request %s %t\n", fs_path, createIfAbsent)
+	iLogger.Debugf("shard make request %s %t", fs_path, createIfAbsent)
 	retval := new(shard)
 
 	var exists bool
@@ -102,19 +118,20 @@ func mkShard(fs_path string, createIfAbsent bool, config shard_config) (*shard,
 		retval.wo = levigo.NewWriteOptions()
 		retval.filter = filter
 
-		logger_prefix := fmt.Sprintf("leveltsd-shard (%s): ", fs_path)
-		retval.logger = logging.MakeLogger(logger_prefix)
-
-		if exists {
-			magic,_ := retval.db.Get(retval.ro, []byte(SCHEME_MAGIC_ID))
-			if bytes.Compare(magic, []byte(SERIALIZATION_TECHNIQUE)) != 0 {
-				error_msg := fmt.Sprintf("Expected magic code was %v but got %v", []byte(SERIALIZATION_TECHNIQUE), magic)
-				retval.logger.Println(error_msg)
-				errors.New(error_msg)
-			}
+		retval.logger = logging.MakeLogger("leveltsd-shard").With("shard", fs_path)
+		retval.label = _shard_label(fs_path)
+
+		if err = retval._initSchema(exists, config.Codec, config.Leave_unstamped); err != nil {
+			iLogger.Limited("schema").Errorf("refusing to open shard %s: %v", fs_path, err)
+			retval.db.Close()
+			retval.ro.Close()
+			retval.wo.Close()
+			cache.Close()
+			filter.Close()
+			return nil, err
 		}
 
-		wchan := make(chan triplet)
+		wchan := make(chan triplet, config.Write_queue_length)
 		retval.wchan = wchan
 		retval.writers = list.New()
 		retval.config = config
@@ -125,14 +142,18 @@ func mkShard(fs_path string, createIfAbsent bool, config shard_config) (*shard,
 	} else {
 		cache.Close()
 		filter.Close()
-		iLogger.Printf("died with %v\n", retval.db)
+		iLogger.Limited("mkshard").Errorf("shard %s died with %v", fs_path, err)
 	}
 	return retval, err
 }
 
 func (this *shard) release() {
+	this.busy.Lock()
+	this.released = true
+	this.busy.Unlock()
+
 	close(this.wchan)
-	this.logger.Println("closed receive pipeline")
+	this.logger.Debugf("closed receive pipeline")
 
 	for e := this.writers.Front(); e != nil; e = e.Next() {
 		var w *shard_writer = e.Value.(*shard_writer)
@@ -143,7 +164,7 @@ func (this *shard) release() {
 	this.wo.Close()
 	this.cache.Close()
 	this.filter.Close()
-	this.logger.Println("closed")
+	this.logger.Infof("closed")
 }
 
 /* Drain the accumulated write commands
@@ -156,14 +177,27 @@ func (this *shard) _flush(batch *writeBatch, id uint8) {
 
 	n := batch.next
 
-	for i := uint(0); i < n; i++ {
-		datum := batch.data[i]
-		levelBatch.Put(datum.key, datum.val)
+	if this.codec.exclusive() {
+		this.flush_lock.Lock()
+		defer this.flush_lock.Unlock()
+	}
+	this.codec.encode(this, levelBatch, batch.data[:n])
+
+	var stats *audit.FlushStats
+	if metrics := audit.GetMetrics(); metrics != nil {
+		stats = metrics.FlushStats(this.label, id)
+		stats.RecordQueueDepth(uint32(len(this.wchan)))
 	}
-	this.logger.Printf("(%02d) flushing %d Datapoint(s)\n", id, n)
+
 	if n != 0 {
-		if err := this.db.Write(this.wo, levelBatch); err != nil {
-			this.logger.Println(err)
+		start := time.Now()
+		err := this.db.Write(this.wo, levelBatch)
+		if err != nil {
+			this.logger.Limited("flush").Errorf("(%02d) flushing %d Datapoint(s) failed: %v", id, n, err)
+			recordWriteFailure()
+		}
+		if stats != nil {
+			stats.RecordFlush(uint32(n), uint32(time.Since(start)/1000), err != nil)
 		}
 	}
 
@@ -172,7 +206,7 @@ func (this *shard) _flush(batch *writeBatch, id uint8) {
 
 /* Create a new background writer */
 func (this *shard) newWriter(wchan <-chan triplet, id uint8) *shard_writer {
-	retval := shard_writer{this, wchan, make(chan bool), id}
+	retval := shard_writer{this, wchan, make(chan bool), id, make(chan chan bool)}
 	go retval._write_loop()
 	this.writers.PushBack(&retval)
 	return &retval
@@ -181,34 +215,24 @@ func (this *shard) newWriter(wchan <-chan triplet, id uint8) *shard_writer {
 /* Retrieve all sets of values associated with a given metric for a given
 time range */
 func (this *shard) dataScan(key *metricIndex, start uint64, end uint64) []Datapoint {
-	start_key := keyString(key.key, start)
-	end_key := keyString(key.key, end)
+	if retval := this.multiScan([]*metricIndex{key}, start, end); retval != nil {
+		return retval[0]
+	}
+	return make([]Datapoint, 0)
+}
 
+/* dataScan for several metrics over a single iterator; keys are best sorted
+by short code, so the iterator only ever moves forward. Nil once the shard is
+released */
+func (this *shard) multiScan(keys []*metricIndex, start uint64, end uint64) [][]Datapoint {
+	this.busy.RLock()
+	defer this.busy.RUnlock()
+	if this.released {
+		return nil
+	}
 	it := this.db.NewIterator(this.ro)
 	defer it.Close()
-
-	retval := make([]Datapoint, 0, 100)
-
-	/* Levigo lacks a range scan; it only has a full scan operation. However, it
-	is possible to inexpensively seek to a given point, hence we use that to control
-	the startig point of a scan
-	*/
-	it.Seek(start_key)
-	for it = it; it.Valid(); it.Next() {
-		k := it.Key()
-
-		/* We all need to terminate the end of range scan; else it would proceeed
-		till the end of the tree index */
-		if bytes.Compare(k, end_key) > 0 {
-			break
-		}
-
-		vb := it.Value()
-		val := readVal(vb)
-		retval = append(retval, Datapoint{extractTsFromFullKey(k), val})
-	}
-
-	return retval
+	return scanMany(this.codec, it, this.logger, keys, start, end)
 }
 
 /* Schedule a value for writing. This operation might fail if the writer pipelines
@@ -221,14 +245,76 @@ func (this *shard) insert(key *metricIndex, ts uint64, val float64) bool {
 	}()
 
 	this.wchan <- triplet{key, Datapoint{ts, val}}
+	atomic.StoreInt64(&this.last_write, time.Now().UnixNano())
 	return true
 }
 
+/* Writes datapoints straight to leveldb in a single batch, bypassing the
+writers & their queue; the caller is expected to have sorted them by short
+code & time. Fails once the shard is released */
+func (this *shard) bulkWrite(points []triplet) error {
+	this.busy.RLock()
+	defer this.busy.RUnlock()
+	if this.released {
+		return errShardReleased
+	}
+	atomic.StoreInt64(&this.last_write, time.Now().UnixNano())
+
+	levelBatch := levigo.NewWriteBatch()
+	defer levelBatch.Close()
+	if this.codec.exclusive() {
+		this.flush_lock.Lock()
+		defer this.flush_lock.Unlock()
+	}
+	this.codec.encode(this, levelBatch, points)
+	if err := this.db.Write(this.wo, levelBatch); err != nil {
+		this.logger.Limited("bulk").Errorf("bulk write of %d Datapoint(s) failed: %v", len(points), err)
+		recordWriteFailure()
+		return err
+	}
+	return nil
+}
+
+/* Number of files at level 0 of the LSM tree; leveldb slows down & then
+stalls writes as these pile up ahead of compactions */
+func (this *shard) level0Files() int {
+	this.busy.RLock()
+	defer this.busy.RUnlock()
+	if this.released {
+		return 0
+	}
+	n, _ := strconv.Atoi(this.db.PropertyValue("leveldb.num-files-at-level0"))
+	return n
+}
+
+/* Forces every writer to drain what has been queued so far and flush it.
+Blocks till all the writers are done; not to be invoked post release */
+func (this *shard) flush() {
+	for e := this.writers.Front(); e != nil; e = e.Next() {
+		var w *shard_writer = e.Value.(*shard_writer)
+		ack := make(chan bool, 1)
+		select {
+		case w.flush <- ack:
+			<-ack
+		case <-w.end:
+		}
+	}
+}
+
+/* Time elapsed since the last datapoint was accepted for writing */
+func (this *shard) idleFor() time.Duration {
+	last := atomic.LoadInt64(&this.last_write)
+	if last == 0 {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Since(time.Unix(0, last))
+}
+
 /* The background writer function */
 func (this *shard_writer) _write_loop() {
 	foo := new(writeBatch)
 	config := this.s.config
-	foo.data = make([]msg, config.Write_batch_size)
+	foo.data = make([]triplet, config.Write_batch_size)
 
 	timeout := time.Tick(config.Write_batch_fill_timeout)
 
@@ -236,23 +322,97 @@ func (this *shard_writer) _write_loop() {
 		select {
 		case x, ok := <-this.c:
 			if ok {
-				var blob msg
-				blob.key = keyString(x.key.key, rounder(x.val.Timestamp, x.key.step_in_seconds))
-				blob.val = writeVal(x.val.Value)
 				if foo.next == config.Write_batch_size {
 					this.s._flush(foo, this.id)
 				}
-				foo.data[foo.next] = blob
+				foo.data[foo.next] = x
 				foo.next++
 			}
 		case <-timeout:
 			this.s._flush(foo, this.id)
+		case ack := <-this.flush:
+			this._drain(foo)
+			this.s._flush(foo, this.id)
+			ack <- true
 		case <-this.end:
 			return
 		}
 	}
 }
 
+/* Moves whatever is queued at this instant into the batch */
+func (this *shard_writer) _drain(batch *writeBatch) {
+	config := this.s.config
+	for n := len(this.c); n > 0; n-- {
+		x, ok := <-this.c
+		if !ok {
+			return
+		}
+		if batch.next == config.Write_batch_size {
+			this.s._flush(batch, this.id)
+		}
+		batch.data[batch.next] = x
+		batch.next++
+	}
+}
+
+func makeMsg(x triplet) msg {
+	var blob msg
+	blob.key = keyString(x.key.key, rounder(x.val.Timestamp, x.key.step_in_seconds))
+	blob.val = writeVal(x.val.Value)
+	return blob
+}
+
 func defaultShardConfig() shard_config {
-	return shard_config{_DATA_CACHE_SIZE, _BATCH_SIZE, time.Duration(_BATCH_TIME_SECONDS) * time.Second, _CONCURRENT_WRITERS}
+	return shard_config{_DATA_CACHE_SIZE, _BATCH_SIZE, time.Duration(_BATCH_TIME_SECONDS) * time.Second, _CONCURRENT_WRITERS, _WRITE_QUEUE_LENGTH, SERIALIZATION_TECHNIQUE, false}
+}
+
+/* Works out the codec of a shard from its stamp. New shards are stamped with
+the codec configured while existing unstamped ones are stamped with the
+layout they were written in, or merely read as such when left unstamped */
+func (this *shard) _initSchema(exists bool, codec string, unstamped bool) error {
+	magic, err := this.db.Get(this.ro, []byte(SCHEME_MAGIC_ID))
+	if err != nil {
+		return err
+	}
+
+	if magic == nil && exists && !this._empty() && unstamped {
+		magic = []byte(SERIALIZATION_TECHNIQUE)
+	}
+	if magic == nil {
+		if exists && !this._empty() {
+			this.logger.Warnf("shard lacks a schema stamp; stamping it as %q", SERIALIZATION_TECHNIQUE)
+			codec = SERIALIZATION_TECHNIQUE
+		}
+		if _, ok := codecs[codec]; !ok {
+			return fmt.Errorf("no codec by the name of %q", codec)
+		}
+		if err := this.db.Put(this.wo, []byte(SCHEME_MAGIC_ID), []byte(codec)); err != nil {
+			return err
+		}
+		magic = []byte(codec)
+	}
+
+	c, ok := codecs[string(magic)]
+	if !ok {
+		return fmt.Errorf("shard is stamped with %q, which is not a known codec", magic)
+	}
+	this.codec = c
+	this.codec_name = string(magic)
+	return nil
+}
+
+func (this *shard) _empty() bool {
+	it := this.db.NewIterator(this.ro)
+	defer it.Close()
+	it.SeekToFirst()
+	return !it.Valid()
+}
+
+/* A short name for a shard to tag its logs & metrics with; the reverse
+of _shard_namer for the shards managed by the federator */
+func _shard_label(fs_path string) string {
+	name := filepath.Base(fs_path)
+	name = strings.TrimPrefix(name, "tsd-data-")
+	return strings.TrimSuffix(name, ".db")
 }
@@ -0,0 +1,379 @@
+package leveltsd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jmhodges/levigo"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+A snapshot is a directory holding a consistent copy of every db of a root,
+laid out just as the root is, along with a manifest. The open shards are
+flushed first; then the indices & the open shards are copied from leveldb
+snapshots taken together while index writes & the opening of shards are
+briefly held off, and the manifest lists them as of that moment. Datapoints
+queued after the flush are left out. Open shards are kept from eviction
+only till their copies are done. Shards that are not open are copied
+afterwards, as they are not being written to; should one be written to in
+the meantime, its copy may hold datapoints newer than the snapshot.
+Archives are immutable and get hard linked where possible.
+
+The manifest is written last; a snapshot without one is incomplete
+*/
+const SNAPSHOT_VERSION = 1
+
+const SNAPSHOT_MANIFEST = "MANIFEST.json"
+
+/* Kinds of the entries of a snapshot */
+const (
+	SNAPSHOT_INDEX   = "index"
+	SNAPSHOT_SHARD   = "shard"
+	SNAPSHOT_ARCHIVE = "archive"
+)
+
+var errSnapshotDest = errors.New("snapshot destination must be an absolute path")
+var errSnapshotExists = errors.New("snapshot destination already exists")
+var errRestoreNotEmpty = errors.New("root holds leveltsd data; restore with force to replace it")
+
+type SnapshotEntry struct {
+	Name    string // relative to the root
+	Kind    string
+	Records uint64 // keys of a db
+	Bytes   int64  // size of an archive
+}
+
+type SnapshotManifest struct {
+	Version int
+	Created time.Time
+	Root    string
+	Entries []SnapshotEntry
+}
+
+/* A db to be copied from a leveldb snapshot */
+type snapshotSource struct {
+	name string
+	kind string
+	db   *levigo.DB
+	snap *levigo.Snapshot
+}
+
+/* Takes a snapshot of a live root into dest, which must not exist */
+func (this *levelfederator) snapshot(dest string) (*SnapshotManifest, error) {
+	if !filepath.IsAbs(dest) {
+		return nil, errSnapshotDest
+	}
+	if err := os.Mkdir(dest, 0755); err != nil {
+		if os.IsExist(err) {
+			return nil, errSnapshotExists
+		}
+		return nil, err
+	}
+
+	/* Archival would pull shards out from under the copy */
+	this.snapshotLock.Lock()
+	defer this.snapshotLock.Unlock()
+
+	/* Ahead of holding anything off, for the snapshots to hold what has
+	been queued thus far */
+	this.flushAll()
+
+	retval := &SnapshotManifest{Version: SNAPSHOT_VERSION, Root: this.config.Basedir}
+	copied, err := this._copySnapshots(this._quiesce(retval), dest, retval)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range this.diskShards() {
+		name := filepath.Base(_shard_namer("", id))
+		if copied[name] {
+			continue
+		}
+		n, err := this._copyShard(id, filepath.Join(dest, name))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		retval.Entries = append(retval.Entries, SnapshotEntry{name, SNAPSHOT_SHARD, n, 0})
+	}
+
+	this.archiveLock.RLock()
+	archives := make([]*archive, 0, len(this.archives))
+	for _, a := range this.archives {
+		archives = append(archives, a)
+	}
+	this.archiveLock.RUnlock()
+	for _, a := range archives {
+		name := filepath.Base(a.path)
+		if err := linkOrCopy(a.path, filepath.Join(dest, name)); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		retval.Entries = append(retval.Entries, SnapshotEntry{name, SNAPSHOT_ARCHIVE, 0, a.size})
+	}
+
+	sort.Slice(retval.Entries, func(i, j int) bool { return retval.Entries[i].Name < retval.Entries[j].Name })
+	return retval, writeManifest(dest, retval)
+}
+
+/* Takes leveldb snapshots of the open shards & the indices, all while index
+writes & the opening of shards are held off; no more than that is done under
+the locks. Open shards stay open, rather than being evicted, till pinned is
+cleared */
+func (this *levelfederator) _quiesce(manifest *SnapshotManifest) []snapshotSource {
+	this.idx.writeLock.Lock()
+	defer this.idx.writeLock.Unlock()
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+
+	manifest.Created = time.Now().UTC()
+	this.pinned = true
+
+	retval := []snapshotSource{
+		{"tsd-dir.db", SNAPSHOT_INDEX, this.idx.dir, this.idx.dir.NewSnapshot()},
+		{"tsd-map.db", SNAPSHOT_INDEX, this.idx.pkey, this.idx.pkey.NewSnapshot()},
+	}
+	for id, s := range this.shards {
+		name := filepath.Base(_shard_namer("", id))
+		retval = append(retval, snapshotSource{name, SNAPSHOT_SHARD, s.db, s.db.NewSnapshot()})
+	}
+	return retval
+}
+
+/* Copies the dbs of the leveldb snapshots taken by _quiesce, then releases
+the snapshots & unpins the open shards, copied or not; returns the names
+copied */
+func (this *levelfederator) _copySnapshots(sources []snapshotSource, dest string, manifest *SnapshotManifest) (map[string]bool, error) {
+	defer func() {
+		for _, src := range sources {
+			src.db.ReleaseSnapshot(src.snap)
+		}
+		this.writeLock.Lock()
+		this.pinned = false
+		this.writeLock.Unlock()
+	}()
+
+	retval := make(map[string]bool)
+	for _, src := range sources {
+		n, err := copyDb(src.db, src.snap, filepath.Join(dest, src.name))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", src.name, err)
+		}
+		manifest.Entries = append(manifest.Entries, SnapshotEntry{src.name, src.kind, n, 0})
+		retval[src.name] = true
+	}
+	return retval, nil
+}
+
+/* Copies a shard that was not open when the snapshot was taken. It is read
+through a read handle, or its write handle if it has since been opened for
+writes, but never opened for writes here */
+func (this *levelfederator) _copyShard(id string, fs_path string) (uint64, error) {
+	for {
+		s := this._readShard(id)
+		if s == nil {
+			return 0, errors.New("cannot be opened")
+		}
+		s.busy.RLock()
+		if s.released {
+			/* Evicted in the meantime */
+			s.busy.RUnlock()
+			continue
+		}
+		snap := s.db.NewSnapshot()
+		n, err := copyDb(s.db, snap, fs_path)
+		s.db.ReleaseSnapshot(snap)
+		s.busy.RUnlock()
+		return n, err
+	}
+}
+
+/* Copies what a leveldb snapshot holds into a new db. Returns the number of
+keys copied */
+func copyDb(src *levigo.DB, snap *levigo.Snapshot, fs_path string) (uint64, error) {
+	opts := levigo.NewOptions()
+	defer opts.Close()
+	opts.SetCreateIfMissing(true)
+	opts.SetErrorIfExists(true)
+	db, err := levigo.Open(fs_path, opts)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	ro.SetFillCache(false)
+	ro.SetSnapshot(snap)
+	wo := levigo.NewWriteOptions()
+	defer wo.Close()
+	wo.SetSync(true)
+
+	it := src.NewIterator(ro)
+	defer it.Close()
+
+	var n uint64
+	batch := levigo.NewWriteBatch()
+	defer batch.Close()
+	pending := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		batch.Put(it.Key(), it.Value())
+		n++
+		if pending++; pending == _BATCH_SIZE {
+			if err := db.Write(wo, batch); err != nil {
+				return n, err
+			}
+			batch.Clear()
+			pending = 0
+		}
+	}
+	if err := it.GetError(); err != nil {
+		return n, err
+	}
+	return n, db.Write(wo, batch)
+}
+
+func linkOrCopy(src string, dest string) error {
+	if err := os.Link(src, dest); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+func writeManifest(dir string, manifest *SnapshotManifest) error {
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, SNAPSHOT_MANIFEST+".tmp")
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, SNAPSHOT_MANIFEST))
+}
+
+func readManifest(dir string) (*SnapshotManifest, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, SNAPSHOT_MANIFEST))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s lacks a manifest; the snapshot is incomplete", dir)
+		}
+		return nil, err
+	}
+	retval := new(SnapshotManifest)
+	if err := json.Unmarshal(b, retval); err != nil {
+		return nil, fmt.Errorf("%s: %v", SNAPSHOT_MANIFEST, err)
+	}
+	if retval.Version != SNAPSHOT_VERSION {
+		return nil, fmt.Errorf("snapshot version %d is not supported", retval.Version)
+	}
+	return retval, nil
+}
+
+/* Takes a snapshot of a root that no daemon is running on */
+func Snapshot(root string, dest string) (*SnapshotManifest, error) {
+	f, err := openFederator(parseConfig(map[string]string{"root": root}))
+	if err != nil {
+		return nil, fmt.Errorf("%v; snapshot a running daemon over its admin port instead", err)
+	}
+	defer f.release()
+
+	return f.snapshot(dest)
+}
+
+/* Names of the leveltsd dbs & archives under a root */
+func rootEntries(root string) []string {
+	retval := make([]string, 0)
+	for _, pattern := range []string{"tsd-dir.db", "tsd-map.db", "tsd-data-*.db", "tsd-archive-*.arc"} {
+		paths, _ := filepath.Glob(filepath.Join(root, pattern))
+		for _, p := range paths {
+			retval = append(retval, filepath.Base(p))
+		}
+	}
+	return retval
+}
+
+/*
+Restores a snapshot into a root that no daemon is running on. A root already
+holding leveltsd data is only written to with force set, in which case that
+data is deleted first. Every db is copied key by key & the number of keys
+checked against the manifest
+*/
+func Restore(snapshot string, root string, force bool) (*SnapshotManifest, error) {
+	manifest, err := readManifest(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+
+	existing := rootEntries(root)
+	if len(existing) > 0 {
+		if !force {
+			return nil, errRestoreNotEmpty
+		}
+		idx, _ := mkIndex(root)
+		if idx == nil {
+			return nil, errors.New("cannot open the indices; is the daemon running?")
+		}
+		idx.release()
+		for _, name := range existing {
+			if err := os.RemoveAll(filepath.Join(root, name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for _, e := range manifest.Entries {
+		if strings.ContainsRune(e.Name, filepath.Separator) {
+			return nil, fmt.Errorf("%s: not a name of the root", e.Name)
+		}
+		src, dest := filepath.Join(snapshot, e.Name), filepath.Join(root, e.Name)
+		if e.Kind == SNAPSHOT_ARCHIVE {
+			if err := linkOrCopy(src, dest); err != nil {
+				return nil, fmt.Errorf("%s: %v", e.Name, err)
+			}
+			if stat, err := os.Stat(dest); err != nil || stat.Size() != e.Bytes {
+				return nil, fmt.Errorf("%s: size differs from the manifest", e.Name)
+			}
+			continue
+		}
+
+		opts := levigo.NewOptions()
+		db, err := levigo.Open(src, opts)
+		opts.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", e.Name, err)
+		}
+		snap := db.NewSnapshot()
+		n, err := copyDb(db, snap, dest)
+		db.ReleaseSnapshot(snap)
+		db.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", e.Name, err)
+		}
+		if n != e.Records {
+			return nil, fmt.Errorf("%s: %d key(s) where the manifest lists %d", e.Name, n, e.Records)
+		}
+	}
+	return manifest, nil
+}
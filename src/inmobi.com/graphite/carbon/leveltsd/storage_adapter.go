@@ -1,20 +1,49 @@
 package leveltsd
 
 import (
+	"inmobi.com/graphite/carbon/admin"
+	"inmobi.com/graphite/carbon/audit"
+	"inmobi.com/graphite/carbon/health"
 	"inmobi.com/graphite/carbon/mq"
 	"inmobi.com/graphite/carbon/storage"
+	"net/http"
 	"strconv"
+	"sync"
 )
 
 type LevelDbStorage struct {
 	federator *levelfederator
+	lock      sync.RWMutex // guards federator against the health checks
+	backfill  *backfiller  // nil unless a backfill port is configured
 }
 
 func (this *LevelDbStorage) Init(config map[string]string) {
-	this.federator = buildStorage(config)
+	health.Register("leveltsd-index", this.whenOpen((*levelfederator).checkIndex))
+	health.Register("leveltsd-writes", this.whenOpen((*levelfederator).checkWrites))
+	health.Register("leveltsd-disk", this.whenOpen((*levelfederator).checkDisk))
+
+	federator := buildStorage(config)
+	this.lock.Lock()
+	this.federator = federator
+	this.lock.Unlock()
+
+	audit.RegisterCollector("leveldb", this.federator.auditStats)
+	registerAdminEndpoints(this.federator)
+	admin.RegisterConfig("leveltsd", federator.config)
 	port, _ := strconv.Atoi(config["reader-port"])
 	reader := make_rpc_server(this.federator, uint16(port))
 	go reader()
+
+	if federator.config.Backfill.Port != 0 {
+		backfill, err := startBackfill(federator)
+		if err != nil {
+			fLogger.Panicf("cannot listen for backfill: %v", err)
+		}
+		this.backfill = backfill
+		admin.HandleJSON("/backfill", func(r *http.Request) (interface{}, error) {
+			return backfill.getStats(), nil
+		})
+	}
 }
 
 func (this *LevelDbStorage) GetMetric(metric string) (interface{}, bool) {
@@ -30,10 +59,31 @@ func (this *LevelDbStorage) UncheckedWrite(lookupRef interface{}, x mq.MetricRea
 }
 
 func (this *LevelDbStorage) Release() {
+	if this.backfill != nil {
+		this.backfill.close()
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
 	this.federator.release()
 	this.federator = nil
 }
 
+/* Adapts a federator check into a health check; it fails whenever there
+is no federator, i.e. while it is being built or post release */
+func (this *LevelDbStorage) whenOpen(check func(*levelfederator) error) health.Check {
+	return func() error {
+		this.lock.RLock()
+		defer this.lock.RUnlock()
+
+		if this.federator == nil {
+			return errIndexClosed
+		}
+		return check(this.federator)
+	}
+}
+
 func init() {
 	x := LevelDbStorage{}
 	storage.RegisterAdapter("leveltsd", &x)
@@ -3,6 +3,7 @@ package leveltsd
 import (
 	"bytes"
 	"github.com/stretchr/testify/assert"
+	"math"
 	"testing"
 )
 
@@ -30,3 +31,44 @@ func TestOrderability(t *testing.T) {
 
 	assert.Equal(t, bytes.Compare(x1, y1), 1)
 }
+
+func TestGorillaReversibility(t *testing.T) {
+	points := []Datapoint{
+		{3600, 1.5},
+		{3660, 1.5},
+		{3720, 1.5},
+		{3780, -2},
+		{3790, 1e300},    // an irregular step
+		{3791, 0},        // a negative delta of delta
+		{4500, 0.1},      // a long gap
+		{9000000000, 42}, // beyond what the 12 bit bucket holds
+		{9000000001, math.Inf(1)},
+		{9000000002, math.SmallestNonzeroFloat64},
+	}
+	for n := 0; n <= len(points); n++ {
+		res, err := decodeBlock(encodeBlock(points[:n]))
+		assert.Nil(t, err)
+		assert.Equal(t, res, points[:n])
+	}
+
+	res, err := decodeBlock(encodeBlock([]Datapoint{{60, math.NaN()}, {120, 1}}))
+	assert.Nil(t, err)
+	assert.True(t, math.IsNaN(res[0].Value))
+	assert.Equal(t, res[1], Datapoint{120, 1})
+
+	_, err = decodeBlock(encodeBlock(points)[:20])
+	assert.Equal(t, err, errCorruptBlock)
+
+	/* Cut short within the first datapoint */
+	res, err = decodeBlock(encodeBlock(points[:1])[:10])
+	assert.Equal(t, err, errCorruptBlock)
+	assert.Equal(t, len(res), 0)
+}
+
+func TestGorillaSize(t *testing.T) {
+	points := make([]Datapoint, 60)
+	for i := range points {
+		points[i] = Datapoint{uint64(3600 + 60*i), float64(1000 + i%3)}
+	}
+	assert.True(t, len(encodeBlock(points)) < 2*len(points))
+}
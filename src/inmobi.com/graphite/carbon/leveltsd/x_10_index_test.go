@@ -1,8 +1,12 @@
 package leveltsd
 
 import (
+	"fmt"
+	"github.com/jmhodges/levigo"
 	"github.com/stretchr/testify/assert"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestSimpleOpen(t *testing.T) {
@@ -204,3 +208,197 @@ func TestBan(t *testing.T) {
 	n := len(children)
 	assert.Equal(t, n, 0, "child count mismatch")
 }
+
+func TestLegacyDirMigration(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	/* Lay out a directory db the way the python implementation did */
+	opts := levigo.NewOptions()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(dir+"/tsd-dir.db", opts)
+	assert.Nil(t, err)
+	wo := levigo.NewWriteOptions()
+	db.Put(wo, []byte(""), []byte(`["animal","plant"]`))
+	db.Put(wo, []byte("animal"), []byte(`["cat","dog"]`))
+	db.Put(wo, []byte("plant"), []byte(`["fern"]`))
+	for i := 0; i < _DIR_MIGRATION_BATCH*2; i++ {
+		db.Put(wo, []byte(fmt.Sprintf("bulk%05d", i)), []byte(`["x"]`))
+	}
+	db.Close()
+	wo.Close()
+	opts.Close()
+
+	index, err := mkIndex(dir)
+	assert.Nil(t, err)
+
+	_, ok := index.getMetric("animal.cow", true)
+	assert.True(t, ok)
+
+	for i := 0; i < 100 && atomic.LoadInt32(&index.migrated) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, atomic.LoadInt32(&index.migrated), int32(1))
+
+	assert.Equal(t, index.listChildern(""), []string{"animal", "plant"})
+	assert.Equal(t, index.listChildern("animal"), []string{"cat", "cow", "dog"})
+	assert.Equal(t, index.listChildern("plant"), []string{"fern"})
+	assert.Equal(t, index.listChildern("bulk01999"), []string{"x"})
+	index.release()
+
+	index, err = mkIndex(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, index.migrated, int32(1))
+	assert.Equal(t, index.listChildern("animal"), []string{"cat", "cow", "dog"})
+	index.release()
+}
+
+func TestManyChildren(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+	index, err := mkIndex(dir)
+	assert.Nil(t, err)
+
+	n := 5000
+	for i := 0; i < n; i++ {
+		_, ok := index.getMetric(fmt.Sprintf("servers.host%05d.cpu", i), true)
+		assert.True(t, ok)
+	}
+	children := index.listChildern("servers")
+	assert.Equal(t, len(children), n)
+	assert.Equal(t, children[0], "host00000")
+	assert.Equal(t, index.listChildern("servers.host00042"), []string{"cpu"})
+	assert.Equal(t, len(index.listChildern("servers.host0004")), 0)
+}
+
+func TestShortcodeCollision(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+	index, err := mkIndex(dir)
+	assert.Nil(t, err)
+	defer index.release()
+
+	first, ok := index.getMetric("a.b", true)
+	assert.True(t, ok)
+	owner, _ := index._codeOwner(first.key)
+	assert.Equal(t, owner, "a.b")
+
+	/* Pretend another name hashes onto the same code */
+	index.pkey.Put(index.wo, codeKey(shortenMetricName([]byte("c.d"))), []byte("a.b"))
+	second, ok := index.getMetric("c.d", true)
+	assert.True(t, ok)
+	assert.NotEqual(t, second.key, shortenMetricName([]byte("c.d")))
+	owner, _ = index._codeOwner(second.key)
+	assert.Equal(t, owner, "c.d")
+
+	events := index.naming.list()
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].Kind, namingCollision)
+	assert.Equal(t, events[0].Metric, "c.d")
+	assert.Equal(t, events[0].Other, "a.b")
+}
+
+func TestScrubAlias(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+	index, err := mkIndex(dir)
+	assert.Nil(t, err)
+	defer index.release()
+
+	first, ok := index.getMetric("web.host*1", true)
+	assert.True(t, ok)
+	_, ok = index.getMetric("web.host*1", false)
+	assert.True(t, ok)
+	assert.Equal(t, len(index.naming.list()), 0)
+
+	second, ok := index.getMetric("web.host?1", false)
+	assert.True(t, ok)
+	assert.Equal(t, second.key, first.key)
+	index.getMetric("web.host?1", false)
+
+	events := index.naming.list()
+	assert.Equal(t, len(events), 1, "a raw name is reported once")
+	assert.Equal(t, events[0].Kind, namingScrubAlias)
+	assert.Equal(t, events[0].Metric, "web.host?1")
+	assert.Equal(t, events[0].Other, "web.host*1")
+}
+
+func TestReverseMapBackfill(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	/* Lay out a map db predating the reverse map */
+	opts := levigo.NewOptions()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(dir+"/tsd-map.db", opts)
+	assert.Nil(t, err)
+	wo := levigo.NewWriteOptions()
+	for i := 0; i < _CODE_BACKFILL_BATCH*2; i++ {
+		m := fmt.Sprintf("bulk.m%05d", i)
+		db.Put(wo, []byte(m), shortenMetricName([]byte(m)))
+	}
+	db.Put(wo, []byte("merged"), shortenMetricName([]byte("bulk.m00000")))
+	db.Close()
+	wo.Close()
+	opts.Close()
+
+	index, err := mkIndex(dir)
+	assert.Nil(t, err)
+
+	ro := levigo.NewReadOptions()
+	defer ro.Close()
+	for i := 0; i < 100; i++ {
+		if done, _ := index.pkey.Get(ro, []byte(_MAP_CODES_KEY)); done != nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	done, _ := index.pkey.Get(ro, []byte(_MAP_CODES_KEY))
+	assert.Equal(t, string(done), _MAP_CODES_COMPLETE)
+
+	owner, _ := index._codeOwner(shortenMetricName([]byte("bulk.m01999")))
+	assert.Equal(t, owner, "bulk.m01999")
+
+	events := index.naming.list()
+	assert.Equal(t, len(events), 1)
+	assert.Equal(t, events[0].Metric, "merged")
+	assert.Equal(t, events[0].Other, "bulk.m00000")
+	index.release()
+}
+
+func TestGlobMetrics(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+	index, err := mkIndex(dir)
+	assert.Nil(t, err)
+	defer index.release()
+
+	for _, m := range []string{"a.b.c", "a.b.d", "a.bb.c", "a.x.c", "b.b.c", "a.b"} {
+		_, ok := index.getMetric(m, true)
+		assert.True(t, ok)
+	}
+	glob := func(pattern string) []string {
+		retval := make([]string, 0)
+		assert.Nil(t, index.globMetrics(pattern, func(metric string) bool {
+			retval = append(retval, metric)
+			return true
+		}))
+		return retval
+	}
+
+	assert.Equal(t, glob("a.b.*"), []string{"a.b.c", "a.b.d"})
+	assert.Equal(t, glob("a.*.c"), []string{"a.b.c", "a.bb.c", "a.x.c"})
+	assert.Equal(t, glob("*.b.c"), []string{"a.b.c", "b.b.c"})
+	assert.Equal(t, glob("a.{b,x}.c"), []string{"a.b.c", "a.x.c"})
+	assert.Equal(t, glob("a.b?.[a-c]"), []string{"a.bb.c"})
+	assert.Equal(t, glob("a.*"), []string{"a.b"}, "only leaves are matched")
+	assert.Equal(t, glob("a.b.c.d"), []string{})
+	assert.NotNil(t, index.globMetrics("a.[b", func(string) bool { return true }))
+
+	n := 0
+	index.globMetrics("*.*.*", func(string) bool { n++; return n < 2 })
+	assert.Equal(t, n, 2)
+
+	assert.Equal(t, expandBraces("x{a,b}y{1,2}"), []string{"xay1", "xay2", "xby1", "xby2"})
+	assert.Equal(t, expandBraces("x{a"), []string{"x{a"})
+}
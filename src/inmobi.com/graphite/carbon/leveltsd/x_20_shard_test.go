@@ -1,7 +1,11 @@
 package leveltsd
 
 import (
+	"github.com/jmhodges/levigo"
 	"github.com/stretchr/testify/assert"
+	"inmobi.com/graphite/carbon/audit"
+	"inmobi.com/graphite/carbon/mq"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -298,9 +302,185 @@ func TestMultiQuantumWrite(t *testing.T) {
 	assert.Equal(t, res[2].Value, val2)
 }
 
+func TestFlushStats(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	audit.InitMetrics(make(chan mq.MetricReading, 1000), func() audit.StoragePipelineDepths {
+		return audit.StoragePipelineDepths{}
+	})
+
+	index, err := mkIndex(dir)
+	assert.Nil(t, err)
+
+	key, ok := index.getMetric("foo.bar", true)
+	assert.True(t, ok)
+
+	s, err := mkShard(dir+"/tsd-data-20140101.db", true, defcon)
+	assert.Nil(t, err)
+	defer s.release()
+
+	assert.Equal(t, s.label, "20140101")
+
+	ok = s.insert(key, 92, 3.4)
+	ok = s.insert(key, 192, 3.4)
+	assert.True(t, ok)
+
+	time.Sleep(defcon.Write_batch_fill_timeout * 3 / 2) // This is a bit hokey
+
+	var flushes, points uint64
+	for i := uint8(0); i < defcon.Write_concurrency; i++ {
+		stats := audit.GetMetrics().FlushStats(s.label, i)
+		flushes += uint64(atomic.LoadUint32(&stats.Flushes))
+		points += atomic.LoadUint64(&stats.Batch_size.Total)
+		assert.Equal(t, atomic.LoadUint32(&stats.Flush_errors), uint32(0))
+	}
+	assert.True(t, flushes >= 1)
+	assert.Equal(t, points, uint64(2))
+}
+
 func TestCreateFail(t *testing.T) {
 	for i := 0; i < 1000 * 1000; i++ {
 		_, err := mkShard("/this-should-not-work/foo/bar", true, defcon)
 		assert.NotNil(t, err)
 	}
 }
+
+func TestSchemaStamp(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	s, err := mkShard(dir+"/mt", true, defcon)
+	assert.Nil(t, err)
+	magic, _ := s.db.Get(s.ro, []byte(SCHEME_MAGIC_ID))
+	assert.Equal(t, string(magic), SERIALIZATION_TECHNIQUE)
+	s.release()
+
+	config := defcon
+	config.Codec = "no such codec"
+	_, err = mkShard(dir+"/other", true, config)
+	assert.NotNil(t, err, "new shards need a known codec")
+}
+
+func TestSchemaLegacyUnstamped(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	/* As written by earlier versions */
+	opts := levigo.NewOptions()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(dir+"/mt", opts)
+	assert.Nil(t, err)
+	wo := levigo.NewWriteOptions()
+	db.Put(wo, keyString(shortenMetricName([]byte("foo")), 60), writeVal(42))
+	db.Close()
+	wo.Close()
+	opts.Close()
+
+	config := defcon
+	config.Codec = "no such codec"
+	s, err := mkShard(dir+"/mt", false, config)
+	assert.Nil(t, err)
+	defer s.release()
+
+	magic, _ := s.db.Get(s.ro, []byte(SCHEME_MAGIC_ID))
+	assert.Equal(t, string(magic), SERIALIZATION_TECHNIQUE)
+	data := s.dataScan(&metricIndex{"foo", shortenMetricName([]byte("foo")), 60}, 0, 120)
+	assert.Equal(t, data, []Datapoint{{60, 42}})
+}
+
+func TestSchemaMismatch(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	s, err := mkShard(dir+"/mt", true, defcon)
+	assert.Nil(t, err)
+	s.db.Put(s.wo, []byte(SCHEME_MAGIC_ID), []byte("struct pack >q"))
+	s.release()
+
+	s, err = mkShard(dir+"/mt", false, defcon)
+	assert.Nil(t, s)
+	assert.NotNil(t, err)
+}
+
+func TestGorillaShard(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	index, err := mkIndex(dir)
+	assert.Nil(t, err)
+	key, ok := index.getMetric("foo.bar", true)
+	assert.True(t, ok)
+	other, ok := index.getMetric("foo.baz", true)
+	assert.True(t, ok)
+
+	config := defcon
+	config.Codec = GORILLA_CODEC
+	s, err := mkShard(dir+"/mt", true, config)
+	assert.Nil(t, err)
+
+	s.insert(key, 7200, 2)
+	s.insert(key, 3600, 1)
+	s.insert(other, 3600, 9)
+	s.flush()
+
+	/* Merges into the existing block & overwrites */
+	s.insert(key, 3661, 1.5)
+	s.insert(key, 7200, 3)
+	s.flush()
+	s.release()
+
+	/* The stamp wins over the codec configured */
+	s, err = mkShard(dir+"/mt", false, defcon)
+	assert.Nil(t, err)
+	defer s.release()
+
+	assert.Equal(t, s.dataScan(key, 0, 10000), []Datapoint{{3600, 1}, {3660, 1.5}, {7200, 3}})
+	assert.Equal(t, s.dataScan(key, 3660, 7199), []Datapoint{{3660, 1.5}})
+	assert.Equal(t, s.dataScan(other, 0, 10000), []Datapoint{{3600, 9}})
+
+	n, _ := s.purge(key.key, true)
+	assert.Equal(t, n, uint64(2), "a key per block")
+}
+
+func TestArchiveRoundtrip(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	index, err := mkIndex(dir)
+	assert.Nil(t, err)
+	key, ok := index.getMetric("foo.bar", true)
+	assert.True(t, ok)
+	other, ok := index.getMetric("foo.baz", true)
+	assert.True(t, ok)
+
+	s, err := mkShard(dir+"/mt", true, defcon)
+	assert.Nil(t, err)
+	defer s.release()
+	for i := uint64(0); i < 5000; i++ {
+		s.insert(key, i*60, float64(i))
+		s.insert(other, i*60, float64(-i))
+	}
+	s.flush()
+
+	it := s.db.NewIterator(s.ro)
+	n, err := writeArchive(dir+"/mt.arc", it, make(chan bool))
+	it.Close()
+	assert.Nil(t, err)
+	assert.Equal(t, n, 10001, "datapoints & the scheme marker")
+
+	a, err := openArchive(dir + "/mt.arc")
+	assert.Nil(t, err)
+	assert.True(t, len(a.blocks) > 1)
+	for _, r := range [][2]uint64{{0, 300000}, {59, 61}, {100000, 200000}, {299940, 400000}} {
+		assert.Equal(t, a.dataScan(key, r[0], r[1]), s.dataScan(key, r[0], r[1]))
+		assert.Equal(t, a.dataScan(other, r[0], r[1]), s.dataScan(other, r[0], r[1]))
+	}
+
+	done := make(chan bool)
+	close(done)
+	it = s.db.NewIterator(s.ro)
+	_, err = writeArchive(dir+"/aborted.arc", it, done)
+	it.Close()
+	assert.Equal(t, err, errArchiveAborted)
+}
@@ -1,11 +1,20 @@
 package leveltsd
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"inmobi.com/graphite/carbon/mq"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"regexp"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -27,7 +36,8 @@ func TestShardCountLongshot(t *testing.T) {
 	t1 := time.Date(2009, time.November, 10, 23, 0, 0, 0, time.UTC)
 	t2 := time.Date(2019, time.March, 1, 23, 0, 0, 0, time.UTC)
 
-	s := _rangeShards(uint64(t1.Unix()), uint64(t2.Unix()))
+	day, _ := getPartitionScheme("day")
+	s := day.rangeShards(uint64(t1.Unix()), uint64(t2.Unix()))
 	assert.Equal(t, len(s), 3399)
 
 	var validID = regexp.MustCompile(`^[0-9]{8}$`)
@@ -41,7 +51,8 @@ func TestShardCountIntraday(t *testing.T) {
 	t1 := time.Date(2009, time.November, 10, 0, 0, 0, 0, time.UTC)
 	t2 := time.Date(2009, time.November, 10, 23, 59, 59, 0, time.UTC)
 
-	s := _rangeShards(uint64(t1.Unix()), uint64(t2.Unix()))
+	day, _ := getPartitionScheme("day")
+	s := day.rangeShards(uint64(t1.Unix()), uint64(t2.Unix()))
 	assert.Equal(t, len(s), 1)
 }
 
@@ -175,7 +186,8 @@ func TestShardNocreate(t *testing.T) {
 	start_time := uint64(t1.Unix())
 	end_time := uint64(t2.Unix())
 
-	s := _rangeShards(start_time, end_time)
+	day, _ := getPartitionScheme("day")
+	s := day.rangeShards(start_time, end_time)
 	assert.Equal(t, len(s), 3399)
 
 	for _, x := range s {
@@ -226,3 +238,1157 @@ func TestShardOpenfileDos(t *testing.T) {
 		}
 	}
 }
+
+func TestForcedFlush(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	config := make(map[string]string)
+	config["root"] = dir
+	config["write-batch-interval-seconds"] = "3600"
+
+	federator := buildStorage(config)
+	defer federator.release()
+
+	key, ok := federator.createMetric("foo.bar")
+	assert.True(t, ok)
+	assert.True(t, federator.uncheckedWrite(key, mq.MetricReading{"foo.bar", 1, 65}))
+
+	assert.Equal(t, federator.flushAll(), 1)
+	assert.Equal(t, len(federator.dataScan(key, 1, 1000)), 1)
+
+	/* Flushes alongside others holding the lock for shard lookups */
+	federator.writeLock.RLock()
+	assert.Equal(t, federator.flushAll(), 1)
+	federator.writeLock.RUnlock()
+}
+
+func TestCloseIdleShard(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	config := make(map[string]string)
+	config["root"] = dir
+	config["write-batch-interval-seconds"] = "1"
+
+	federator := buildStorage(config)
+	defer federator.release()
+
+	key, ok := federator.createMetric("foo.bar")
+	assert.True(t, ok)
+	assert.True(t, federator.uncheckedWrite(key, mq.MetricReading{"foo.bar", 1, 65}))
+
+	assert.Equal(t, federator.closeShard("19700102"), errShardNotOpen)
+	assert.Equal(t, federator.closeShard("19700101"), errShardBusy)
+
+	time.Sleep(_IDLE_BATCH_INTERVALS * time.Second * 3 / 2)
+
+	assert.Nil(t, federator.closeShard("19700101"))
+	assert.Equal(t, len(federator.openShards()), 0)
+	assert.Equal(t, len(federator.dataScan(key, 1, 1000)), 1)
+}
+
+func TestHealthChecks(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	config := make(map[string]string)
+	config["root"] = dir
+
+	federator := buildStorage(config)
+
+	assert.Nil(t, federator.checkIndex())
+	assert.Nil(t, federator.checkWrites())
+	assert.Nil(t, federator.checkDisk())
+
+	recordWriteFailure()
+	assert.NotNil(t, federator.checkWrites())
+	federator.config.Write_failure_window = 0
+	assert.Nil(t, federator.checkWrites())
+
+	federator.config.Min_free_disk_percent = 101
+	assert.NotNil(t, federator.checkDisk())
+
+	federator.release()
+	assert.Equal(t, federator.checkIndex(), errIndexClosed)
+}
+
+func TestDeleteSubtree(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	config := make(map[string]string)
+	config["root"] = dir
+
+	federator := buildStorage(config)
+	defer func() { federator.release() }()
+
+	for _, m := range []string{"a.b.c", "a.b.d", "a.e"} {
+		key, ok := federator.createMetric(m)
+		assert.True(t, ok)
+		assert.True(t, federator.uncheckedWrite(key, mq.MetricReading{m, 1, 65}))
+		assert.True(t, federator.uncheckedWrite(key, mq.MetricReading{m, 1, 86465}))
+	}
+	assert.Equal(t, federator.flushAll(), 2)
+
+	/* As written by earlier versions */
+	s := federator._getShardFromDate("19700101", false)
+	s.db.Delete(s.wo, []byte(SCHEME_MAGIC_ID))
+	federator.release()
+	federator = buildStorage(config)
+	c, _ := federator.getMetric("a.b.c")
+
+	_, err := federator.deleteMetric(&DeleteRequest{Path: "a.x"})
+	assert.Equal(t, err, errMetricNotFound)
+
+	report, err := federator.deleteMetric(&DeleteRequest{Path: "a.b", Subtree: true, PurgeData: true, DryRun: true})
+	assert.Nil(t, err)
+	assert.Equal(t, len(report.Metrics), 2)
+	assert.Equal(t, report.Shards, []string{"19700101", "19700102"})
+	assert.Equal(t, report.Datapoints, uint64(4))
+	assert.Equal(t, federator.idx.listChildern("a"), []string{"b", "e"})
+	assert.Equal(t, len(federator.dataScan(c, 1, 100000)), 2)
+	assert.Equal(t, len(federator.openShards()), 0, "shards are purged without being opened for writes")
+	h := federator.readers.handles["19700101"].s
+	magic, _ := h.db.Get(h.ro, []byte(SCHEME_MAGIC_ID))
+	assert.Nil(t, magic)
+
+	report, err = federator.deleteMetric(&DeleteRequest{Path: "a.b", Subtree: true, PurgeData: true})
+	assert.Nil(t, err)
+	assert.Equal(t, report.Datapoints, uint64(4))
+	assert.Equal(t, federator.idx.listChildern("a"), []string{"e"})
+	assert.Equal(t, len(federator.idx.listChildern("a.b")), 0)
+	_, ok := federator.getMetric("a.b.c")
+	assert.False(t, ok)
+	assert.Equal(t, len(federator.dataScan(c, 1, 100000)), 0)
+
+	/* Removing the last leaf prunes the empty parent as well */
+	report, err = federator.deleteMetric(&DeleteRequest{Path: "a.e"})
+	assert.Nil(t, err)
+	assert.Equal(t, report.Nodes, []string{"a.e", "a"})
+	assert.Equal(t, len(federator.idx.listChildern("")), 0)
+}
+
+func TestRenameSubtree(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	config := make(map[string]string)
+	config["root"] = dir
+
+	federator := buildStorage(config)
+	defer federator.release()
+
+	for _, m := range []string{"old.x.cpu", "old.x.mem", "keep.y"} {
+		key, ok := federator.createMetric(m)
+		assert.True(t, ok)
+		assert.True(t, federator.uncheckedWrite(key, mq.MetricReading{m, 1, 65}))
+	}
+	federator.flushAll()
+
+	_, err := federator.renameMetric(&RenameRequest{From: "old.x", To: "keep", Subtree: true})
+	assert.Equal(t, err, errRenameConflict)
+	_, err = federator.renameMetric(&RenameRequest{From: "old", To: "old.z", Subtree: true})
+	assert.Equal(t, err, errRenameInvalid)
+
+	report, err := federator.renameMetric(&RenameRequest{From: "old.x", To: "new.x", Subtree: true, DryRun: true})
+	assert.Nil(t, err)
+	assert.Equal(t, report.Renamed, map[string]string{"old.x.cpu": "new.x.cpu", "old.x.mem": "new.x.mem"})
+	assert.Equal(t, federator.idx.listChildern(""), []string{"keep", "old"})
+
+	report, err = federator.renameMetric(&RenameRequest{From: "old.x", To: "new.x", Subtree: true})
+	assert.Nil(t, err)
+	assert.Equal(t, report.Nodes, []string{"old.x", "old.x.cpu", "old.x.mem", "old"})
+	assert.Equal(t, federator.idx.listChildern(""), []string{"keep", "new"})
+	assert.Equal(t, federator.idx.listChildern("new.x"), []string{"cpu", "mem"})
+
+	/* History follows the metric */
+	key, ok := federator.getMetric("new.x.cpu")
+	assert.True(t, ok)
+	assert.Equal(t, len(federator.dataScan(key, 1, 1000)), 1)
+	_, ok = federator.getMetric("old.x.cpu")
+	assert.False(t, ok)
+
+	/* The old name starts afresh */
+	fresh, ok := federator.createMetric("old.x.cpu")
+	assert.True(t, ok)
+	assert.NotEqual(t, fresh.key, key.key)
+	assert.Equal(t, len(federator.dataScan(fresh, 1, 1000)), 0)
+}
+
+func TestRenameAlias(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	config := make(map[string]string)
+	config["root"] = dir
+
+	federator := buildStorage(config)
+	defer federator.release()
+
+	key, ok := federator.createMetric("a.b")
+	assert.True(t, ok)
+
+	report, err := federator.renameMetric(&RenameRequest{From: "a.b", To: "c.d", AliasSeconds: 60})
+	assert.Nil(t, err)
+	assert.Equal(t, report.Aliases, map[string]string{"a.b": "c.d"})
+
+	alias, ok := federator.getMetric("a.b")
+	assert.True(t, ok)
+	assert.Equal(t, alias.key, key.key)
+	assert.Equal(t, federator.idx.listChildern(""), []string{"a", "c"})
+
+	_, err = federator.renameMetric(&RenameRequest{From: "a.b", To: "e.f"})
+	assert.Equal(t, err, errRenameAlias)
+
+	n, err := federator.idx.expireAliases(time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, n, 0)
+	n, err = federator.idx.expireAliases(time.Now().Add(time.Minute))
+	assert.Nil(t, err)
+	assert.Equal(t, n, 1)
+
+	_, ok = federator.getMetric("a.b")
+	assert.False(t, ok)
+	assert.Equal(t, federator.idx.listChildern(""), []string{"c"})
+	moved, ok := federator.getMetric("c.d")
+	assert.True(t, ok)
+	assert.Equal(t, moved.key, key.key)
+}
+
+func TestPartitionSchemes(t *testing.T) {
+	ts := uint64(time.Date(2021, time.January, 3, 13, 30, 0, 0, time.UTC).Unix())
+	expected := map[string]string{"hour": "2021010313", "day": "20210103", "week": "2020w53", "month": "202101"}
+	for name, id := range expected {
+		p, ok := getPartitionScheme(name)
+		assert.True(t, ok)
+		assert.Equal(t, p.shardFor(ts), id)
+		c, ok := classifyShard(id)
+		assert.True(t, ok)
+		assert.Equal(t, c, p)
+	}
+
+	week, _ := getPartitionScheme("week")
+	end := uint64(time.Date(2021, time.January, 11, 0, 0, 0, 0, time.UTC).Unix())
+	assert.Equal(t, week.rangeShards(ts, end), []string{"2020w53", "2021w01", "2021w02"})
+
+	hour, _ := getPartitionScheme("hour")
+	assert.Equal(t, len(hour.rangeShards(ts, ts+86400)), 25)
+
+	ends := map[string]time.Time{
+		"2021010313": time.Date(2021, time.January, 3, 14, 0, 0, 0, time.UTC),
+		"20210103":   time.Date(2021, time.January, 4, 0, 0, 0, 0, time.UTC),
+		"2020w53":    time.Date(2021, time.January, 4, 0, 0, 0, 0, time.UTC),
+		"2021w01":    time.Date(2021, time.January, 11, 0, 0, 0, 0, time.UTC),
+		"202012":     time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC),
+	}
+	for id, expected := range ends {
+		end, err := partitionEnd(id)
+		assert.Nil(t, err)
+		assert.Equal(t, end, expected, id)
+	}
+	_, err := partitionEnd("mt")
+	assert.NotNil(t, err)
+}
+
+func TestPartitionTransition(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	config := make(map[string]string)
+	config["root"] = dir
+
+	base := uint64(time.Date(2021, time.January, 3, 0, 0, 0, 0, time.UTC).Unix())
+	datum := mq.MetricReading{Metric: "a.b"}
+
+	federator := buildStorage(config)
+	key, ok := federator.createMetric("a.b")
+	assert.True(t, ok)
+	for _, ts := range []uint64{base + 60, base + 3600, base + 7200} {
+		datum.Time, datum.Val = ts, 1
+		assert.True(t, federator.uncheckedWrite(key, datum))
+	}
+	time.Sleep(_BATCH_TIME_SECONDS * time.Second * 3 / 2)
+	federator.release()
+
+	config["shard-partition"] = "hour"
+	federator = buildStorage(config)
+	defer federator.release()
+	assert.Equal(t, len(federator.schemes), 2)
+
+	key, ok = federator.getMetric("a.b")
+	assert.True(t, ok)
+	for _, ts := range []uint64{base + 7200, base + 10800} {
+		datum.Time, datum.Val = ts, 2
+		assert.True(t, federator.uncheckedWrite(key, datum))
+	}
+	time.Sleep(_BATCH_TIME_SECONDS * time.Second * 3 / 2)
+
+	assert.Equal(t, federator.diskShards(), []string{"20210103", "2021010302", "2021010303"})
+	assert.Equal(t, federator.dataScan(key, base, base+86399), []Datapoint{
+		{base + 60, 1}, {base + 3600, 1}, {base + 7200, 2}, {base + 10800, 2},
+	})
+}
+
+func TestArchiveShards(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	config := make(map[string]string)
+	config["root"] = dir
+
+	base := uint64(time.Date(2021, time.January, 3, 0, 0, 0, 0, time.UTC).Unix())
+	datum := mq.MetricReading{Metric: "a.b"}
+
+	federator := buildStorage(config)
+	key, ok := federator.createMetric("a.b")
+	assert.True(t, ok)
+	for _, ts := range []uint64{base + 60, base + 3600, base + 86400 + 60} {
+		datum.Time, datum.Val = ts, float64(ts)
+		assert.True(t, federator.uncheckedWrite(key, datum))
+	}
+	time.Sleep(_BATCH_TIME_SECONDS * time.Second * 3 / 2)
+	expected := federator.dataScan(key, base, base+2*86400)
+	assert.Equal(t, len(expected), 3)
+
+	/* Shards being written to are left alone */
+	federator.config.Archive_after = 24 * time.Hour
+	now := time.Unix(int64(base), 0).Add(72 * time.Hour)
+	assert.Equal(t, federator.archiveShards(now), []string{})
+
+	federator.release()
+	federator = buildStorage(config)
+	federator.config.Archive_after = 24 * time.Hour
+	assert.Equal(t, federator.archiveShards(now.Add(-time.Hour)), []string{"20210103"})
+	assert.Equal(t, federator.archiveShards(now), []string{"20210104"})
+	assert.Equal(t, federator.diskShards(), []string{})
+	assert.Equal(t, archiveIds(dir), []string{"20210103", "20210104"})
+	assert.Equal(t, federator.dataScan(key, base, base+2*86400), expected)
+
+	/* Archives are immutable */
+	datum.Time = base + 120
+	assert.False(t, federator.uncheckedWrite(key, datum))
+	assert.Equal(t, federator.diskShards(), []string{})
+	federator.release()
+
+	federator = buildStorage(config)
+	defer federator.release()
+	key, _ = federator.getMetric("a.b")
+	assert.Equal(t, federator.dataScan(key, base, base+2*86400), expected)
+	assert.Equal(t, federator.dataScan(key, base+3600, base+3600), expected[1:2])
+
+	/* Purging rewrites the archives */
+	report, err := federator.deleteMetric(&DeleteRequest{Path: "a.b", PurgeData: true, DryRun: true})
+	assert.Nil(t, err)
+	assert.Equal(t, report.Shards, []string{"20210103", "20210104"})
+	assert.Equal(t, report.Datapoints, uint64(3))
+	assert.Equal(t, federator.dataScan(key, base, base+2*86400), expected)
+
+	report, err = federator.deleteMetric(&DeleteRequest{Path: "a.b", PurgeData: true})
+	assert.Nil(t, err)
+	assert.Equal(t, report.Datapoints, uint64(3))
+	key, ok = federator.createMetric("a.b")
+	assert.True(t, ok)
+	assert.Equal(t, len(federator.dataScan(key, base, base+2*86400)), 0)
+	assert.Equal(t, archiveIds(dir), []string{"20210103", "20210104"})
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+	backup, cleanupBackup := _makeDir()
+	defer cleanupBackup()
+	restored, cleanupRestored := _makeDir()
+	defer cleanupRestored()
+
+	config := make(map[string]string)
+	config["root"] = dir
+
+	base := uint64(time.Date(2021, time.January, 3, 0, 0, 0, 0, time.UTC).Unix())
+	datum := mq.MetricReading{Metric: "a.b"}
+
+	federator := buildStorage(config)
+	key, ok := federator.createMetric("a.b")
+	assert.True(t, ok)
+	for _, ts := range []uint64{base + 60, base + 86400 + 60} {
+		datum.Time, datum.Val = ts, float64(ts)
+		assert.True(t, federator.uncheckedWrite(key, datum))
+	}
+	time.Sleep(_BATCH_TIME_SECONDS * time.Second * 3 / 2)
+	federator.release()
+
+	/* Queued datapoints are flushed into the snapshot; shards that are not
+	open are copied too */
+	federator = buildStorage(config)
+	key, _ = federator.getMetric("a.b")
+	datum.Time = base + 86400 + 120
+	assert.True(t, federator.uncheckedWrite(key, datum))
+	expected := []Datapoint{{base + 60, float64(base + 60)}, {base + 86400 + 60, float64(base + 86400 + 60)}, {base + 86400 + 120, float64(base + 86400 + 60)}}
+
+	_, err := federator.snapshot("relative")
+	assert.Equal(t, err, errSnapshotDest)
+	_, err = federator.snapshot(backup)
+	assert.Equal(t, err, errSnapshotExists)
+
+	manifest, err := federator.snapshot(backup + "/snap")
+	assert.Nil(t, err)
+	names := make([]string, 0)
+	for _, e := range manifest.Entries {
+		names = append(names, e.Name)
+	}
+	assert.Equal(t, names, []string{"tsd-data-20210103.db", "tsd-data-20210104.db", "tsd-dir.db", "tsd-map.db"})
+	assert.Equal(t, manifest.Entries[1].Records, uint64(3), "2 datapoints & the scheme marker")
+	assert.False(t, federator.pinned)
+	assert.Equal(t, len(federator.openShards()), 1, "the shard that was not open is read without being opened for writes")
+	assert.Equal(t, len(federator.readers.list()), 1)
+
+	/* Changes past the snapshot are not carried over */
+	_, ok = federator.createMetric("c.d")
+	assert.True(t, ok)
+	federator.release()
+
+	offline, err := Snapshot(dir, backup+"/offline")
+	assert.Nil(t, err)
+	assert.Equal(t, len(offline.Entries), 4)
+
+	_, err = Restore(backup+"/snap", dir, false)
+	assert.Equal(t, err, errRestoreNotEmpty)
+	_, err = Restore(backup, restored, false)
+	assert.NotNil(t, err, "no manifest")
+
+	_, err = Restore(backup+"/snap", restored, false)
+	assert.Nil(t, err)
+	config["root"] = restored
+	federator = buildStorage(config)
+	defer federator.release()
+	key, ok = federator.getMetric("a.b")
+	assert.True(t, ok)
+	_, ok = federator.getMetric("c.d")
+	assert.False(t, ok)
+	assert.Equal(t, federator.dataScan(key, base, base+2*86400), expected)
+}
+
+func TestImporter(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	config := make(map[string]string)
+	config["root"] = dir
+
+	/* Spans more shards than are kept open */
+	base := uint64(time.Date(2021, time.January, 3, 0, 0, 0, 0, time.UTC).Unix())
+	points := make([]Datapoint, 0)
+	for ts := base; ts < base+40*86400; ts += 3600 {
+		points = append(points, Datapoint{ts, float64(ts % 7)})
+	}
+
+	importer, err := OpenImporter(config)
+	assert.Nil(t, err)
+	assert.Nil(t, importer.Add("a.b", points[:500]))
+	assert.Equal(t, importer.Buffered(), 500)
+	assert.Nil(t, importer.Checkpoint())
+	assert.Equal(t, importer.Buffered(), 0)
+	assert.True(t, len(importer.federator.openShards()) <= _MAX_OPEN_SHARDS)
+	assert.Nil(t, importer.Add("a.b", points[500:]))
+	assert.Nil(t, importer.Add("c.d", points[:10]))
+	assert.Nil(t, importer.Close())
+	assert.Equal(t, importer.Stats, ImportStats{3, uint64(len(points) + 10), 0})
+
+	federator := buildStorage(config)
+	defer federator.release()
+	assert.Equal(t, len(federator.diskShards()), 40)
+	key, ok := federator.getMetric("a.b")
+	assert.True(t, ok)
+	assert.Equal(t, federator.dataScan(key, base, base+40*86400), points)
+	key, ok = federator.getMetric("c.d")
+	assert.True(t, ok)
+	assert.Equal(t, federator.dataScan(key, base, base+40*86400), points[:10])
+}
+
+func TestExport(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	config := make(map[string]string)
+	config["root"] = dir
+
+	base := uint64(time.Date(2021, time.January, 3, 0, 0, 0, 0, time.UTC).Unix())
+	importer, err := OpenImporter(config)
+	assert.Nil(t, err)
+	assert.Nil(t, importer.Add("x.a", []Datapoint{{base, 1.5}, {base + 86400, math.NaN()}}))
+	assert.Nil(t, importer.Add("x.b", []Datapoint{{base + 60, 2}}))
+	assert.Nil(t, importer.Add("y.a", []Datapoint{{base, 3}}))
+	assert.Nil(t, importer.Close())
+
+	export := func(format string) string {
+		var b bytes.Buffer
+		_, err := Export(dir, &b, &ExportRequest{"x.*", base, base + 2*86400, format})
+		assert.Nil(t, err)
+		return b.String()
+	}
+	/* Shard by shard, so the day's datapoints of both come first */
+	assert.Equal(t, export(EXPORT_CSV), fmt.Sprintf("metric,timestamp,value\nx.a,%d,1.5\nx.b,%d,2\nx.a,%d,NaN\n",
+		base, base+60, base+86400))
+	assert.Equal(t, export(EXPORT_JSONL), fmt.Sprintf(
+		"{\"metric\":\"x.a\",\"timestamp\":%d,\"value\":1.5}\n{\"metric\":\"x.b\",\"timestamp\":%d,\"value\":2}\n{\"metric\":\"x.a\",\"timestamp\":%d,\"value\":null}\n",
+		base, base+60, base+86400))
+	assert.Equal(t, export(EXPORT_PLAINTEXT), fmt.Sprintf("x.a 1.5 %d\nx.b 2 %d\nx.a NaN %d\n", base, base+60, base+86400))
+
+	var b bytes.Buffer
+	n, err := Export(dir, &b, &ExportRequest{"*.a", base + 1, base + 2*86400, EXPORT_PLAINTEXT})
+	assert.Nil(t, err)
+	assert.Equal(t, n, uint64(1))
+	_, err = Export(dir, &b, &ExportRequest{"x.*", base, base, "xml"})
+	assert.NotNil(t, err)
+
+	federator := buildStorage(config)
+	defer federator.release()
+	server := httptest.NewServer(http.HandlerFunc(federator.serveExport))
+	defer server.Close()
+	resp, err := http.Get(fmt.Sprintf("%s/export?glob=y.*&from=%d&until=%d&format=plaintext", server.URL, base, base+86400))
+	assert.Nil(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	assert.Equal(t, string(body), fmt.Sprintf("y.a 3 %d\n", base))
+	resp, err = http.Get(server.URL + "/export?glob=x.[&format=csv")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+}
+
+func TestBackfill(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	config := make(map[string]string)
+	config["root"] = dir
+	federator := buildStorage(config)
+	defer federator.release()
+
+	/* Small batches so the buffer is written out more than once */
+	backfill := newBackfiller(federator, backfillConf{0, 100, 1000000, 4})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	go backfill.serve(l)
+
+	base := uint64(time.Date(2021, time.January, 3, 0, 0, 0, 0, time.UTC).Unix())
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.Nil(t, err)
+	expected := make([]Datapoint, 0)
+	for ts := base + 3*86400; ts >= base; ts -= 900 {
+		fmt.Fprintf(conn, "a.b %d %d\n", ts%11, ts)
+		expected = append([]Datapoint{{ts, float64(ts % 11)}}, expected...)
+	}
+	fmt.Fprintf(conn, "a.b 1 %d\n", base) // the last one received wins
+	expected[0].Value = 1
+	fmt.Fprintf(conn, "garbage\n")
+	conn.Close()
+
+	lines := uint64(len(expected) + 2)
+	for i := 0; i < 100 && backfill.getStats().Lines < lines; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	backfill.close()
+
+	stats := backfill.getStats()
+	assert.Equal(t, stats.Lines, lines)
+	assert.Equal(t, stats.Garbled, uint64(1))
+	assert.Equal(t, stats.Datapoints, uint64(len(expected)+1))
+	assert.Equal(t, stats.Buffered, int64(0))
+	assert.Equal(t, len(federator.diskShards()), 4)
+	assert.Equal(t, len(federator.openShards()), 0, "backfill opens no shard for writes")
+	assert.False(t, backfill._sleep(time.Hour), "throttling is given up on once closed")
+
+	key, ok := federator.getMetric("a.b")
+	assert.True(t, ok)
+	assert.Equal(t, federator.dataScan(key, base, base+3*86400), expected)
+
+	points := []triplet{{key, Datapoint{3, 0}}, {&metricIndex{"x", []byte{0}, 60}, Datapoint{9, 0}}, {key, Datapoint{1, 0}}}
+	sortTriplets(points)
+	assert.Equal(t, points[0].val.Timestamp, uint64(9))
+	assert.Equal(t, points[2].val.Timestamp, uint64(3))
+}
+
+func TestRangePagination(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	config := make(map[string]string)
+	config["root"] = dir
+	config["max-points-per-query"] = "60"
+
+	base := uint64(time.Date(2021, time.January, 3, 0, 0, 0, 0, time.UTC).Unix())
+	points := make([]Datapoint, 0)
+	for ts := base; ts < base+3*86400; ts += 3600 {
+		points = append(points, Datapoint{ts, float64(ts % 13)})
+	}
+	points[5].Value = math.NaN()
+	importer, err := OpenImporter(config)
+	assert.Nil(t, err)
+	assert.Nil(t, importer.Add("a.b", points))
+	assert.Nil(t, importer.Close())
+
+	federator := buildStorage(config)
+	defer federator.release()
+	reader := &ReaderService{federator}
+	end := base + 3*86400
+
+	/* Pages that straddle shards */
+	seen := make([]Datapoint, 0)
+	query := RangeQuery{Node: "a.b", Start: base, End: end, Limit: 30}
+	for pages := 1; ; pages++ {
+		var result RangeResult
+		assert.Nil(t, reader.GetRangeData(nil, &query, &result))
+		seen = append(seen, result.Data...)
+		if result.Next == 0 {
+			assert.Equal(t, pages, 3)
+			break
+		}
+		assert.Equal(t, len(result.Data), 30)
+		query.Start = result.Next
+	}
+	assert.Equal(t, len(seen), len(points))
+	assert.Equal(t, seen[0], points[0])
+	assert.Equal(t, seen[71], points[71])
+
+	/* Beyond max-points-per-query; unpaginated queries are refused & pages
+	are capped */
+	var result RangeResult
+	assert.NotNil(t, reader.GetRangeData(nil, &RangeQuery{Node: "a.b", Start: base, End: end}, &result))
+	assert.Nil(t, reader.GetRangeData(nil, &RangeQuery{Node: "a.b", Start: base, End: base + 86400}, &result))
+	assert.Equal(t, len(result.Data), 25)
+	assert.Equal(t, result.Next, uint64(0))
+	config["max-points-per-query"] = "50"
+	federator.config = parseConfig(config)
+	assert.Nil(t, reader.GetRangeData(nil, &RangeQuery{Node: "a.b", Start: base, End: end, Limit: 1000}, &result))
+	assert.Equal(t, len(result.Data), 50)
+	assert.Equal(t, result.Next, points[50].Timestamp)
+
+	server := httptest.NewServer(http.HandlerFunc(federator.serveData))
+	defer server.Close()
+	get := func(query string) (int, map[string]interface{}) {
+		resp, err := http.Get(server.URL + "/data?" + query)
+		assert.Nil(t, err)
+		defer resp.Body.Close()
+		retval := make(map[string]interface{})
+		if resp.StatusCode == http.StatusOK {
+			assert.Nil(t, json.NewDecoder(resp.Body).Decode(&retval))
+		}
+		return resp.StatusCode, retval
+	}
+	status, body := get(fmt.Sprintf("target=a.b&from=%d&until=%d&limit=10", base, end))
+	assert.Equal(t, status, http.StatusOK)
+	data := body["data"].([]interface{})
+	assert.Equal(t, len(data), 10)
+	assert.Equal(t, data[0].(map[string]interface{})["Timestamp"], float64(base))
+	assert.Nil(t, data[5].(map[string]interface{})["Value"])
+	assert.Equal(t, body["next"], float64(points[10].Timestamp))
+
+	/* Capped by max-points-per-query */
+	_, body = get(fmt.Sprintf("target=a.b&from=%d&until=%d", base, end))
+	assert.Equal(t, len(body["data"].([]interface{})), 50)
+	assert.Equal(t, body["next"], float64(points[50].Timestamp))
+	_, body = get(fmt.Sprintf("target=a.b&from=%d&until=%d", points[60].Timestamp, end))
+	assert.Equal(t, len(body["data"].([]interface{})), 12)
+	assert.Equal(t, body["next"], float64(0))
+
+	status, _ = get("target=x.y")
+	assert.Equal(t, status, http.StatusNotFound)
+	status, _ = get(fmt.Sprintf("target=a.b&from=%d&until=%d", end, base))
+	assert.Equal(t, status, http.StatusBadRequest)
+}
+
+func TestConsolidation(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	config := make(map[string]string)
+	config["root"] = dir
+
+	/* A datapoint a minute for two days */
+	base := uint64(time.Date(2021, time.January, 3, 0, 0, 0, 0, time.UTC).Unix())
+	points := make([]Datapoint, 0)
+	for ts := base; ts < base+2*86400; ts += 60 {
+		points = append(points, Datapoint{ts, float64((ts - base) / 60 % 10)})
+	}
+	points[1].Value = math.NaN()
+	importer, err := OpenImporter(config)
+	assert.Nil(t, err)
+	assert.Nil(t, importer.Add("a.b", points))
+	assert.Nil(t, importer.Close())
+
+	federator := buildStorage(config)
+	defer federator.release()
+	reader := &ReaderService{federator}
+	end := base + 2*86400 - 1
+
+	/* 10 minute buckets hold 0 through 9; the NaN of the first is
+	disregarded */
+	expected := map[string]float64{"avg": 4.5, "sum": 45, "min": 0, "max": 9, "last": 9}
+	first := map[string]float64{"avg": 44.0 / 9, "sum": 44, "min": 0, "max": 9, "last": 9}
+	for fn, v := range expected {
+		var result RangeResult
+		assert.Nil(t, reader.GetRangeData(nil, &RangeQuery{Node: "a.b", Start: base, End: end, BucketSeconds: 600, Consolidate: fn}, &result))
+		assert.Equal(t, result.Bucket, uint64(600))
+		assert.Equal(t, len(result.Data), 288)
+		assert.Equal(t, result.Data[0].Timestamp, base)
+		assert.Equal(t, result.Data[0].Value, first[fn], fn)
+		assert.Equal(t, result.Data[287], Datapoint{base + 287*600, v}, fn)
+	}
+
+	/* 800 points over two days is a bucket of 216 seconds, rounded up to a
+	multiple of the step */
+	var result RangeResult
+	assert.Nil(t, reader.GetRangeData(nil, &RangeQuery{Node: "a.b", Start: base, End: end, MaxDataPoints: 800}, &result))
+	assert.Equal(t, result.Bucket, uint64(240))
+	assert.True(t, len(result.Data) <= 800)
+	assert.Equal(t, result.Data[1], Datapoint{base + 240, 5.5})
+
+	/* An hour from half a minute past; 20 points would be buckets of 180
+	seconds, but the range straddles 21 of them */
+	var unaligned RangeResult
+	assert.Nil(t, reader.GetRangeData(nil, &RangeQuery{Node: "a.b", Start: base + 30, End: base + 3629, MaxDataPoints: 20}, &unaligned))
+	assert.Equal(t, unaligned.Bucket, uint64(240))
+	assert.Equal(t, len(unaligned.Data), 16)
+
+	/* Buckets worked out from maxDataPoints are not paged through, each page
+	would work out its own; pages of buckets asked for as is stitch together */
+	query := RangeQuery{Node: "a.b", Start: base, End: end, Limit: 100, MaxDataPoints: 800, Consolidate: "max"}
+	var refused RangeResult
+	assert.NotNil(t, reader.GetRangeData(nil, &query, &refused))
+	query.BucketSeconds = 240
+	paged := make([]Datapoint, 0)
+	for {
+		var page RangeResult
+		assert.Nil(t, reader.GetRangeData(nil, &query, &page))
+		paged = append(paged, page.Data...)
+		if page.Next == 0 {
+			break
+		}
+		query.Start = page.Next
+	}
+	var whole RangeResult
+	assert.Nil(t, reader.GetRangeData(nil, &RangeQuery{Node: "a.b", Start: base, End: end, MaxDataPoints: 800, Consolidate: "max"}, &whole))
+	assert.Equal(t, paged, whole.Data)
+
+	/* No finer than what is stored */
+	var raw RangeResult
+	assert.Nil(t, reader.GetRangeData(nil, &RangeQuery{Node: "a.b", Start: base, End: base + 3599, MaxDataPoints: 800}, &raw))
+	assert.Equal(t, raw.Bucket, uint64(0))
+	assert.Equal(t, len(raw.Data), 60)
+	assert.NotNil(t, reader.GetRangeData(nil, &RangeQuery{Node: "a.b", Start: base, End: end, BucketSeconds: 600, Consolidate: "median"}, &raw))
+
+	server := httptest.NewServer(http.HandlerFunc(federator.serveData))
+	defer server.Close()
+	resp, err := http.Get(fmt.Sprintf("%s/data?target=a.b&from=%d&until=%d&bucket_seconds=3600&consolidateBy=sum", server.URL, base, end))
+	assert.Nil(t, err)
+	body := make(map[string]interface{})
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&body))
+	resp.Body.Close()
+	assert.Equal(t, body["bucket"], float64(3600))
+	data := body["data"].([]interface{})
+	assert.Equal(t, len(data), 48)
+	assert.Equal(t, data[1].(map[string]interface{})["Value"], float64(270))
+}
+
+func TestDenseSeries(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	config := make(map[string]string)
+	config["root"] = dir
+	config["max-points-per-query"] = "2000"
+
+	/* A datapoint every other minute, but for a gap of an hour, across a
+	change of shard */
+	base := uint64(time.Date(2021, time.January, 3, 23, 0, 0, 0, time.UTC).Unix())
+	points := make([]Datapoint, 0)
+	for ts := base; ts < base+2*3600; ts += 120 {
+		if ts < base+1800 || ts >= base+5400 {
+			points = append(points, Datapoint{ts, float64(ts % 7)})
+		}
+	}
+	points[1].Value = math.NaN()
+	importer, err := OpenImporter(config)
+	assert.Nil(t, err)
+	assert.Nil(t, importer.Add("a.b", points))
+	assert.Nil(t, importer.Close())
+
+	federator := buildStorage(config)
+	defer federator.release()
+	reader := &ReaderService{federator}
+
+	var result SeriesResult
+	assert.Nil(t, reader.GetSeries(nil, &RangeQuery{Node: "a.b", Start: base + 30, End: base + 2*3600 - 1}, &result))
+	assert.Equal(t, result.Start, base+60)
+	assert.Equal(t, result.Step, uint64(60))
+	assert.Equal(t, result.End, base+2*3600)
+	assert.Equal(t, len(result.Values), 119)
+	filled := make(map[uint64]float64)
+	for _, x := range points {
+		filled[x.Timestamp] = x.Value
+	}
+	for i, v := range result.Values {
+		ts := result.Start + uint64(i)*60
+		if x, ok := filled[ts]; ok && !math.IsNaN(x) {
+			assert.NotNil(t, v, "%d", ts)
+			if v != nil {
+				assert.Equal(t, *v, x)
+			}
+		} else {
+			assert.Nil(t, v, "%d", ts)
+		}
+	}
+
+	/* Consolidated, the step is the bucket */
+	assert.Nil(t, reader.GetSeries(nil, &RangeQuery{Node: "a.b", Start: base, End: base + 2*3600 - 1, BucketSeconds: 600, Consolidate: "sum"}, &result))
+	assert.Equal(t, result.Step, uint64(600))
+	assert.Equal(t, len(result.Values), 12)
+	assert.Nil(t, result.Values[3])
+	assert.NotNil(t, result.Values[9])
+
+	/* More steps than max-points-per-query */
+	assert.NotNil(t, reader.GetSeries(nil, &RangeQuery{Node: "a.b", Start: base, End: base + 3*86400}, &result))
+
+	server := httptest.NewServer(http.HandlerFunc(federator.serveData))
+	defer server.Close()
+	resp, err := http.Get(fmt.Sprintf("%s/data?target=a.b&from=%d&until=%d&shape=dense", server.URL, base+30, base+2*3600-1))
+	assert.Nil(t, err)
+	var body struct {
+		Metric string
+		Start  uint64
+		End    uint64
+		Step   uint64
+		Values []*float64
+	}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&body))
+	resp.Body.Close()
+	assert.Equal(t, body.Metric, "a.b")
+	reader.GetSeries(nil, &RangeQuery{Node: "a.b", Start: base + 30, End: base + 2*3600 - 1}, &result)
+	assert.Equal(t, SeriesResult{body.Start, body.End, body.Step, body.Values}, result)
+
+	resp, err = http.Get(fmt.Sprintf("%s/data?target=a.b&from=%d&until=%d&shape=wide", server.URL, base, base+60))
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, http.StatusBadRequest)
+}
+
+func TestMultiRangeData(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	config := make(map[string]string)
+	config["root"] = dir
+	config["max-points-per-query"] = "200"
+
+	base := uint64(time.Date(2021, time.January, 3, 0, 0, 0, 0, time.UTC).Unix())
+	importer, err := OpenImporter(config)
+	assert.Nil(t, err)
+	series := make(map[string][]Datapoint)
+	for i := 0; i < 20; i++ {
+		metric := fmt.Sprintf("servers.s%02d.cpu", i)
+		points := make([]Datapoint, 0)
+		for ts := base + uint64(i)*60; ts < base+6*86400; ts += 3600 {
+			points = append(points, Datapoint{ts, float64(i)})
+		}
+		series[metric] = points
+		assert.Nil(t, importer.Add(metric, points))
+	}
+	long := make([]Datapoint, 0)
+	for ts := base; ts < base+86400; ts += 60 {
+		long = append(long, Datapoint{ts, 1})
+	}
+	assert.Nil(t, importer.Add("servers.long", long))
+	assert.Nil(t, importer.Close())
+
+	federator := buildStorage(config)
+	defer federator.release()
+	reader := &ReaderService{federator}
+
+	end := base + 6*86400
+	var result MultiRangeResult
+	query := MultiRangeQuery{Nodes: []string{"servers.s07.cpu", "servers.s1*.cpu", "nope.x", "servers.long"}, Start: base, End: end}
+	assert.Nil(t, reader.GetMultiRangeData(nil, &query, &result))
+	assert.Equal(t, len(result.Series), 13)
+	assert.Equal(t, result.Series[0].Node, "servers.s07.cpu")
+	assert.Equal(t, result.Series[0].Data, series["servers.s07.cpu"])
+	for i := 0; i < 10; i++ {
+		metric := fmt.Sprintf("servers.s1%d.cpu", i)
+		assert.Equal(t, result.Series[1+i].Node, metric)
+		assert.Equal(t, result.Series[1+i].Data, series[metric])
+		assert.Equal(t, result.Series[1+i].Error, "")
+	}
+	assert.Equal(t, result.Series[11].Node, "nope.x")
+	assert.NotEqual(t, result.Series[11].Error, "")
+	assert.Equal(t, result.Series[12].Node, "servers.long")
+	assert.NotEqual(t, result.Series[12].Error, "", "beyond max-points-per-query")
+	assert.Nil(t, result.Series[12].Data)
+
+	/* The same as one series at a time */
+	for _, s := range result.Series[:11] {
+		var single RangeResult
+		assert.Nil(t, reader.GetRangeData(nil, &RangeQuery{Node: s.Node, Start: base + 3600, End: end - 3600, BucketSeconds: 7200, Consolidate: "sum"}, &single))
+		var multi MultiRangeResult
+		assert.Nil(t, reader.GetMultiRangeData(nil, &MultiRangeQuery{Nodes: []string{s.Node}, Start: base + 3600, End: end - 3600, BucketSeconds: 7200, Consolidate: "sum"}, &multi))
+		assert.Equal(t, multi.Series[0].Data, single.Data)
+		assert.Equal(t, multi.Series[0].Bucket, uint64(7200))
+	}
+
+	query = MultiRangeQuery{Nodes: []string{"servers.long"}, Start: base, End: end, MaxDataPoints: 100}
+	assert.Nil(t, reader.GetMultiRangeData(nil, &query, &result))
+	assert.Equal(t, result.Series[0].Error, "")
+	assert.True(t, len(result.Series[0].Data) <= 100)
+
+	query = MultiRangeQuery{Nodes: []string{"servers.[s"}, Start: base, End: end}
+	assert.Nil(t, reader.GetMultiRangeData(nil, &query, &result))
+	assert.NotEqual(t, result.Series[0].Error, "")
+}
+
+func TestParallelScan(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	config := make(map[string]string)
+	config["root"] = dir
+	config["read-concurrency"] = "3"
+
+	base := uint64(time.Date(2021, time.February, 1, 0, 0, 0, 0, time.UTC).Unix())
+	importer, err := OpenImporter(config)
+	assert.Nil(t, err)
+	points := make([]Datapoint, 0)
+	for ts := base; ts < base+40*86400; ts += 6 * 3600 {
+		points = append(points, Datapoint{ts, float64(ts - base)})
+	}
+	assert.Nil(t, importer.Add("foo.bar", points))
+	assert.Nil(t, importer.Close())
+
+	federator := buildStorage(config)
+	defer federator.release()
+	assert.Equal(t, cap(federator.readSlots), 3)
+	key, _ := federator.getMetric("foo.bar")
+
+	/* More shards than there are read handles budgeted for; those of the
+	range scanned earlier are closed as the later ones are opened, & none is
+	opened for writes */
+	assert.Equal(t, federator.dataScan(key, base, base+40*86400), points)
+	assert.Equal(t, len(federator.openShards()), 0)
+	assert.Equal(t, len(federator.readers.list()), _READ_CACHE_SHARDS)
+	assert.Equal(t, federator.dataScan(key, base+86400, base+2*86400-1), points[4:8])
+
+	/* Scans overlap up to the slots available & are visited in order */
+	var running, most int32
+	visited := make([]int, 0)
+	err = federator.scanInOrder(context.Background(), 20, func(i int) {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Duration(20-i) * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	}, func(i int) bool {
+		visited = append(visited, i)
+		return i < 14
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, len(visited), 15)
+	for i, v := range visited {
+		assert.Equal(t, v, i)
+	}
+	assert.True(t, most > 1 && most <= 3, "%d scans at once", most)
+
+	/* A query is given up on once its client is gone */
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := httptest.NewRequest("POST", "/rpc", nil).WithContext(ctx)
+	var result RangeResult
+	err = (&ReaderService{federator}).GetRangeData(r, &RangeQuery{Node: "foo.bar", Start: base, End: base + 40*86400}, &result)
+	assert.NotNil(t, err)
+	assert.Nil(t, result.Data)
+
+	/* or once it times out */
+	federator.config.Query_timeout = time.Nanosecond
+	err = (&ReaderService{federator}).GetRangeData(nil, &RangeQuery{Node: "foo.bar", Start: base, End: base + 40*86400}, &result)
+	assert.Equal(t, err.Error(), "query for foo.bar timed out")
+
+	w := httptest.NewRecorder()
+	assert.Panics(t, func() {
+		federator.serveData(w, httptest.NewRequest("GET", fmt.Sprintf("/data?target=foo.bar&from=%d&until=%d", base, base+40*86400), nil))
+	})
+}
+
+func TestReadHandles(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	config := make(map[string]string)
+	config["root"] = dir
+	config["read-cache-shards"] = "3"
+	config["read-concurrency"] = "1"
+	config["read-cache-ttl-seconds"] = "60"
+
+	base := uint64(time.Date(2021, time.March, 1, 0, 0, 0, 0, time.UTC).Unix())
+	importer, err := OpenImporter(config)
+	assert.Nil(t, err)
+	points := make([]Datapoint, 0)
+	for ts := base; ts < base+10*86400; ts += 3 * 3600 {
+		points = append(points, Datapoint{ts, 1})
+	}
+	assert.Nil(t, importer.Add("foo.bar", points))
+	assert.Nil(t, importer.Close())
+
+	federator := buildStorage(config)
+	defer federator.release()
+	key, _ := federator.getMetric("foo.bar")
+
+	/* Reads open no shard for writes & keep no more read handles than
+	budgeted for, the ones read from last */
+	assert.Equal(t, federator.dataScan(key, base, base+10*86400), points)
+	assert.Equal(t, len(federator.openShards()), 0)
+	handles := federator.readers.list()
+	assert.Equal(t, len(handles), 3)
+	assert.Equal(t, handles[0].Id, "20210308")
+	assert.Equal(t, federator.dataScan(key, base+86400, base+2*86400-1), points[8:16])
+	assert.Equal(t, len(federator.readers.list()), 3)
+
+	/* A write takes the read handle of its shard over */
+	assert.True(t, federator.uncheckedWrite(key, mq.MetricReading{"foo.bar", float64(7), base + 9*86400 + 60}))
+	assert.Equal(t, federator.flushAll(), 1)
+	assert.Equal(t, federator.openShards()[0].Id, "20210310")
+	for _, h := range federator.readers.list() {
+		assert.NotEqual(t, h.Id, "20210310")
+	}
+	scanned := federator.dataScan(key, base+9*86400, base+10*86400)
+	assert.Equal(t, len(scanned), 9)
+	assert.Equal(t, scanned[1], Datapoint{base + 9*86400 + 60, 7})
+
+	/* Concurrent reads & writes */
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			for j := 0; j < 5; j++ {
+				from := base + uint64((i+j)%8)*86400
+				assert.Equal(t, len(federator.dataScan(key, from, from+2*86400-1)), 16)
+			}
+			done <- true
+		}(i)
+	}
+	for i := 0; i < 10; i++ {
+		federator.uncheckedWrite(key, mq.MetricReading{"foo.bar", 1, base + 9*86400 + uint64(i)*3600})
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+
+	/* Handles unused for longer than the TTL are closed */
+	assert.Equal(t, federator.readers.expire(time.Now()), 0)
+	assert.Equal(t, len(federator.readers.list()), 3)
+	assert.Equal(t, federator.readers.expire(time.Now().Add(2*time.Minute)), 3)
+	assert.Equal(t, len(federator.readers.list()), 0)
+
+	/* A handle being closed, with a scan under way on it, holds up neither
+	the read that closes it to make room nor writes to other shards */
+	federator.readers.release()
+	federator.readers = newReadCache(dir, federator.config.Sconfig, 1, time.Minute, federator.owns)
+	held := federator._readShard("20210302")
+	held.busy.RLock()
+	opened := make(chan *shard)
+	go func() {
+		opened <- federator._readShard("20210303")
+	}()
+	assert.NotNil(t, <-opened)
+	written := make(chan bool)
+	go func() {
+		written <- federator.uncheckedWrite(key, mq.MetricReading{"foo.bar", 1, base + 3*86400})
+	}()
+	select {
+	case ok := <-written:
+		assert.True(t, ok)
+	case <-time.After(10 * time.Second):
+		t.Error("write held up by a scan of another shard")
+	}
+	held.busy.RUnlock()
+	assert.Equal(t, federator.readers.list()[0].Id, "20210303")
+
+	/* A get that would create the shard does so once a get that would not
+	has failed to open it */
+	pending := &readHandle{id: "20210401", used: time.Now(), ready: make(chan bool)}
+	federator.readers.lock.Lock()
+	federator.readers.handles["20210401"] = pending
+	federator.readers.lock.Unlock()
+	created := make(chan *shard)
+	go func() {
+		created <- federator._shardHandle("20210401", true)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	federator.readers.lock.Lock()
+	delete(federator.readers.handles, "20210401")
+	close(pending.ready)
+	federator.readers.lock.Unlock()
+	assert.NotNil(t, <-created)
+}
+
+func TestRender(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	config := make(map[string]string)
+	config["root"] = dir
+
+	base := uint64(time.Date(2021, time.January, 3, 0, 0, 0, 0, time.UTC).Unix())
+	importer, err := OpenImporter(config)
+	assert.Nil(t, err)
+	for i, metric := range []string{"servers.a.cpu", "servers.b.cpu"} {
+		points := make([]Datapoint, 0)
+		for ts := base; ts < base+600; ts += 60 {
+			if metric == "servers.b.cpu" && ts == base+120 {
+				continue
+			}
+			points = append(points, Datapoint{ts, float64(i + 1)})
+		}
+		assert.Nil(t, importer.Add(metric, points))
+	}
+	assert.Nil(t, importer.Close())
+
+	federator := buildStorage(config)
+	defer federator.release()
+
+	server := httptest.NewServer(http.HandlerFunc(federator.serveRender))
+	defer server.Close()
+	get := func(params string) *http.Response {
+		resp, err := http.Get(fmt.Sprintf("%s/render?from=%d&until=%d&%s", server.URL, base, base+299, params))
+		assert.Nil(t, err)
+		return resp
+	}
+
+	resp := get("target=sumSeries(servers.*.cpu)&target=alias(servers.b.cpu,'b')&format=json")
+	assert.Equal(t, resp.StatusCode, http.StatusOK)
+	var body []struct {
+		Target     string
+		Datapoints [][2]*float64
+	}
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&body))
+	resp.Body.Close()
+	assert.Equal(t, len(body), 2)
+	assert.Equal(t, body[0].Target, "sumSeries(servers.*.cpu)")
+	assert.Equal(t, body[1].Target, "b")
+	assert.Equal(t, len(body[0].Datapoints), 5)
+	for i, point := range body[0].Datapoints {
+		assert.Equal(t, uint64(*point[1]), base+uint64(i)*60)
+		if i == 2 {
+			assert.Equal(t, *point[0], 1.0)
+			assert.Nil(t, body[1].Datapoints[i][0])
+		} else {
+			assert.Equal(t, *point[0], 3.0)
+		}
+	}
+
+	for _, params := range []string{"target=servers.a.cpu&format=png", "target=sumSeries(servers.*.cpu", "target=noSuchFunction(servers.a.cpu)"} {
+		resp := get(params)
+		resp.Body.Close()
+		assert.Equal(t, resp.StatusCode, http.StatusBadRequest, params)
+	}
+}
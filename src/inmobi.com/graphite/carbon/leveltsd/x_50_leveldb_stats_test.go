@@ -0,0 +1,70 @@
+package leveltsd
+
+import (
+	"github.com/stretchr/testify/assert"
+	"inmobi.com/graphite/carbon/mq"
+	"testing"
+)
+
+const _SAMPLE_STATS = `                               Compactions
+Level  Files Size(MB) Time(sec) Read(MB) Write(MB)
+--------------------------------------------------
+  0        2        1         0        0         3
+  1        3        6         4       12        10
+`
+
+const _SAMPLE_SSTABLES = `--- level 0 ---
+ 12:1000['a' @ 5 : 1 .. 'b' @ 6 : 1]
+ 13:2000['c' @ 7 : 1 .. 'd' @ 8 : 1]
+--- level 1 ---
+ 5:3000['a' @ 1 : 1 .. 'b' @ 2 : 1]
+ 6:4000['c' @ 1 : 1 .. 'd' @ 2 : 1]
+ 7:5000['e' @ 1 : 1 .. 'f' @ 2 : 1]
+--- level 2 ---
+`
+
+func TestLevelStatsParse(t *testing.T) {
+	levels := parseLevelStats(_SAMPLE_STATS, _SAMPLE_SSTABLES)
+	assert.Equal(t, len(levels), 3)
+
+	assert.Equal(t, levels[0].Level, 0)
+	assert.Equal(t, levels[0].Files, 2)
+	assert.Equal(t, levels[0].Bytes, uint64(3000))
+	assert.Equal(t, levels[0].Write_mb, float64(3))
+
+	assert.Equal(t, levels[1].Files, 3)
+	assert.Equal(t, levels[1].Bytes, uint64(12000))
+	assert.Equal(t, levels[1].Compaction_seconds, float64(4))
+	assert.Equal(t, levels[1].Read_mb, float64(12))
+
+	assert.Equal(t, levels[2].Files, 0)
+}
+
+func TestLevelStatsEmpty(t *testing.T) {
+	levels := parseLevelStats("", "")
+	assert.Equal(t, len(levels), 0)
+}
+
+func TestCollectStats(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	config := make(map[string]string)
+	config["root"] = dir
+
+	federator := buildStorage(config)
+	defer federator.release()
+
+	key, ok := federator.createMetric("foo.bar")
+	assert.True(t, ok)
+	assert.NotNil(t, federator.getShard(65, true))
+	assert.True(t, federator.uncheckedWrite(key, mq.MetricReading{"foo.bar", 1, 65}))
+
+	stats := federator.collectStats()
+	assert.Contains(t, stats, "index.dir")
+	assert.Contains(t, stats, "index.map")
+	assert.Contains(t, stats, "shard.19700101")
+
+	config["stats-interval-seconds"] = "0"
+	assert.Panics(t, func() { parseConfig(config) })
+}
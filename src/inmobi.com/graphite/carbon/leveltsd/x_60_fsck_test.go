@@ -0,0 +1,176 @@
+package leveltsd
+
+import (
+	"github.com/jmhodges/levigo"
+	"github.com/stretchr/testify/assert"
+	"inmobi.com/graphite/carbon/mq"
+	"os"
+	"testing"
+	"time"
+)
+
+func _fsckKinds(report *FsckReport) map[string]int {
+	retval := make(map[string]int)
+	for _, p := range report.Problems {
+		retval[p.Kind]++
+	}
+	return retval
+}
+
+func TestFsckRepair(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	config := make(map[string]string)
+	config["root"] = dir
+
+	federator := buildStorage(config)
+	for _, m := range []string{"a.b", "a.c", "d.e"} {
+		key, ok := federator.createMetric(m)
+		assert.True(t, ok)
+		assert.True(t, federator.uncheckedWrite(key, mq.MetricReading{m, 1, 65}))
+	}
+	federator.flushAll()
+
+	/* Crash between the directory & the map db, both ways round */
+	idx := federator.idx
+	idx.pkey.Delete(idx.wo, []byte("a.c"))
+	idx.pkey.Put(idx.wo, []byte("f.g"), shortenMetricName([]byte("f.g")))
+	idx.pkey.Delete(idx.wo, codeKey(shortenMetricName([]byte("d.e"))))
+
+	/* As written by earlier versions */
+	s := federator._getShardFromDate("19700101", false)
+	s.db.Delete(s.wo, []byte(SCHEME_MAGIC_ID))
+	federator.release()
+
+	report, err := Fsck(dir, false, false)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Metrics, 3)
+	assert.Equal(t, report.Shards, 1)
+	assert.Equal(t, _fsckKinds(report), map[string]int{
+		FSCK_DANGLING_LEAF:      1,
+		FSCK_UNLISTED_METRIC:    1,
+		FSCK_MISSING_CODE_OWNER: 2,
+		FSCK_STALE_CODE_OWNER:   1,
+		FSCK_MISSING_MAGIC:      1,
+		FSCK_ORPHANED_CODE:      1,
+	})
+	assert.Equal(t, report.Outstanding(), len(report.Problems))
+
+	report, err = Fsck(dir, true, true)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Outstanding(), 0)
+
+	report, err = Fsck(dir, false, false)
+	assert.Nil(t, err)
+	assert.Equal(t, len(report.Problems), 0)
+
+	federator = buildStorage(config)
+	defer federator.release()
+	assert.Equal(t, federator.idx.listChildern("a"), []string{"b"})
+	assert.Equal(t, federator.idx.listChildern("f"), []string{"g"})
+
+	s = federator._getShardFromDate("19700101", false)
+	n, _ := s.purge(shortenMetricName([]byte("a.c")), true)
+	assert.Equal(t, n, uint64(0))
+}
+
+func TestFsckBadMagic(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	index, _ := mkIndex(dir)
+	index.release()
+
+	opts := levigo.NewOptions()
+	opts.SetCreateIfMissing(true)
+	db, err := levigo.Open(_shard_namer(dir, "19700101"), opts)
+	assert.Nil(t, err)
+	wo := levigo.NewWriteOptions()
+	db.Put(wo, []byte(SCHEME_MAGIC_ID), []byte("something else"))
+	db.Put(wo, []byte("short"), []byte("x"))
+	db.Close()
+	wo.Close()
+	opts.Close()
+
+	report, err := Fsck(dir, true, false)
+	assert.Nil(t, err)
+	assert.Equal(t, _fsckKinds(report), map[string]int{FSCK_BAD_MAGIC: 1, FSCK_MALFORMED_KEY: 1})
+	assert.Equal(t, report.Outstanding(), 2)
+}
+
+func TestFsckArchives(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	config := make(map[string]string)
+	config["root"] = dir
+
+	base := uint64(time.Date(2021, time.January, 3, 0, 0, 0, 0, time.UTC).Unix())
+	federator := buildStorage(config)
+	for _, m := range []string{"a.b", "a.c"} {
+		key, ok := federator.createMetric(m)
+		assert.True(t, ok)
+		assert.True(t, federator.uncheckedWrite(key, mq.MetricReading{m, 1, base + 60}))
+	}
+	federator.flushAll()
+	federator.release()
+
+	federator = buildStorage(config)
+	federator.config.Archive_after = 24 * time.Hour
+	assert.Equal(t, federator.archiveShards(time.Unix(int64(base), 0).Add(72*time.Hour)), []string{"20210103"})
+	_, err := federator.deleteMetric(&DeleteRequest{Path: "a.c"})
+	assert.Nil(t, err)
+	federator.release()
+
+	report, err := Fsck(dir, false, false)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Archives, 1)
+	assert.Equal(t, _fsckKinds(report), map[string]int{FSCK_ORPHANED_CODE: 1})
+
+	report, err = Fsck(dir, true, true)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Outstanding(), 0)
+
+	report, err = Fsck(dir, false, false)
+	assert.Nil(t, err)
+	assert.Equal(t, len(report.Problems), 0)
+
+	federator = buildStorage(config)
+	key, _ := federator.getMetric("a.b")
+	assert.Equal(t, federator.dataScan(key, base, base+86400), []Datapoint{{base + 60, 1}})
+	federator.release()
+
+	/* A block failing its checksum */
+	f, err := os.OpenFile(_archive_namer(dir, "20210103"), os.O_RDWR, 0)
+	assert.Nil(t, err)
+	f.WriteAt([]byte{0xff, 0xff}, 0)
+	f.Close()
+	report, err = Fsck(dir, true, true)
+	assert.Nil(t, err)
+	assert.Equal(t, _fsckKinds(report), map[string]int{FSCK_CORRUPT_ARCHIVE: 1})
+	assert.Equal(t, report.Outstanding(), 1)
+}
+
+func TestFsckPendingBackfill(t *testing.T) {
+	dir, cleanup := _makeDir()
+	defer cleanup()
+
+	/* As written before the reverse map */
+	index, _ := mkIndex(dir)
+	_, ok := index.getMetric("a.b", true)
+	assert.True(t, ok)
+	index.pkey.Delete(index.wo, []byte(_MAP_CODES_KEY))
+	index.release()
+
+	_, err := Fsck(dir, false, false)
+	assert.NotNil(t, err)
+	index, _ = openIndex(dir, false)
+	done, _ := index.pkey.Get(index.ro, []byte(_MAP_CODES_KEY))
+	index.release()
+	assert.Nil(t, done, "nothing is backfilled without repair")
+
+	report, err := Fsck(dir, true, false)
+	assert.Nil(t, err)
+	assert.Equal(t, report.Metrics, 1)
+}
@@ -3,25 +3,82 @@ package listener
 import (
 	"bufio"
 	"fmt"
+	"inmobi.com/graphite/carbon/admin"
 	"inmobi.com/graphite/carbon/audit"
 	"inmobi.com/graphite/carbon/logging"
 	"inmobi.com/graphite/carbon/mq"
-	"log"
 	"net"
+	"net/http"
+	"sort"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
-var logger *log.Logger
+var logger *logging.Logger
 
 type connnectionContext struct {
-	conn net.Conn
-	id   int64
+	conn  net.Conn
+	id    int64
+	stats *connectionStats
 }
 
+/* Tallies of a single live connection; served on the admin listener */
+type connectionStats struct {
+	Id        int64
+	Local     string
+	Remote    string
+	Since     time.Time
+	Lines     uint64
+	Garbled   uint64
+	Dropped   uint64 // due to the write buffer being full
+	Last_seen int64  // unix time of the last line received
+}
+
+var connections = make(map[int64]*connectionStats)
+var connectionsLock sync.Mutex
+
 func init() {
-	logger = logging.MakeLogger("plaintext-listener: ")
+	logger = logging.MakeLogger("plaintext-listener")
+	admin.HandleJSON("/connections", serveConnections)
+}
+
+func trackConnection(context connnectionContext) {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+	connections[context.id] = context.stats
+}
+
+func untrackConnection(context connnectionContext) {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+	delete(connections, context.id)
 }
 
+func serveConnections(r *http.Request) (interface{}, error) {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+
+	retval := make([]connectionStats, 0, len(connections))
+	for _, c := range connections {
+		retval = append(retval, connectionStats{
+			c.Id, c.Local, c.Remote, c.Since,
+			atomic.LoadUint64(&c.Lines),
+			atomic.LoadUint64(&c.Garbled),
+			atomic.LoadUint64(&c.Dropped),
+			atomic.LoadInt64(&c.Last_seen),
+		})
+	}
+	sort.Sort(byId(retval))
+	return retval, nil
+}
+
+type byId []connectionStats
+
+func (x byId) Len() int           { return len(x) }
+func (x byId) Less(i, j int) bool { return x[i].Id < x[j].Id }
+func (x byId) Swap(i, j int)      { x[i], x[j] = x[j], x[i] }
+
 type PlaintextConfig struct {
 	Port uint16
 }
@@ -53,11 +110,12 @@ func (this *PlaintextReceiver) Listen() {
 			client, err := server.Accept()
 			i++
 			if err != nil {
-				logger.Printf("connection(%010d) %v\n", err)
+				logger.Limited("accept").Errorf("connection(%010d) %v", i, err)
 				continue
 			}
-			logger.Printf("connection(%010d) %v <-> %v\n", i, client.LocalAddr(), client.RemoteAddr())
-			context := connnectionContext{client, i}
+			logger.Limited("connect").Infof("connection(%010d) %v <-> %v", i, client.LocalAddr(), client.RemoteAddr())
+			stats := &connectionStats{Id: i, Local: client.LocalAddr().String(), Remote: client.RemoteAddr().String(), Since: time.Now()}
+			context := connnectionContext{client, i, stats}
 			clients <- context
 		}
 	}()
@@ -75,7 +133,7 @@ func (this *PlaintextReceiver) Run() {
 }
 
 func (this *PlaintextReceiver) Close() {
-	logger.Printf("Shutting down listener %v", this)
+	logger.Infof("Shutting down listener on port %d", this.config.Port)
 	this.active = false
 	this.server.Close()
 }
@@ -94,6 +152,10 @@ func handleConn(context connnectionContext, writer_queue chan<- mq.MetricReading
 	client := context.conn
 	defer client.Close()
 
+	stats := context.stats
+	trackConnection(context)
+	defer untrackConnection(context)
+
 	b := bufio.NewReader(client)
 	i := 0
 	for {
@@ -102,12 +164,14 @@ func handleConn(context connnectionContext, writer_queue chan<- mq.MetricReading
 			/* Any sort of a line read error causes us to exit
 			If the last line of transmission lacks a newline, it is
 			discarded*/
-			logger.Printf("connection(%010d) received %d line(s); closing due to %v\n", context.id, i, err)
+			logger.Limited("disconnect").Infof("connection(%010d) received %d line(s); closing due to %v", context.id, i, err)
 			break
 		}
 		var val mq.MetricReading
 		var parts, _ = fmt.Sscanf(line, "%s %f %d", &val.Metric, &val.Val, &val.Time)
 		i++
+		atomic.AddUint64(&stats.Lines, 1)
+		atomic.StoreInt64(&stats.Last_seen, time.Now().Unix())
 
 		audit := audit.GetMetrics()
 		if parts == 3 {
@@ -116,12 +180,14 @@ func handleConn(context connnectionContext, writer_queue chan<- mq.MetricReading
 			case writer_queue <- val:
 
 			default:
-				logger.Println("write buffer is full")
+				logger.Limited("buffer-full").Warnf("write buffer is full")
+				atomic.AddUint64(&stats.Dropped, 1)
 				atomic.AddUint32(&audit.Writer.Cache_full_events, 1)
 			}
 		} else {
 			atomic.AddUint32(&audit.Garbled_reception, 1)
-			logger.Printf("connection(%010d) Garbled message: %v", context.id, line)
+			atomic.AddUint64(&stats.Garbled, 1)
+			logger.Limited("garbled").Warnf("connection(%010d) Garbled message: %q", context.id, line)
 		}
 	}
 }
@@ -0,0 +1,103 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+const _MAX_FILE_SIZE_MB = 256
+const _MAX_BACKUPS = 5
+const _SYSLOG_TAG = "koolstof"
+
+/*
+Applies the [logging] section of the config. Absent keys retain their
+defaults i.e. text lines of INFO & above on stdout, with rate limited call
+sites allowing 10 lines per key per minute.
+
+Errors are returned rather than logged as logging itself is what failed to
+be setup
+*/
+func Configure(config map[string]string) error {
+	level := INFO
+	if val, ok := config["level"]; ok {
+		var err error
+		if level, err = parseLevel(val); err != nil {
+			return err
+		}
+	}
+
+	format := formatText
+	if val, ok := config["format"]; ok {
+		if format, ok = formatters[val]; !ok {
+			return fmt.Errorf("unknown log format %q", val)
+		}
+	}
+
+	out, err := makeSink(config)
+	if err != nil {
+		return err
+	}
+
+	max, err := getInt(config, "rate-limit", _RATE_LIMIT)
+	if err != nil {
+		return err
+	}
+	interval, err := getInt(config, "rate-limit-interval-seconds", int(_RATE_LIMIT_INTERVAL/time.Second))
+	if err != nil {
+		return err
+	}
+	limiter.configure(max, time.Duration(interval)*time.Second)
+
+	current.Lock()
+	defer current.Unlock()
+
+	previous := current.out
+	current.level, current.format, current.out = level, format, out
+	return previous.close()
+}
+
+func makeSink(config map[string]string) (sink, error) {
+	switch output := config["output"]; output {
+	case "", "stdout":
+		return &writerSink{os.Stdout}, nil
+
+	case "file":
+		path, ok := config["file"]
+		if !ok {
+			return nil, fmt.Errorf("'file' is needed for file output")
+		}
+		maxSize, err := getInt(config, "max-size-mb", _MAX_FILE_SIZE_MB)
+		if err != nil {
+			return nil, err
+		}
+		backups, err := getInt(config, "max-backups", _MAX_BACKUPS)
+		if err != nil {
+			return nil, err
+		}
+		return openRotatingFile(path, int64(maxSize)<<20, backups)
+
+	case "syslog":
+		tag, ok := config["syslog-tag"]
+		if !ok {
+			tag = _SYSLOG_TAG
+		}
+		return openSyslog(tag)
+
+	default:
+		return nil, fmt.Errorf("unknown log output %q", output)
+	}
+}
+
+func getInt(config map[string]string, key string, def int) (int, error) {
+	val, ok := config[key]
+	if !ok {
+		return def, nil
+	}
+	x, err := strconv.Atoi(val)
+	if err != nil {
+		return 0, fmt.Errorf("parse error in %s %v", key, err)
+	}
+	return x, nil
+}
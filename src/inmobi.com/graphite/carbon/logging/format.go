@@ -0,0 +1,88 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Renders a record as a single line, including the trailing newline */
+type formatter func(r *record) []byte
+
+var formatters = map[string]formatter{
+	"text":   formatText,
+	"json":   formatJson,
+	"logfmt": formatLogfmt,
+}
+
+/* Errors and the likes do not serialize meaningfully on their own */
+func fieldValue(val interface{}) interface{} {
+	switch x := val.(type) {
+	case error:
+		return x.Error()
+	case fmt.Stringer:
+		return x.String()
+	}
+	return val
+}
+
+/* The classic format; close to what the standard library logger produces */
+func formatText(r *record) []byte {
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%s %-5s %s: %s", r.time.Format("2006/01/02 15:04:05"), strings.ToUpper(r.level.String()), r.logger, r.msg)
+	for _, f := range r.fields {
+		fmt.Fprintf(buf, " %s=%v", f.key, fieldValue(f.val))
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+func formatJson(r *record) []byte {
+	m := make(map[string]interface{}, len(r.fields)+4)
+	for _, f := range r.fields {
+		m[f.key] = fieldValue(f.val)
+	}
+	m["time"] = r.time.Format(time.RFC3339Nano)
+	m["level"] = r.level.String()
+	m["logger"] = r.logger
+	m["msg"] = r.msg
+
+	buf, err := json.Marshal(m)
+	if err != nil {
+		buf, _ = json.Marshal(map[string]string{
+			"time":   r.time.Format(time.RFC3339Nano),
+			"level":  r.level.String(),
+			"logger": r.logger,
+			"msg":    r.msg,
+			"error":  err.Error(),
+		})
+	}
+	return append(buf, '\n')
+}
+
+func formatLogfmt(r *record) []byte {
+	buf := new(bytes.Buffer)
+	writeLogfmtPair(buf, "time", r.time.Format(time.RFC3339Nano))
+	writeLogfmtPair(buf, "level", r.level.String())
+	writeLogfmtPair(buf, "logger", r.logger)
+	writeLogfmtPair(buf, "msg", r.msg)
+	for _, f := range r.fields {
+		writeLogfmtPair(buf, f.key, fmt.Sprint(fieldValue(f.val)))
+	}
+	buf.Bytes()[buf.Len()-1] = '\n'
+	return buf.Bytes()
+}
+
+func writeLogfmtPair(buf *bytes.Buffer, key string, val string) {
+	buf.WriteString(key)
+	buf.WriteByte('=')
+	if val == "" || strings.ContainsAny(val, " =\"\t\r\n") {
+		buf.WriteString(strconv.Quote(val))
+	} else {
+		buf.WriteString(val)
+	}
+	buf.WriteByte(' ')
+}
@@ -2,12 +2,141 @@ package logging
 
 import (
 	"encoding/json"
-	"log"
-	"os"
+	"fmt"
+	"strings"
+	"time"
 )
 
-func MakeLogger(name string) *log.Logger {
-	return log.New(os.Stdout, name, log.LstdFlags)
+type Level int
+
+const (
+	DEBUG Level = iota
+	INFO
+	WARN
+	ERROR
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < DEBUG || l > ERROR {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+func parseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return INFO, fmt.Errorf("unknown log level %q", s)
+}
+
+type field struct {
+	key string
+	val interface{}
+}
+
+/* A single log line prior to formatting */
+type record struct {
+	time   time.Time
+	level  Level
+	logger string
+	msg    string
+	fields []field
+}
+
+/*
+A named, leveled logger. Loggers are cheap to derive; attaching fields or a
+rate limit returns a new logger and leaves the receiver untouched.
+
+The output destination, format and threshold level are process wide and can
+be changed via Configure at any point in time, including after a logger has
+been created
+*/
+type Logger struct {
+	name   string
+	fields []field
+	limit  string // rate limiting key; empty if unlimited
+}
+
+func MakeLogger(name string) *Logger {
+	return &Logger{name: name}
+}
+
+/* Returns a logger which attaches a key-value pair to every line */
+func (this *Logger) With(key string, val interface{}) *Logger {
+	retval := *this
+	retval.fields = make([]field, len(this.fields), len(this.fields)+1)
+	copy(retval.fields, this.fields)
+	retval.fields = append(retval.fields, field{key, val})
+	return &retval
+}
+
+/* Returns a logger whose output is rate limited. All loggers of the same
+name sharing a key share the limit. Meant for the hot paths wherein a
+misbehaving client or a sick disk can otherwise flood the logs */
+func (this *Logger) Limited(key string) *Logger {
+	retval := *this
+	retval.limit = this.name + "/" + key
+	return &retval
+}
+
+func (this *Logger) Enabled(level Level) bool {
+	return level >= currentLevel()
+}
+
+func (this *Logger) Debugf(format string, v ...interface{}) {
+	this.logf(DEBUG, format, v...)
+}
+
+func (this *Logger) Infof(format string, v ...interface{}) {
+	this.logf(INFO, format, v...)
+}
+
+func (this *Logger) Warnf(format string, v ...interface{}) {
+	this.logf(WARN, format, v...)
+}
+
+func (this *Logger) Errorf(format string, v ...interface{}) {
+	this.logf(ERROR, format, v...)
+}
+
+/* Logs at ERROR level and then panics; panics are never rate limited */
+func (this *Logger) Panicf(format string, v ...interface{}) {
+	msg := fmt.Sprintf(format, v...)
+	this.output(ERROR, msg, false)
+	panic(msg)
+}
+
+func (this *Logger) Panicln(v ...interface{}) {
+	msg := fmt.Sprintln(v...)
+	this.output(ERROR, msg, false)
+	panic(msg)
+}
+
+func (this *Logger) logf(level Level, format string, v ...interface{}) {
+	if !this.Enabled(level) {
+		return
+	}
+	this.output(level, fmt.Sprintf(format, v...), true)
+}
+
+func (this *Logger) output(level Level, msg string, limit bool) {
+	fields := this.fields
+	if limit && this.limit != "" {
+		ok, suppressed := limiter.allow(this.limit)
+		if !ok {
+			return
+		}
+		if suppressed != 0 {
+			fields = append(fields[:len(fields):len(fields)], field{"suppressed", suppressed})
+		}
+	}
+	r := record{time.Now(), level, this.name, strings.TrimRight(msg, "\n"), fields}
+	emit(&r)
 }
 
 func ObjectJsonifier(x interface{}) string {
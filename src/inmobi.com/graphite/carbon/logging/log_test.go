@@ -0,0 +1,67 @@
+package logging
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimitWindow(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newRateLimiter(2, time.Minute)
+	l.now = func() time.Time { return now }
+
+	ok, _ := l.allow("x")
+	assert.True(t, ok)
+	ok, _ = l.allow("x")
+	assert.True(t, ok)
+	ok, _ = l.allow("x")
+	assert.False(t, ok)
+	ok, _ = l.allow("x")
+	assert.False(t, ok)
+
+	ok, _ = l.allow("y")
+	assert.True(t, ok, "keys are limited independently")
+
+	now = now.Add(time.Minute)
+	ok, suppressed := l.allow("x")
+	assert.True(t, ok)
+	assert.Equal(t, suppressed, 2)
+
+	ok, suppressed = l.allow("x")
+	assert.True(t, ok)
+	assert.Equal(t, suppressed, 0)
+}
+
+func TestLogfmt(t *testing.T) {
+	r := record{time.Unix(0, 0).UTC(), WARN, "listener", "Garbled message", []field{{"connection", 42}, {"err", errors.New("bad input")}}}
+	line := string(formatLogfmt(&r))
+	assert.Equal(t, line, `time=1970-01-01T00:00:00Z level=warn logger=listener msg="Garbled message" connection=42 err="bad input"`+"\n")
+}
+
+func TestJson(t *testing.T) {
+	r := record{time.Unix(0, 0).UTC(), INFO, "audit", "hello", []field{{"n", 1}}}
+	line := string(formatJson(&r))
+	assert.True(t, strings.HasSuffix(line, "\n"))
+	assert.Contains(t, line, `"level":"info"`)
+	assert.Contains(t, line, `"logger":"audit"`)
+	assert.Contains(t, line, `"msg":"hello"`)
+	assert.Contains(t, line, `"n":1`)
+}
+
+func TestParseLevel(t *testing.T) {
+	l, err := parseLevel("WARN")
+	assert.Nil(t, err)
+	assert.Equal(t, l, WARN)
+
+	_, err = parseLevel("chatty")
+	assert.NotNil(t, err)
+}
+
+func TestConfigureRejectsUnknown(t *testing.T) {
+	assert.NotNil(t, Configure(map[string]string{"format": "xml"}))
+	assert.NotNil(t, Configure(map[string]string{"output": "carrier-pigeon"}))
+	assert.NotNil(t, Configure(map[string]string{"output": "file"}))
+}
@@ -0,0 +1,64 @@
+package logging
+
+import (
+	"sync"
+	"time"
+)
+
+const _RATE_LIMIT = 10
+const _RATE_LIMIT_INTERVAL = 60 * time.Second
+
+/* Fixed window rate limiter keyed by an arbitrary string */
+type rateLimiter struct {
+	lock     sync.Mutex
+	max      int
+	interval time.Duration
+	windows  map[string]*window
+	now      func() time.Time
+}
+
+type window struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+var limiter = newRateLimiter(_RATE_LIMIT, _RATE_LIMIT_INTERVAL)
+
+func newRateLimiter(max int, interval time.Duration) *rateLimiter {
+	return &rateLimiter{max: max, interval: interval, windows: make(map[string]*window), now: time.Now}
+}
+
+func (this *rateLimiter) configure(max int, interval time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.max, this.interval = max, interval
+}
+
+/* Decides whether a line may be logged. When a new window begins, the
+number of lines suppressed during the previous one is handed out once so
+that it can be reported along with the line */
+func (this *rateLimiter) allow(key string) (bool, int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := this.now()
+	w, ok := this.windows[key]
+	if !ok {
+		w = &window{start: now}
+		this.windows[key] = w
+	}
+
+	suppressed := 0
+	if now.Sub(w.start) >= this.interval {
+		suppressed = w.suppressed
+		w.start, w.count, w.suppressed = now, 0, 0
+	}
+
+	if this.max > 0 && w.count >= this.max {
+		w.suppressed++
+		return false, 0
+	}
+	w.count++
+	return true, suppressed
+}
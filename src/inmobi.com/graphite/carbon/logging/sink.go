@@ -0,0 +1,145 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+)
+
+/* A destination for formatted log lines */
+type sink interface {
+	write(level Level, line []byte) error
+	close() error
+}
+
+type writerSink struct {
+	w io.Writer
+}
+
+func (this *writerSink) write(level Level, line []byte) error {
+	_, err := this.w.Write(line)
+	return err
+}
+
+func (this *writerSink) close() error {
+	return nil
+}
+
+/*
+A file that is rotated once it grows beyond a given size. Rotated files are
+suffixed with .1, .2 ... with .1 being the most recent; anything beyond the
+configured number of backups is discarded
+*/
+type rotatingFileSink struct {
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFileSink, error) {
+	retval := &rotatingFileSink{path: path, maxSize: maxSize, backups: backups}
+	if err := retval.open(); err != nil {
+		return nil, err
+	}
+	return retval, nil
+}
+
+func (this *rotatingFileSink) open() error {
+	f, err := os.OpenFile(this.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	this.file, this.size = f, stat.Size()
+	return nil
+}
+
+func (this *rotatingFileSink) rotate() error {
+	this.file.Close()
+	for i := this.backups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", this.path, i), fmt.Sprintf("%s.%d", this.path, i+1))
+	}
+	if this.backups > 0 {
+		os.Rename(this.path, this.path+".1")
+	} else {
+		os.Remove(this.path)
+	}
+	return this.open()
+}
+
+func (this *rotatingFileSink) write(level Level, line []byte) error {
+	if this.maxSize > 0 && this.size+int64(len(line)) > this.maxSize && this.size > 0 {
+		if err := this.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := this.file.Write(line)
+	this.size += int64(n)
+	return err
+}
+
+func (this *rotatingFileSink) close() error {
+	return this.file.Close()
+}
+
+/* Writes to the local syslog daemon over its unix socket */
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func openSyslog(tag string) (*syslogSink, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w}, nil
+}
+
+func (this *syslogSink) write(level Level, line []byte) error {
+	msg := strings.TrimRight(string(line), "\n")
+	switch level {
+	case DEBUG:
+		return this.w.Debug(msg)
+	case INFO:
+		return this.w.Info(msg)
+	case WARN:
+		return this.w.Warning(msg)
+	}
+	return this.w.Err(msg)
+}
+
+func (this *syslogSink) close() error {
+	return this.w.Close()
+}
+
+/* The process wide logging setup */
+var current = struct {
+	sync.RWMutex
+	level  Level
+	format formatter
+	out    sink
+}{level: INFO, format: formatText, out: &writerSink{os.Stdout}}
+
+func currentLevel() Level {
+	current.RLock()
+	defer current.RUnlock()
+	return current.level
+}
+
+func emit(r *record) {
+	current.Lock()
+	defer current.Unlock()
+
+	if err := current.out.write(r.level, current.format(r)); err != nil {
+		fmt.Fprintf(os.Stderr, "logging: %v\n", err)
+	}
+}
@@ -0,0 +1,756 @@
+package query
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/* The functions of graphite-web that dashboards use the most; see the
+graphite documentation for what each does */
+func init() {
+	for name, fn := range map[string]string{
+		"sumSeries":      "sum",
+		"sum":            "sum",
+		"averageSeries":  "average",
+		"avg":            "average",
+		"minSeries":      "min",
+		"maxSeries":      "max",
+		"diffSeries":     "diff",
+		"multiplySeries": "multiply",
+		"rangeSeries":    "range",
+		"countSeries":    "count",
+	} {
+		Register(name, aggregateFunction(fn))
+	}
+	for name, fn := range map[string]string{
+		"movingAverage": "average",
+		"movingSum":     "sum",
+		"movingMin":     "min",
+		"movingMax":     "max",
+	} {
+		Register(name, movingFunction(fn))
+	}
+
+	Register("scale", scale)
+	Register("offset", offset)
+	Register("absolute", absolute)
+	Register("derivative", derivative)
+	Register("nonNegativeDerivative", nonNegativeDerivative)
+	Register("perSecond", perSecond)
+	Register("integral", integral)
+	Register("keepLastValue", keepLastValue)
+	Register("transformNull", transformNull)
+	Register("asPercent", asPercent)
+	Register("alias", alias)
+	Register("aliasByNode", aliasByNode)
+	Register("aliasSub", aliasSub)
+	Register("groupByNode", groupByNode)
+	Register("sortByName", sortByName)
+	Register("limit", limit)
+	Register("grep", grepFunction(false))
+	Register("exclude", grepFunction(true))
+}
+
+/* Reduce the values of a row that are not NaN, of which there is at least
+one, to one */
+var aggregators = map[string]func([]float64) float64{
+	"sum":     sumOf,
+	"total":   sumOf,
+	"average": func(v []float64) float64 { return sumOf(v) / float64(len(v)) },
+	"avg":     func(v []float64) float64 { return sumOf(v) / float64(len(v)) },
+	"min": func(v []float64) float64 {
+		retval := v[0]
+		for _, x := range v[1:] {
+			retval = math.Min(retval, x)
+		}
+		return retval
+	},
+	"max": func(v []float64) float64 {
+		retval := v[0]
+		for _, x := range v[1:] {
+			retval = math.Max(retval, x)
+		}
+		return retval
+	},
+	"diff": func(v []float64) float64 { return v[0] - sumOf(v[1:]) },
+	"multiply": func(v []float64) float64 {
+		retval := 1.0
+		for _, x := range v {
+			retval *= x
+		}
+		return retval
+	},
+	"range": func(v []float64) float64 {
+		lo, hi := v[0], v[0]
+		for _, x := range v[1:] {
+			lo, hi = math.Min(lo, x), math.Max(hi, x)
+		}
+		return hi - lo
+	},
+	"count": func(v []float64) float64 { return float64(len(v)) },
+	"last":  func(v []float64) float64 { return v[len(v)-1] },
+}
+
+func sumOf(v []float64) float64 {
+	retval := 0.0
+	for _, x := range v {
+		retval += x
+	}
+	return retval
+}
+
+/* The average of the values that are not NaN; NaN if there are none */
+func avgOf(values []float64) float64 {
+	if v := notNaN(values); len(v) > 0 {
+		return sumOf(v) / float64(len(v))
+	}
+	return math.NaN()
+}
+
+func notNaN(values []float64) []float64 {
+	retval := make([]float64, 0, len(values))
+	for _, x := range values {
+		if !math.IsNaN(x) {
+			retval = append(retval, x)
+		}
+	}
+	return retval
+}
+
+/* Applies an aggregator to a row; NaN if it is all NaN */
+func reduce(fn func([]float64) float64, row []float64) float64 {
+	if v := notNaN(row); len(v) > 0 {
+		return fn(v)
+	}
+	return math.NaN()
+}
+
+func title(s string) string {
+	return strings.ToUpper(s[:1]) + s[1:]
+}
+
+/* Formats a number as python's %g does */
+func formatG(x float64) string {
+	return strconv.FormatFloat(x, 'g', 6, 64)
+}
+
+/* The path expressions of series, each once & sorted; what graphite names
+series combined from others by */
+func pathExpressions(series []*Series) string {
+	seen := make(map[string]bool)
+	retval := make([]string, 0)
+	for _, s := range series {
+		if !seen[s.PathExpression] {
+			seen[s.PathExpression] = true
+			retval = append(retval, s.PathExpression)
+		}
+	}
+	sort.Strings(retval)
+	return strings.Join(retval, ",")
+}
+
+/* Combines series value by value into one, named as fnSeries(...) */
+func aggregate(series []*Series, fn string) ([]*Series, error) {
+	agg, ok := aggregators[fn]
+	if !ok {
+		return nil, fmt.Errorf("no aggregation by the name of %s", fn)
+	}
+	if len(series) == 0 {
+		return []*Series{}, nil
+	}
+	values, start, end, step := normalize(series)
+	combined := make([]float64, 0)
+	for _, row := range rows(values) {
+		combined = append(combined, reduce(agg, row))
+	}
+	name := fmt.Sprintf("%sSeries(%s)", fn, pathExpressions(series))
+	return []*Series{{name, name, start, end, step, combined}}, nil
+}
+
+/* sumSeries(*seriesLists) & the like */
+func aggregateFunction(fn string) Function {
+	return func(c *Call) ([]*Series, error) {
+		series, err := c.SeriesLists(0)
+		if err != nil {
+			return nil, err
+		}
+		return aggregate(series, fn)
+	}
+}
+
+/* Applies f to every value of every series, renaming each as name(series,
+arg); as graphite does, the path expression becomes the name */
+func mapValues(c *Call, f func(float64) float64, suffix string) ([]*Series, error) {
+	series, err := c.Series(0, "seriesList")
+	if err != nil {
+		return nil, err
+	}
+	retval := make([]*Series, 0, len(series))
+	for _, s := range series {
+		x := s.derive(fmt.Sprintf("%s(%s%s)", c.Name(), s.Name, suffix), append([]float64(nil), s.Values...))
+		for i, v := range x.Values {
+			x.Values[i] = f(v)
+		}
+		retval = append(retval, x)
+	}
+	return retval, nil
+}
+
+/* scale(seriesList, factor) */
+func scale(c *Call) ([]*Series, error) {
+	factor, err := c.Float(1, "factor")
+	if err != nil {
+		return nil, err
+	}
+	return mapValues(c, func(v float64) float64 { return v * factor }, ","+formatG(factor))
+}
+
+/* offset(seriesList, factor) */
+func offset(c *Call) ([]*Series, error) {
+	factor, err := c.Float(1, "factor")
+	if err != nil {
+		return nil, err
+	}
+	return mapValues(c, func(v float64) float64 { return v + factor }, ","+formatG(factor))
+}
+
+/* absolute(seriesList) */
+func absolute(c *Call) ([]*Series, error) {
+	return mapValues(c, math.Abs, "")
+}
+
+/* transformNull(seriesList, default=0) */
+func transformNull(c *Call) ([]*Series, error) {
+	def, err := c.FloatOr(1, "default", 0)
+	if err != nil {
+		return nil, err
+	}
+	return mapValues(c, func(v float64) float64 {
+		if math.IsNaN(v) {
+			return def
+		}
+		return v
+	}, ","+formatG(def))
+}
+
+/* Derives a series from each, value by value, named as name(series) */
+func deriveValues(c *Call, f func(s *Series) []float64) ([]*Series, error) {
+	series, err := c.Series(0, "seriesList")
+	if err != nil {
+		return nil, err
+	}
+	retval := make([]*Series, 0, len(series))
+	for _, s := range series {
+		retval = append(retval, s.derive(fmt.Sprintf("%s(%s)", c.Name(), s.Name), f(s)))
+	}
+	return retval, nil
+}
+
+/* derivative(seriesList) */
+func derivative(c *Call) ([]*Series, error) {
+	return deriveValues(c, func(s *Series) []float64 {
+		retval := make([]float64, len(s.Values))
+		prev := math.NaN()
+		for i, v := range s.Values {
+			retval[i] = v - prev // NaN if either is
+			prev = v
+		}
+		return retval
+	})
+}
+
+/* integral(seriesList) */
+func integral(c *Call) ([]*Series, error) {
+	return deriveValues(c, func(s *Series) []float64 {
+		retval := make([]float64, len(s.Values))
+		current := 0.0
+		for i, v := range s.Values {
+			if math.IsNaN(v) {
+				retval[i] = v
+				continue
+			}
+			current += v
+			retval[i] = current
+		}
+		return retval
+	})
+}
+
+/*
+The increase of a counter from prev to v, along with the value to take as
+prev next; as graphite's _nonNegativeDelta. A counter that goes down wrapped
+past maxValue, or else was reset to minValue; the increase is NaN if neither
+is known
+*/
+func nonNegativeDelta(v float64, prev float64, maxValue float64, minValue float64) (float64, float64) {
+	if v > maxValue || v < minValue {
+		return math.NaN(), math.NaN()
+	}
+	if math.IsNaN(prev) || math.IsNaN(v) {
+		return math.NaN(), v
+	}
+	if v >= prev {
+		return v - prev, v
+	}
+	if !math.IsInf(maxValue, 1) {
+		return maxValue + 1 + v - prev, v
+	}
+	if !math.IsInf(minValue, -1) {
+		return v - minValue, v
+	}
+	return math.NaN(), v
+}
+
+func _counterBounds(c *Call) (float64, float64, error) {
+	maxValue, err := c.FloatOr(1, "maxValue", math.Inf(1))
+	if err != nil {
+		return 0, 0, err
+	}
+	minValue, err := c.FloatOr(2, "minValue", math.Inf(-1))
+	return maxValue, minValue, err
+}
+
+/* nonNegativeDerivative(seriesList, maxValue=None, minValue=None) */
+func nonNegativeDerivative(c *Call) ([]*Series, error) {
+	maxValue, minValue, err := _counterBounds(c)
+	if err != nil {
+		return nil, err
+	}
+	return deriveValues(c, func(s *Series) []float64 {
+		retval := make([]float64, len(s.Values))
+		prev := math.NaN()
+		for i, v := range s.Values {
+			retval[i], prev = nonNegativeDelta(v, prev, maxValue, minValue)
+		}
+		return retval
+	})
+}
+
+/* perSecond(seriesList, maxValue=None, minValue=None); rates are rounded to
+6 places, as graphite does */
+func perSecond(c *Call) ([]*Series, error) {
+	maxValue, minValue, err := _counterBounds(c)
+	if err != nil {
+		return nil, err
+	}
+	return deriveValues(c, func(s *Series) []float64 {
+		retval := make([]float64, len(s.Values))
+		prev := math.NaN()
+		for i, v := range s.Values {
+			var delta float64
+			delta, prev = nonNegativeDelta(v, prev, maxValue, minValue)
+			retval[i] = math.Round(delta/float64(s.Step)*1e6) / 1e6
+		}
+		return retval
+	})
+}
+
+/* keepLastValue(seriesList, limit=INF); runs of no more than limit missing
+values are filled with the value before them */
+func keepLastValue(c *Call) ([]*Series, error) {
+	n, err := c.FloatOr(1, "limit", math.Inf(1))
+	if err != nil {
+		return nil, err
+	}
+	return mapSeries(c, "", func(s *Series) {
+		missing := 0
+		fill := func(end int) {
+			if missing > 0 && float64(missing) <= n {
+				for i := end - missing; i < end; i++ {
+					s.Values[i] = s.Values[end-missing-1]
+				}
+			}
+			missing = 0
+		}
+		for i, v := range s.Values {
+			if i == 0 {
+				continue // nothing came before it
+			}
+			if math.IsNaN(v) {
+				missing++
+			} else {
+				fill(i)
+			}
+		}
+		fill(len(s.Values))
+	})
+}
+
+/* Alters a copy of each series in place, renaming it as name(series...);
+the path expression becomes the name, as with mapValues */
+func mapSeries(c *Call, suffix string, f func(s *Series)) ([]*Series, error) {
+	series, err := c.Series(0, "seriesList")
+	if err != nil {
+		return nil, err
+	}
+	retval := make([]*Series, 0, len(series))
+	for _, s := range series {
+		x := s.derive(fmt.Sprintf("%s(%s%s)", c.Name(), s.Name, suffix), append([]float64(nil), s.Values...))
+		f(x)
+		retval = append(retval, x)
+	}
+	return retval, nil
+}
+
+/*
+movingAverage(seriesList, windowSize, xFilesFactor=None) & the like. The
+window is a number of values, or else a time offset such as '5min' that spans
+as many whole steps of each series. Each value is the aggregate of the window
+of values before it; the series are fetched early enough for the first values
+to have one & the values before the range are left out
+*/
+func movingFunction(fn string) Function {
+	return func(c *Call) ([]*Series, error) {
+		window := c.Arg(1, "windowSize")
+		if window == nil {
+			return nil, fmt.Errorf("missing windowSize")
+		}
+		xff, err := c.FloatOr(2, "xFilesFactor", 0)
+		if err != nil {
+			return nil, err
+		}
+
+		var preview uint64
+		switch {
+		case window.Kind == EXPR_STRING:
+			seconds, err := ParseOffset(window.Str)
+			if err != nil {
+				return nil, err
+			}
+			if seconds < 0 {
+				seconds = -seconds
+			}
+			preview = uint64(seconds)
+		case window.Kind == EXPR_NUMBER && window.IsInt && window.Number > 0:
+			/* By the steps of the series, as fetched over the range */
+			series, err := c.Series(0, "seriesList")
+			if err != nil {
+				return nil, err
+			}
+			for _, s := range series {
+				if x := s.Step * uint64(window.Number); x > preview {
+					preview = x
+				}
+			}
+		default:
+			return nil, fmt.Errorf("windowSize: expected a positive integer or a time offset but got %s", window.Text)
+		}
+
+		from, _ := c.Range()
+		if preview > from {
+			preview = from
+		}
+		series, err := c.SeriesFrom(0, "seriesList", from-preview)
+		if err != nil {
+			return nil, err
+		}
+		retval := make([]*Series, 0, len(series))
+		for _, s := range series {
+			points := int(window.Number)
+			name := fmt.Sprintf("moving%s(%s,%s)", title(fn), s.Name, window.Text)
+			if window.Kind == EXPR_STRING {
+				points = int(preview / s.Step)
+				name = fmt.Sprintf("moving%s(%s,\"%s\")", title(fn), s.Name, window.Str)
+			}
+			values := make([]float64, 0)
+			start := s.Start + uint64(points)*s.Step
+			for i := points; i < len(s.Values); i++ {
+				if start+uint64(i-points)*s.Step < from {
+					continue
+				}
+				v := notNaN(s.Values[i-points : i])
+				if len(v) > 0 && float64(len(v))/float64(points) >= xff {
+					values = append(values, aggregators[fn](v))
+				} else {
+					values = append(values, math.NaN())
+				}
+			}
+			for start < from {
+				start += s.Step
+			}
+			x := s.derive(name, values)
+			x.Start = start
+			retval = append(retval, x)
+		}
+		return retval, nil
+	}
+}
+
+/* asPercent(seriesList, total=None); the total is the sum of the series,
+a number, a single series or one series per series, matched by name */
+func asPercent(c *Call) ([]*Series, error) {
+	series, err := c.Series(0, "seriesList")
+	if err != nil {
+		return nil, err
+	}
+	percent := func(v float64, total float64) float64 {
+		if total == 0 {
+			return math.NaN()
+		}
+		return v / total * 100
+	}
+	each := func(s *Series, totals []float64, totalName string) *Series {
+		values := make([]float64, len(s.Values))
+		for i, v := range s.Values {
+			values[i] = math.NaN()
+			if i < len(totals) {
+				values[i] = percent(v, totals[i])
+			}
+		}
+		return s.derive(fmt.Sprintf("asPercent(%s,%s)", s.Name, totalName), values)
+	}
+
+	retval := make([]*Series, 0, len(series))
+	total := c.Arg(1, "total")
+	switch {
+	case total == nil:
+		if len(series) == 0 {
+			return retval, nil
+		}
+		totals := make([]float64, 0)
+		for _, row := range rows(seriesValues(series)) {
+			totals = append(totals, reduce(sumOf, row))
+		}
+		name := fmt.Sprintf("sumSeries(%s)", pathExpressions(series))
+		for _, s := range series {
+			retval = append(retval, each(s, totals, name))
+		}
+	case total.Kind == EXPR_NUMBER:
+		for _, s := range series {
+			totals := make([]float64, len(s.Values))
+			for i := range totals {
+				totals[i] = total.Number
+			}
+			retval = append(retval, each(s, totals, total.Text))
+		}
+	default:
+		totals, err := c.Series(1, "total")
+		if err != nil {
+			return nil, err
+		}
+		switch len(totals) {
+		case 1:
+			for _, s := range series {
+				retval = append(retval, each(s, totals[0].Values, totals[0].Name))
+			}
+		case len(series):
+			series, totals = byName(series), byName(totals)
+			for i, s := range series {
+				retval = append(retval, each(s, totals[i].Values, totals[i].Name))
+			}
+		default:
+			return nil, fmt.Errorf("total is to be a number, a single series or as many series as seriesList")
+		}
+	}
+	return retval, nil
+}
+
+func seriesValues(series []*Series) [][]float64 {
+	retval := make([][]float64, len(series))
+	for i, s := range series {
+		retval[i] = s.Values
+	}
+	return retval
+}
+
+/* A copy of series in order of name */
+func byName(series []*Series) []*Series {
+	retval := append([]*Series(nil), series...)
+	sort.SliceStable(retval, func(i, j int) bool { return retval[i].Name < retval[j].Name })
+	return retval
+}
+
+/* alias(seriesList, newName) */
+func alias(c *Call) ([]*Series, error) {
+	series, err := c.Series(0, "seriesList")
+	if err != nil {
+		return nil, err
+	}
+	name, err := c.String(1, "newName")
+	if err != nil {
+		return nil, err
+	}
+	retval := make([]*Series, 0, len(series))
+	for _, s := range series {
+		retval = append(retval, s.rename(name))
+	}
+	return retval, nil
+}
+
+/* The first path expression in the name of a series, e.g. a.b of
+scale(a.b,2); the name if it is none */
+func firstPath(name string) string {
+	expr, err := Parse(name)
+	if err != nil {
+		return name
+	}
+	var walk func(*Expr) string
+	walk = func(e *Expr) string {
+		if e.Kind == EXPR_PATH {
+			return e.Name
+		}
+		for _, arg := range e.Args {
+			if path := walk(arg); path != "" {
+				return path
+			}
+		}
+		return ""
+	}
+	if path := walk(expr); path != "" {
+		return path
+	}
+	return name
+}
+
+/* The nodes of a metric at the given positions, counting back from the
+end if negative, joined; an out of range node is blank */
+func pickNodes(metric string, nodes []int) string {
+	parts := strings.Split(metric, ".")
+	picked := make([]string, len(nodes))
+	for i, n := range nodes {
+		if n < 0 {
+			n += len(parts)
+		}
+		if n >= 0 && n < len(parts) {
+			picked[i] = parts[n]
+		}
+	}
+	return strings.Join(picked, ".")
+}
+
+/* aliasByNode(seriesList, *nodes) */
+func aliasByNode(c *Call) ([]*Series, error) {
+	series, err := c.Series(0, "seriesList")
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := c.Ints(1, "nodes")
+	if err != nil {
+		return nil, err
+	}
+	retval := make([]*Series, 0, len(series))
+	for _, s := range series {
+		retval = append(retval, s.rename(pickNodes(firstPath(s.Name), nodes)))
+	}
+	return retval, nil
+}
+
+/* Python's \1 style references of a replacement in the style of Go */
+var pythonGroup = regexp.MustCompile(`\\(\d+)`)
+
+/* aliasSub(seriesList, search, replace) */
+func aliasSub(c *Call) ([]*Series, error) {
+	series, err := c.Series(0, "seriesList")
+	if err != nil {
+		return nil, err
+	}
+	search, err := c.String(1, "search")
+	if err != nil {
+		return nil, err
+	}
+	replace, err := c.String(2, "replace")
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(search)
+	if err != nil {
+		return nil, err
+	}
+	replace = pythonGroup.ReplaceAllString(strings.Replace(replace, "$", "$$", -1), "$${$1}")
+	retval := make([]*Series, 0, len(series))
+	for _, s := range series {
+		retval = append(retval, s.rename(re.ReplaceAllString(s.Name, replace)))
+	}
+	return retval, nil
+}
+
+/* groupByNode(seriesList, nodeNum, callback='average'); the groups are in
+order of their first series */
+func groupByNode(c *Call) ([]*Series, error) {
+	series, err := c.Series(0, "seriesList")
+	if err != nil {
+		return nil, err
+	}
+	node, err := c.Int(1, "nodeNum")
+	if err != nil {
+		return nil, err
+	}
+	callback, err := c.StringOr(2, "callback", "average")
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[string][]*Series)
+	keys := make([]string, 0)
+	for _, s := range series {
+		key := pickNodes(s.Name, []int{node})
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], s)
+	}
+	retval := make([]*Series, 0, len(keys))
+	for _, key := range keys {
+		combined, err := aggregate(groups[key], callback)
+		if err != nil {
+			return nil, err
+		}
+		combined[0].Name = key
+		retval = append(retval, combined[0])
+	}
+	return retval, nil
+}
+
+/* sortByName(seriesList) */
+func sortByName(c *Call) ([]*Series, error) {
+	series, err := c.Series(0, "seriesList")
+	if err != nil {
+		return nil, err
+	}
+	return byName(series), nil
+}
+
+/* limit(seriesList, n) */
+func limit(c *Call) ([]*Series, error) {
+	series, err := c.Series(0, "seriesList")
+	if err != nil {
+		return nil, err
+	}
+	n, err := c.Int(1, "n")
+	if err != nil {
+		return nil, err
+	}
+	if n >= 0 && n < len(series) {
+		series = series[:n]
+	}
+	return series, nil
+}
+
+/* grep(seriesList, pattern) & exclude(seriesList, pattern) */
+func grepFunction(exclude bool) Function {
+	return func(c *Call) ([]*Series, error) {
+		series, err := c.Series(0, "seriesList")
+		if err != nil {
+			return nil, err
+		}
+		pattern, err := c.String(1, "pattern")
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		retval := make([]*Series, 0, len(series))
+		for _, s := range series {
+			if re.MatchString(s.Name) != exclude {
+				retval = append(retval, s)
+			}
+		}
+		return retval, nil
+	}
+}
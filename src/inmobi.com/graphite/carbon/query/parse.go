@@ -0,0 +1,181 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type ExprKind int
+
+const (
+	EXPR_PATH ExprKind = iota
+	EXPR_CALL
+	EXPR_NUMBER
+	EXPR_STRING
+	EXPR_BOOL
+)
+
+/*
+A parsed target or argument. Path expressions may hold globs, e.g.
+a.{b,c}.*; numbers are integers unless written with a point or an exponent
+*/
+type Expr struct {
+	Kind   ExprKind
+	Text   string           // as written
+	Name   string           // of a path expression or function
+	Args   []*Expr          // positional
+	Kwargs map[string]*Expr // by keyword, e.g. func(a.b, n=1)
+	Number float64
+	IsInt  bool
+	Str    string
+	Bool   bool
+}
+
+type parser struct {
+	in  string
+	pos int
+}
+
+/* Parses a target; it is to be a single expression */
+func Parse(target string) (*Expr, error) {
+	p := &parser{target, 0}
+	expr, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.skipSpace(); p.pos < len(p.in) {
+		return nil, p.errorf("unexpected %q", p.in[p.pos:])
+	}
+	return expr, nil
+}
+
+func (this *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at %d of %q: %s", this.pos, this.in, fmt.Sprintf(format, args...))
+}
+
+func (this *parser) skipSpace() {
+	for this.pos < len(this.in) && (this.in[this.pos] == ' ' || this.in[this.pos] == '\t') {
+		this.pos++
+	}
+}
+
+func (this *parser) peek() byte {
+	if this.pos < len(this.in) {
+		return this.in[this.pos]
+	}
+	return 0
+}
+
+func (this *parser) expr() (*Expr, error) {
+	this.skipSpace()
+	start := this.pos
+	switch c := this.peek(); {
+	case c == 0:
+		return nil, this.errorf("expected an expression")
+	case c == '\'' || c == '"':
+		s, err := this.quoted(c)
+		if err != nil {
+			return nil, err
+		}
+		return &Expr{Kind: EXPR_STRING, Text: this.in[start:this.pos], Str: s}, nil
+	}
+
+	word := this.word()
+	if word == "" {
+		return nil, this.errorf("unexpected %q", string(this.peek()))
+	}
+	if this.peek() == '(' {
+		return this.call(word, start)
+	}
+	if n, err := strconv.ParseFloat(word, 64); err == nil && strings.IndexByte("0123456789+-.", word[0]) >= 0 {
+		isInt := !strings.ContainsAny(word, ".eE")
+		return &Expr{Kind: EXPR_NUMBER, Text: word, Number: n, IsInt: isInt}, nil
+	}
+	switch strings.ToLower(word) {
+	case "true", "false":
+		return &Expr{Kind: EXPR_BOOL, Text: word, Bool: strings.ToLower(word) == "true"}, nil
+	}
+	return &Expr{Kind: EXPR_PATH, Text: word, Name: word}, nil
+}
+
+/* A path expression, function name, number or boolean; commas within braces
+belong to the word */
+func (this *parser) word() string {
+	start := this.pos
+	braces := 0
+	for ; this.pos < len(this.in); this.pos++ {
+		switch c := this.in[this.pos]; c {
+		case '{':
+			braces++
+		case '}':
+			braces--
+		case ',':
+			if braces <= 0 {
+				return this.in[start:this.pos]
+			}
+		case '(', ')', '=', ' ', '\t', '\'', '"':
+			return this.in[start:this.pos]
+		}
+	}
+	return this.in[start:this.pos]
+}
+
+func (this *parser) quoted(quote byte) (string, error) {
+	this.pos++
+	end := strings.IndexByte(this.in[this.pos:], quote)
+	if end < 0 {
+		return "", this.errorf("unterminated string")
+	}
+	retval := this.in[this.pos : this.pos+end]
+	this.pos += end + 1
+	return retval, nil
+}
+
+func (this *parser) call(name string, start int) (*Expr, error) {
+	retval := &Expr{Kind: EXPR_CALL, Name: name, Args: []*Expr{}, Kwargs: map[string]*Expr{}}
+	this.pos++ // (
+	if this.skipSpace(); this.peek() == ')' {
+		this.pos++
+		retval.Text = this.in[start:this.pos]
+		return retval, nil
+	}
+	for {
+		this.skipSpace()
+		argStart := this.pos
+		arg, err := this.expr()
+		if err != nil {
+			return nil, err
+		}
+		if this.skipSpace(); this.peek() == '=' {
+			if arg.Kind != EXPR_PATH || strings.ContainsAny(arg.Name, ".*?[{") {
+				return nil, this.errorf("%q is not a keyword", this.in[argStart:this.pos])
+			}
+			this.pos++
+			value, err := this.expr()
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := retval.Kwargs[arg.Name]; dup {
+				return nil, this.errorf("%s given twice", arg.Name)
+			}
+			retval.Kwargs[arg.Name] = value
+		} else if len(retval.Kwargs) > 0 {
+			return nil, this.errorf("positional argument after keyword arguments")
+		} else {
+			retval.Args = append(retval.Args, arg)
+		}
+
+		this.skipSpace()
+		switch this.peek() {
+		case ',':
+			this.pos++
+		case ')':
+			this.pos++
+			retval.Text = this.in[start:this.pos]
+			return retval, nil
+		default:
+			return nil, this.errorf("expected , or )")
+		}
+	}
+}
@@ -0,0 +1,217 @@
+/*
+Evaluation of graphite render targets, such as
+
+	movingAverage(sumSeries(servers.*.cpu.user), '5min')
+
+A target is parsed into an expression; path expressions in it are fetched
+through a Fetcher & function calls are evaluated by the functions of the
+registry, see Register. Functions follow graphite-web's in what they compute
+as well as how they name the series they return.
+
+Series are laid out at a fixed step, as graphite's finders return them; a
+missing value is NaN, which is rendered as null
+*/
+package query
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"inmobi.com/graphite/carbon/logging"
+	"io"
+	"math"
+	"strconv"
+)
+
+var logger *logging.Logger
+
+func init() {
+	logger = logging.MakeLogger("query")
+}
+
+/* A value per step from Start on; End is past the last step */
+type Series struct {
+	Name           string
+	PathExpression string // what it was fetched by, or its name once derived anew
+	Start          uint64
+	End            uint64
+	Step           uint64
+	Values         []float64
+}
+
+/* Fetches the series a path expression, metric or glob, matches, in order of
+name, over a time range; both ends inclusive. None is not an error */
+type Fetcher interface {
+	Fetch(ctx context.Context, pathExpr string, from uint64, until uint64) ([]*Series, error)
+}
+
+type Context struct {
+	Ctx     context.Context
+	From    uint64
+	Until   uint64
+	Fetcher Fetcher
+}
+
+/* Parses & evaluates a target */
+func Eval(ctx *Context, target string) ([]*Series, error) {
+	expr, err := Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.eval(expr)
+}
+
+func (this *Context) eval(expr *Expr) ([]*Series, error) {
+	if err := this.Ctx.Err(); err != nil {
+		return nil, err
+	}
+	switch expr.Kind {
+	case EXPR_PATH:
+		return this.Fetcher.Fetch(this.Ctx, expr.Name, this.From, this.Until)
+	case EXPR_CALL:
+		fn, ok := lookup(expr.Name)
+		if !ok {
+			return nil, fmt.Errorf("unknown function %s", expr.Name)
+		}
+		retval, err := fn(&Call{expr, this})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", expr.Name, err)
+		}
+		return retval, nil
+	}
+	return nil, fmt.Errorf("%s is not a series", expr.Text)
+}
+
+/* The number of values the series spans */
+func (this *Series) Len() int {
+	return len(this.Values)
+}
+
+/* The timestamp of the i-th value */
+func (this *Series) At(i int) uint64 {
+	return this.Start + uint64(i)*this.Step
+}
+
+/* A copy by a new name, with new values; as graphite's TimeSeries.copy, the
+path expression becomes the name */
+func (this *Series) derive(name string, values []float64) *Series {
+	return &Series{name, name, this.Start, this.End, this.Step, values}
+}
+
+/* A copy by a new name with the same values; the path expression is kept, as
+graphite's alias functions rename series in place */
+func (this *Series) rename(name string) *Series {
+	retval := *this
+	retval.Name = name
+	retval.Values = append([]float64(nil), this.Values...)
+	return &retval
+}
+
+/* Consolidates every points values into one by averaging those that are not
+NaN, from the first value on, as graphite does */
+func (this *Series) consolidate(points int) []float64 {
+	if points <= 1 {
+		return this.Values
+	}
+	retval := make([]float64, 0, (len(this.Values)+points-1)/points)
+	for i := 0; i < len(this.Values); i += points {
+		j := i + points
+		if j > len(this.Values) {
+			j = len(this.Values)
+		}
+		retval = append(retval, avgOf(this.Values[i:j]))
+	}
+	return retval
+}
+
+/*
+Brings series to a common step, the least common multiple of theirs, for
+them to be combined value by value; as graphite's normalize, series are
+lined up by index from their first values on. Returns the values of each at
+the common step along with the start, end & step
+*/
+func normalize(series []*Series) ([][]float64, uint64, uint64, uint64) {
+	step := series[0].Step
+	for _, s := range series[1:] {
+		step = lcm(step, s.Step)
+	}
+	start, end := series[0].Start, series[0].End
+	values := make([][]float64, len(series))
+	for i, s := range series {
+		values[i] = s.consolidate(int(step / s.Step))
+		if s.Start < start {
+			start = s.Start
+		}
+		if s.End > end {
+			end = s.End
+		}
+	}
+	end -= (end - start) % step
+	return values, start, end, step
+}
+
+/* The values of series, lined up, as rows of a value per series; rows past
+the end of a series hold NaN in its place */
+func rows(values [][]float64) [][]float64 {
+	n := 0
+	for _, v := range values {
+		if len(v) > n {
+			n = len(v)
+		}
+	}
+	retval := make([][]float64, n)
+	for i := range retval {
+		row := make([]float64, len(values))
+		for j, v := range values {
+			row[j] = math.NaN()
+			if i < len(v) {
+				row[j] = v[i]
+			}
+		}
+		retval[i] = row
+	}
+	return retval
+}
+
+func gcd(a uint64, b uint64) uint64 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+func lcm(a uint64, b uint64) uint64 {
+	if a == b {
+		return a
+	}
+	return a / gcd(a, b) * b
+}
+
+/* Writes series as graphite-web's render API does for format=json:
+[{"target": ..., "datapoints": [[value, timestamp], ...]}, ...]. NaN &
+infinities are written as null */
+func WriteJSON(w io.Writer, series []*Series) error {
+	out := bufio.NewWriter(w)
+	out.WriteByte('[')
+	for i, s := range series {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		quoted, _ := json.Marshal(s.Name)
+		fmt.Fprintf(out, "{\"target\":%s,\"datapoints\":[", quoted)
+		for j, v := range s.Values {
+			if j > 0 {
+				out.WriteByte(',')
+			}
+			val := "null"
+			if !math.IsNaN(v) && !math.IsInf(v, 0) {
+				val = strconv.FormatFloat(v, 'g', -1, 64)
+			}
+			fmt.Fprintf(out, "[%s,%d]", val, s.At(j))
+		}
+		out.WriteString("]}")
+	}
+	out.WriteString("]\n")
+	return out.Flush()
+}
@@ -0,0 +1,176 @@
+package query
+
+import (
+	"fmt"
+	"sync"
+)
+
+/* Evaluates a call of a function; arguments are evaluated, if at all, as the
+function asks for them through the Call */
+type Function func(c *Call) ([]*Series, error)
+
+var functions = make(map[string]Function)
+var functionLock sync.RWMutex
+
+/* Adds a function to the registry, by the name targets call it by. Any
+package may register functions, at any point in time */
+func Register(name string, fn Function) {
+	functionLock.Lock()
+	defer functionLock.Unlock()
+
+	if fn == nil {
+		logger.Panicf("Trying to register nil for %s", name)
+	}
+	if _, dup := functions[name]; dup {
+		logger.Panicf("Function already registered under the name of %s", name)
+	}
+	functions[name] = fn
+}
+
+func lookup(name string) (Function, bool) {
+	functionLock.RLock()
+	defer functionLock.RUnlock()
+	fn, ok := functions[name]
+	return fn, ok
+}
+
+/* A call being evaluated. Arguments are looked up by position & else by
+keyword, as graphite's are */
+type Call struct {
+	expr *Expr
+	ctx  *Context
+}
+
+func (this *Call) Name() string {
+	return this.expr.Name
+}
+
+/* The time range the call is evaluated over */
+func (this *Call) Range() (uint64, uint64) {
+	return this.ctx.From, this.ctx.Until
+}
+
+/* The number of positional arguments */
+func (this *Call) Len() int {
+	return len(this.expr.Args)
+}
+
+/* An argument as parsed; nil if it is not given */
+func (this *Call) Arg(i int, name string) *Expr {
+	if i >= 0 && i < len(this.expr.Args) {
+		return this.expr.Args[i]
+	}
+	return this.expr.Kwargs[name]
+}
+
+func (this *Call) Has(i int, name string) bool {
+	return this.Arg(i, name) != nil
+}
+
+func (this *Call) _required(i int, name string) (*Expr, error) {
+	if arg := this.Arg(i, name); arg != nil {
+		return arg, nil
+	}
+	return nil, fmt.Errorf("missing %s", name)
+}
+
+/* A series list argument, evaluated */
+func (this *Call) Series(i int, name string) ([]*Series, error) {
+	arg, err := this._required(i, name)
+	if err != nil {
+		return nil, err
+	}
+	return this.ctx.eval(arg)
+}
+
+/* A series list argument evaluated from an earlier time on, e.g. to lead
+into a window over the range */
+func (this *Call) SeriesFrom(i int, name string, from uint64) ([]*Series, error) {
+	arg, err := this._required(i, name)
+	if err != nil {
+		return nil, err
+	}
+	ctx := *this.ctx
+	ctx.From = from
+	return ctx.eval(arg)
+}
+
+/* The series of every positional argument from i on, in order */
+func (this *Call) SeriesLists(i int) ([]*Series, error) {
+	retval := make([]*Series, 0)
+	for ; i < len(this.expr.Args); i++ {
+		series, err := this.ctx.eval(this.expr.Args[i])
+		if err != nil {
+			return nil, err
+		}
+		retval = append(retval, series...)
+	}
+	return retval, nil
+}
+
+func (this *Call) Float(i int, name string) (float64, error) {
+	arg, err := this._required(i, name)
+	if err != nil {
+		return 0, err
+	}
+	if arg.Kind != EXPR_NUMBER {
+		return 0, fmt.Errorf("%s: expected a number but got %s", name, arg.Text)
+	}
+	return arg.Number, nil
+}
+
+func (this *Call) FloatOr(i int, name string, def float64) (float64, error) {
+	if !this.Has(i, name) {
+		return def, nil
+	}
+	return this.Float(i, name)
+}
+
+func (this *Call) Int(i int, name string) (int, error) {
+	arg, err := this._required(i, name)
+	if err != nil {
+		return 0, err
+	}
+	if arg.Kind != EXPR_NUMBER || !arg.IsInt {
+		return 0, fmt.Errorf("%s: expected an integer but got %s", name, arg.Text)
+	}
+	return int(arg.Number), nil
+}
+
+func (this *Call) IntOr(i int, name string, def int) (int, error) {
+	if !this.Has(i, name) {
+		return def, nil
+	}
+	return this.Int(i, name)
+}
+
+/* The integers of every positional argument from i on */
+func (this *Call) Ints(i int, name string) ([]int, error) {
+	retval := make([]int, 0)
+	for ; i < len(this.expr.Args); i++ {
+		arg := this.expr.Args[i]
+		if arg.Kind != EXPR_NUMBER || !arg.IsInt {
+			return nil, fmt.Errorf("%s: expected an integer but got %s", name, arg.Text)
+		}
+		retval = append(retval, int(arg.Number))
+	}
+	return retval, nil
+}
+
+func (this *Call) String(i int, name string) (string, error) {
+	arg, err := this._required(i, name)
+	if err != nil {
+		return "", err
+	}
+	if arg.Kind != EXPR_STRING {
+		return "", fmt.Errorf("%s: expected a string but got %s", name, arg.Text)
+	}
+	return arg.Str, nil
+}
+
+func (this *Call) StringOr(i int, name string, def string) (string, error) {
+	if !this.Has(i, name) {
+		return def, nil
+	}
+	return this.String(i, name)
+}
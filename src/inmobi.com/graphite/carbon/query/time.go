@@ -0,0 +1,93 @@
+package query
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Units of time offsets by the prefix they are known by, e.g. min, mins &
+minutes; as graphite's, a month is 30 days & a year 365 */
+var offsetUnits = []struct {
+	prefix  string
+	seconds int64
+}{
+	{"s", 1},
+	{"min", 60},
+	{"h", 3600},
+	{"d", 86400},
+	{"w", 7 * 86400},
+	{"mon", 30 * 86400},
+	{"y", 365 * 86400},
+}
+
+/* Parses a time offset such as 5min, -1d or 1h30min into seconds */
+func ParseOffset(offset string) (int64, error) {
+	s := strings.TrimSpace(offset)
+	sign := int64(1)
+	if strings.HasPrefix(s, "-") {
+		sign, s = -1, s[1:]
+	} else if strings.HasPrefix(s, "+") {
+		s = s[1:]
+	}
+	if s == "" {
+		return 0, fmt.Errorf("bad time offset %q", offset)
+	}
+
+	var retval int64
+	for s != "" {
+		i := 0
+		for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+			i++
+		}
+		j := i
+		for j < len(s) && (s[j] < '0' || s[j] > '9') {
+			j++
+		}
+		n, err := strconv.ParseInt(s[:i], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad time offset %q", offset)
+		}
+		unit := strings.ToLower(s[i:j])
+		found := false
+		for _, u := range offsetUnits {
+			if strings.HasPrefix(unit, u.prefix) {
+				retval += n * u.seconds
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("bad time offset %q; unknown unit %q", offset, unit)
+		}
+		s = s[j:]
+	}
+	return sign * retval, nil
+}
+
+/* Parses the from or until of a render request: unix time, now or an offset
+from now, such as -1d or now-2h */
+func ParseTime(s string, now time.Time) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if x, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return x, nil
+	}
+	base := now.Unix()
+	if strings.HasPrefix(s, "now") {
+		if s = s[3:]; s == "" {
+			return uint64(base), nil
+		}
+	}
+	seconds, err := ParseOffset(s)
+	if err != nil {
+		return 0, err
+	}
+	if !strings.HasPrefix(s, "-") && !strings.HasPrefix(s, "+") {
+		return 0, fmt.Errorf("bad time %q; expected unix time or an offset such as -1d", s)
+	}
+	if base+seconds < 0 {
+		return 0, nil
+	}
+	return uint64(base + seconds), nil
+}
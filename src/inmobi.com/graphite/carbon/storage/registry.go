@@ -2,14 +2,13 @@ package storage
 
 import (
 	"inmobi.com/graphite/carbon/logging"
-	"log"
 )
 
-var logger *log.Logger
+var logger *logging.Logger
 var adapters = make(map[string]StorageAdapter)
 
 func init() {
-	logger = logging.MakeLogger("storage-gateway: ")
+	logger = logging.MakeLogger("storage-gateway")
 }
 
 func RegisterAdapter(name string, x StorageAdapter) {
@@ -19,7 +18,7 @@ func RegisterAdapter(name string, x StorageAdapter) {
 	if _, dup := adapters[name]; dup {
 		logger.Panicf("Adapter already registered under the name of %s", name)
 	} else {
-		logger.Printf("Registering storage engine named %s", name)
+		logger.Infof("Registering storage engine named %s", name)
 		adapters[name] = x
 	}
 }
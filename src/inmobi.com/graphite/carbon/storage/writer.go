@@ -1,8 +1,10 @@
 package storage
 
 import (
+	"inmobi.com/graphite/carbon/admin"
 	"inmobi.com/graphite/carbon/audit"
 	"inmobi.com/graphite/carbon/mq"
+	"net/http"
 	"strconv"
 	"sync/atomic"
 	"time"
@@ -27,9 +29,37 @@ func BuildDispatcher(config map[string]string, engine_conf map[string]string) St
 	}
 	storage.Init(engine_conf)
 	retval := StorageCore{storage}
+	admin.HandleJSON("/ratelimits", serveRateLimits)
+	admin.RegisterConfig("storage", struct {
+		Engine         string
+		Max_write_rpm  uint32
+		Max_create_rpm uint32
+	}{config["engine"], max_write_rpm, max_create_rpm})
 	return retval
 }
 
+/* The configured limits along with the usage so far in the current minute */
+type rateLimits struct {
+	Max_write_rpm  uint32
+	Max_create_rpm uint32
+
+	Write_operations          uint32
+	Metrics_created           uint32
+	Write_ratelimit_exceeded  uint32
+	Create_ratelimit_exceeded uint32
+}
+
+func serveRateLimits(r *http.Request) (interface{}, error) {
+	retval := rateLimits{Max_write_rpm: max_write_rpm, Max_create_rpm: max_create_rpm}
+	if audit := audit.GetMetrics(); audit != nil {
+		retval.Write_operations = atomic.LoadUint32(&audit.Writer.Write_operations)
+		retval.Metrics_created = atomic.LoadUint32(&audit.Writer.Metrics_created)
+		retval.Write_ratelimit_exceeded = atomic.LoadUint32(&audit.Writer.Write_ratelimit_exceeded)
+		retval.Create_ratelimit_exceeded = atomic.LoadUint32(&audit.Writer.Create_ratelimit_exceeded)
+	}
+	return retval, nil
+}
+
 /* Start "n" dispatchers working off a given command queue
 
 This method returns immediately after starting the dispatchers. Also, there
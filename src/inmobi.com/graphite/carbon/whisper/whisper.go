@@ -0,0 +1,161 @@
+/*
+Reader of whisper (.wsp) files, the storage format of stock carbon. A file is
+a header followed by archives of fixed size, each a ring of points at a
+given resolution, with the most precise archive first:
+
+	metadata      aggregation type, max retention, x-files factor, archive count
+	archive info  offset, seconds per point, number of points; one per archive
+	archives      points of (timestamp, value); 12 bytes each
+
+All numbers are big endian; 32 bit unsigned integers save for the x-files
+factor (float32) and the values (float64)
+*/
+package whisper
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+)
+
+const metadataSize = 16
+const archiveInfoSize = 12
+const pointSize = 12
+
+var ErrCorrupt = errors.New("corrupt whisper header")
+
+type Archive struct {
+	Offset          uint32
+	SecondsPerPoint uint32
+	Points          uint32
+}
+
+/* Time span covered by the archive, in seconds */
+func (this Archive) Retention() uint32 {
+	return this.SecondsPerPoint * this.Points
+}
+
+type Header struct {
+	Aggregation  uint32
+	MaxRetention uint32
+	XFilesFactor float32
+	Archives     []Archive
+}
+
+type Point struct {
+	Timestamp uint32
+	Value     float64
+}
+
+/* Parses & validates the header of a whisper file of a given size */
+func ReadHeader(r io.ReaderAt, size int64) (*Header, error) {
+	meta := make([]byte, metadataSize)
+	if _, err := r.ReadAt(meta, 0); err != nil {
+		return nil, err
+	}
+	retval := &Header{
+		Aggregation:  binary.BigEndian.Uint32(meta[0:4]),
+		MaxRetention: binary.BigEndian.Uint32(meta[4:8]),
+		XFilesFactor: math.Float32frombits(binary.BigEndian.Uint32(meta[8:12])),
+	}
+	count := binary.BigEndian.Uint32(meta[12:16])
+	if count == 0 || metadataSize+int64(count)*archiveInfoSize > size {
+		return nil, ErrCorrupt
+	}
+
+	infos := make([]byte, int64(count)*archiveInfoSize)
+	if _, err := r.ReadAt(infos, metadataSize); err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < count; i++ {
+		b := infos[i*archiveInfoSize:]
+		a := Archive{binary.BigEndian.Uint32(b[0:4]), binary.BigEndian.Uint32(b[4:8]), binary.BigEndian.Uint32(b[8:12])}
+		if a.SecondsPerPoint == 0 || a.Points == 0 || int64(a.Offset)+int64(a.Points)*pointSize > size {
+			return nil, ErrCorrupt
+		}
+		if i > 0 && a.SecondsPerPoint <= retval.Archives[i-1].SecondsPerPoint {
+			return nil, fmt.Errorf("archive %d is not coarser than the one before it", i)
+		}
+		retval.Archives = append(retval.Archives, a)
+	}
+	return retval, nil
+}
+
+/*
+The points of an archive that are current; the slots of the ring that have
+never been written to or that hold a point older than the retention of the
+archive as of now are skipped. Points are in no particular order
+*/
+func ReadArchive(r io.ReaderAt, a Archive, now uint32) ([]Point, error) {
+	raw := make([]byte, int64(a.Points)*pointSize)
+	if _, err := r.ReadAt(raw, int64(a.Offset)); err != nil {
+		return nil, err
+	}
+
+	base := int64(binary.BigEndian.Uint32(raw[0:4]))
+	if base == 0 {
+		return []Point{}, nil
+	}
+	step, slots := int64(a.SecondsPerPoint), int64(a.Points)
+	oldest := int64(now) - int64(a.Retention())
+
+	retval := make([]Point, 0, a.Points)
+	for j := int64(0); j < slots; j++ {
+		b := raw[j*pointSize:]
+		ts := int64(binary.BigEndian.Uint32(b[0:4]))
+		if ts == 0 || ts <= oldest || ts > int64(now) || ts%step != 0 {
+			continue
+		}
+		/* A point written in a past lap of the ring is at odds with the
+		slot it would take up in the current one */
+		if ((ts-base)/step%slots+slots)%slots != j {
+			continue
+		}
+		val := math.Float64frombits(binary.BigEndian.Uint64(b[4:12]))
+		retval = append(retval, Point{uint32(ts), val})
+	}
+	return retval, nil
+}
+
+/*
+The points of a file in order of time, each from the most precise archive
+covering it as of now: an archive only contributes points older than the
+retention of the archive before it
+*/
+func Dump(path string, now uint32) ([]Point, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := ReadHeader(f, stat.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	retval := make([]Point, 0)
+	newest := int64(now)
+	for _, a := range header.Archives {
+		points, err := ReadArchive(f, a, now)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range points {
+			if int64(p.Timestamp) <= newest {
+				retval = append(retval, p)
+			}
+		}
+		newest = int64(now) - int64(a.Retention())
+	}
+	sort.Slice(retval, func(i, j int) bool { return retval[i].Timestamp < retval[j].Timestamp })
+	return retval, nil
+}
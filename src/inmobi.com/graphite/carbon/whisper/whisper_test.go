@@ -0,0 +1,114 @@
+package whisper
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+/* Lays out a whisper file; the first point of every archive is taken as the
+base of its ring */
+func writeFile(t *testing.T, path string, archives []Archive, points [][]Point) {
+	offset := uint32(metadataSize + len(archives)*archiveInfoSize)
+	header := make([]byte, offset)
+	binary.BigEndian.PutUint32(header[0:4], 1)
+	binary.BigEndian.PutUint32(header[12:16], uint32(len(archives)))
+	size := offset
+	for i := range archives {
+		archives[i].Offset = size
+		b := header[metadataSize+i*archiveInfoSize:]
+		binary.BigEndian.PutUint32(b[0:4], archives[i].Offset)
+		binary.BigEndian.PutUint32(b[4:8], archives[i].SecondsPerPoint)
+		binary.BigEndian.PutUint32(b[8:12], archives[i].Points)
+		size += archives[i].Points * pointSize
+	}
+
+	raw := make([]byte, size)
+	copy(raw, header)
+	for i, a := range archives {
+		if len(points[i]) == 0 {
+			continue
+		}
+		base := int64(points[i][0].Timestamp)
+		for _, p := range points[i] {
+			slot := ((int64(p.Timestamp)-base)/int64(a.SecondsPerPoint)%int64(a.Points) + int64(a.Points)) % int64(a.Points)
+			b := raw[int64(a.Offset)+slot*pointSize:]
+			binary.BigEndian.PutUint32(b[0:4], p.Timestamp)
+			binary.BigEndian.PutUint64(b[4:12], math.Float64bits(p.Value))
+		}
+	}
+	assert.Nil(t, ioutil.WriteFile(path, raw, 0644))
+}
+
+func TestDump(t *testing.T) {
+	dir, err := ioutil.TempDir("", "whisper")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "x.wsp")
+
+	const now = 100020
+	archives := []Archive{{0, 60, 10}, {0, 300, 12}}
+	fine := make([]Point, 0)
+	for ts := uint32(99000); ts <= now; ts += 60 {
+		fine = append(fine, Point{ts, float64(ts)})
+	}
+	coarse := make([]Point, 0)
+	for ts := uint32(96300); ts <= 99900; ts += 300 {
+		coarse = append(coarse, Point{ts, -float64(ts)})
+	}
+	writeFile(t, path, archives, [][]Point{fine, coarse})
+
+	f, _ := os.Open(path)
+	defer f.Close()
+	stat, _ := f.Stat()
+	header, err := ReadHeader(f, stat.Size())
+	assert.Nil(t, err)
+	assert.Equal(t, len(header.Archives), 2)
+	assert.Equal(t, header.Archives[1].Retention(), uint32(3600))
+
+	/* The ring of the fine archive has wrapped; what it held from past laps
+	is overwritten */
+	points, err := ReadArchive(f, header.Archives[0], now)
+	assert.Nil(t, err)
+	assert.Equal(t, len(points), 10)
+
+	points, err = Dump(path, now)
+	assert.Nil(t, err)
+	expected := make([]Point, 0)
+	for _, p := range coarse {
+		if p.Timestamp > now-3600 && p.Timestamp <= now-600 {
+			expected = append(expected, p)
+		}
+	}
+	for _, p := range fine {
+		if p.Timestamp > now-600 {
+			expected = append(expected, p)
+		}
+	}
+	assert.Equal(t, points, expected)
+
+	/* Everything has aged out of the fine archive */
+	points, err = Dump(path, now+3000)
+	assert.Nil(t, err)
+	assert.NotEqual(t, len(points), 0)
+	for _, p := range points {
+		assert.True(t, p.Timestamp%300 == 0 && p.Timestamp > now+3000-3600)
+	}
+
+	assert.Nil(t, ioutil.WriteFile(path, []byte("garbage, not a whisper file"), 0644))
+	_, err = Dump(path, now)
+	assert.NotNil(t, err)
+}
+
+/* An archive count that overflows the size of the archive info in 32 bits */
+func TestHeaderOverflow(t *testing.T) {
+	raw := make([]byte, 64)
+	binary.BigEndian.PutUint32(raw[12:16], 357913942)
+	_, err := ReadHeader(bytes.NewReader(raw), int64(len(raw)))
+	assert.Equal(t, err, ErrCorrupt)
+}